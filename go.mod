@@ -1,6 +1,6 @@
 module go-blog
 
-go 1.13
+go 1.19
 
 require (
 	github.com/go-chi/chi v4.1.2+incompatible
@@ -8,5 +8,24 @@ require (
 	github.com/go-chi/render v1.0.1
 	github.com/lestrrat-go/jwx v1.1.0
 	github.com/mattn/go-sqlite3 v2.0.3+incompatible
+	github.com/microcosm-cc/bluemonday v1.0.21
+	github.com/mozillazg/go-unidecode v0.2.0
+	github.com/yuin/goldmark v1.4.15
+	github.com/yuin/goldmark-highlighting/v2 v2.0.0-20230729083705-37449abec8cc
 	golang.org/x/crypto v0.0.0-20210921155107-089bfa567519
 )
+
+require (
+	github.com/alecthomas/chroma/v2 v2.2.0 // indirect
+	github.com/aymerick/douceur v0.2.0 // indirect
+	github.com/dlclark/regexp2 v1.7.0 // indirect
+	github.com/goccy/go-json v0.3.5 // indirect
+	github.com/gorilla/css v1.0.0 // indirect
+	github.com/lestrrat-go/backoff/v2 v2.0.7 // indirect
+	github.com/lestrrat-go/httpcc v1.0.0 // indirect
+	github.com/lestrrat-go/iter v1.0.0 // indirect
+	github.com/lestrrat-go/option v1.0.0 // indirect
+	github.com/pkg/errors v0.9.1 // indirect
+	golang.org/x/net v0.0.0-20221002022538-bcab6841153b // indirect
+	golang.org/x/sys v0.0.0-20220728004956-3c1f35247d10 // indirect
+)
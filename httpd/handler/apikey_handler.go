@@ -0,0 +1,83 @@
+package handler
+
+import (
+	"errors"
+	"go-blog/platform/apikey"
+	"go-blog/platform/status"
+	"go-blog/platform/user"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi"
+	"github.com/go-chi/render"
+)
+
+// NoAPIKey rejects requests authenticated with an API key, so a leaked
+// key can't be used to take over the account or mint other keys.
+func NoAPIKey(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		claims := r.Context().Value(ClaimsKey).(user.Claims)
+		if claims.APIKeyID != 0 {
+			render.Render(w, r, status.ErrUnauthorized("Not allowed with an API key."))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func APIKeyGetAll(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(UserKey).(int64)
+	repo := r.Context().Value(APIKeyRepoKey).(*apikey.Repo)
+
+	keys := repo.GetByUserID(userID)
+	render.RenderList(w, r, apikey.NewKeyListPayload(keys))
+}
+
+func APIKeyPost(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(UserKey).(int64)
+	claims := r.Context().Value(ClaimsKey).(user.Claims)
+
+	if userID != claims.UserID {
+		render.Render(w, r, status.ErrUnauthorized("You can only create keys for yourself."))
+		return
+	}
+
+	data := &apikey.KeyPayload{}
+	if err := render.Bind(r, data); err != nil {
+		render.Render(w, r, status.ErrInvalidRequest(err))
+		return
+	}
+
+	keyTemp := data.Key
+	keyTemp.User_ID = userID
+
+	repo := r.Context().Value(APIKeyRepoKey).(*apikey.Repo)
+	if id, plain, err := repo.Add(keyTemp); err != nil {
+		render.Render(w, r, status.ErrInternal(err))
+		return
+	} else {
+		keyTemp.ID = id
+		data.Plain = plain
+	}
+
+	render.Status(r, http.StatusCreated)
+	render.Render(w, r, data)
+}
+
+func APIKeyDelete(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(UserKey).(int64)
+
+	keyID, err := strconv.ParseInt(chi.URLParam(r, "keyID"), 10, 64)
+	if err != nil || keyID < 1 {
+		render.Render(w, r, status.ErrInvalidRequest(errors.New("Invalid key id.")))
+		return
+	}
+
+	repo := r.Context().Value(APIKeyRepoKey).(*apikey.Repo)
+	if err := repo.Delete(keyID, userID); err != nil {
+		render.Render(w, r, status.ErrNotFound)
+		return
+	}
+
+	render.Render(w, r, status.DelSuccess())
+}
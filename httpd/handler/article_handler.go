@@ -3,21 +3,214 @@ package handler
 import (
 	"errors"
 	"go-blog/platform/article"
+	"go-blog/platform/audit"
 	"go-blog/platform/role"
 	"go-blog/platform/status"
+	"go-blog/platform/tag"
 	"go-blog/platform/user"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/go-chi/render"
 )
 
+// worksOnArticle reports whether the caller wrote or collaborates on the article.
+func worksOnArticle(r *http.Request, articleTemp *article.Article) bool {
+	claims := r.Context().Value(ClaimsKey).(user.Claims)
+	if !claims.Authenticated {
+		return false
+	}
+
+	articleRepo := r.Context().Value(ArticleRepoKey).(*article.Repo)
+	return articleTemp.User_ID == claims.UserID || articleRepo.IsCollaborator(articleTemp.ID, claims.UserID)
+}
+
+// canEditArticle reports whether the caller may change the article, rendering
+// an error if not. Authors, collaborators and article moderators can.
+func canEditArticle(w http.ResponseWriter, r *http.Request, articleTemp *article.Article) bool {
+	return worksOnArticle(r, articleTemp) || canModerateArticles(w, r)
+}
+
+// canModerateArticles reports whether the caller may change the articles of
+// others, rendering an error if not.
+func canModerateArticles(w http.ResponseWriter, r *http.Request) bool {
+	roleRepo := r.Context().Value(RoleRepoKey).(*role.Repo)
+	claims := r.Context().Value(ClaimsKey).(user.Claims)
+
+	tempRole, err := claimsRole(roleRepo, claims)
+	if err != nil {
+		render.Render(w, r, status.ErrInternal(err))
+		return false
+	}
+
+	if !tempRole.Check(role.CanManageOtherArticle) {
+		render.Render(w, r, status.ErrUnauthorized("You are not the author."))
+		return false
+	}
+
+	return true
+}
+
+// reviewsArticles reports whether the caller sees articles that aren't published.
+func reviewsArticles(r *http.Request) bool {
+	claims := r.Context().Value(ClaimsKey).(user.Claims)
+	if !claims.Authenticated {
+		return false
+	}
+
+	roleRepo := r.Context().Value(RoleRepoKey).(*role.Repo)
+	userRole, err := claimsRole(roleRepo, claims)
+	return err == nil && (userRole.Check(role.CanPublishArticle) || userRole.Check(role.CanManageOtherArticle))
+}
+
+// articleVisible renders not found and reports false when the caller can't see the article.
+func articleVisible(w http.ResponseWriter, r *http.Request, articleTemp *article.Article) bool {
+	if articleTemp.Status != article.Published && !worksOnArticle(r, articleTemp) && !reviewsArticles(r) {
+		render.Render(w, r, status.ErrNotFound)
+		return false
+	}
+	return true
+}
+
+// queryArticleStatus narrows a listing to the 'status' asked for, published
+// by default. Other statuses only list what the caller may see.
+func queryArticleStatus(w http.ResponseWriter, r *http.Request, search *article.Search) bool {
+	articleStatus := r.FormValue("status")
+	if articleStatus == "" {
+		articleStatus = article.Published
+	} else if !article.IsStatus(articleStatus) {
+		render.Render(w, r, status.ErrInvalidRequest(errors.New("Invalid status.")))
+		return false
+	}
+
+	search.QueryStatus(articleStatus)
+	if articleStatus == article.Published || reviewsArticles(r) {
+		return true
+	}
+
+	claims := r.Context().Value(ClaimsKey).(user.Claims)
+	if !claims.Authenticated {
+		render.Render(w, r, status.ErrUnauthorized("Only published articles are public."))
+		return false
+	}
+
+	search.QueryWorkedOnBy(claims.UserID)
+	return true
+}
+
+// queryArticleTaxonomy narrows a listing to the articles with every tag of
+// 'tag', separated by commas, and within 'category' or its subcategories.
+func queryArticleTaxonomy(w http.ResponseWriter, r *http.Request, search *article.Search) bool {
+	if tags := r.FormValue("tag"); tags != "" {
+		for _, name := range strings.Split(tags, ",") {
+			if name = tag.Normalize(name); name != "" {
+				search.QueryTag(name)
+			}
+		}
+	}
+
+	if categoryID := r.FormValue("category"); categoryID != "" {
+		id, err := strconv.ParseInt(categoryID, 10, 64)
+		if err != nil || id < 1 {
+			render.Render(w, r, status.ErrInvalidRequest(errors.New("Invalid category id.")))
+			return false
+		}
+		search.QueryCategory(id)
+	}
+
+	return true
+}
+
+// ArticleSetStatus moves an article through the workflow. Authors and
+// collaborators submit drafts for review, publishing takes the publish
+// permission and taking an article down is up to its author or a reviewer.
+// Scheduling, or rescheduling, needs 'publish_at' as a unix time to come.
+func ArticleSetStatus(w http.ResponseWriter, r *http.Request) {
+	articleTemp := r.Context().Value(ArticleKey).(*article.Article)
+	claims := r.Context().Value(ClaimsKey).(user.Claims)
+
+	to := r.FormValue("status")
+	if !article.IsStatus(to) {
+		render.Render(w, r, status.ErrInvalidRequest(errors.New("Status must be one of draft, in_review, scheduled, published or archived.")))
+		return
+	}
+
+	now := time.Now().Unix()
+	publishAt := int64(0)
+	switch to {
+	case article.Scheduled:
+		var err error
+		if publishAt, err = strconv.ParseInt(r.FormValue("publish_at"), 10, 64); err != nil || publishAt <= now {
+			render.Render(w, r, status.ErrInvalidRequest(errors.New("Scheduled articles need a publish_at in the future.")))
+			return
+		}
+	case article.Published:
+		publishAt = now
+	case article.Archived:
+		publishAt = articleTemp.Publish_At // keeps when it was live.
+	}
+
+	if !articleVisible(w, r, articleTemp) {
+		return
+	}
+
+	from := articleTemp.Status
+	if from == to && to != article.Scheduled {
+		render.Render(w, r, article.NewArticlePayload(articleTemp, user.NotAuthenticated, nil, nil))
+		return
+	}
+	if !article.CanTransition(from, to) {
+		render.Render(w, r, status.ErrConflict("A "+from+" article can't be moved to "+to+"."))
+		return
+	}
+
+	roleRepo := r.Context().Value(RoleRepoKey).(*role.Repo)
+	userRole, err := claimsRole(roleRepo, claims)
+	if err != nil {
+		render.Render(w, r, status.ErrInternal(err))
+		return
+	}
+
+	publisher := userRole.Check(role.CanPublishArticle)
+	var allowed bool
+	switch {
+	case to == article.Published || to == article.Scheduled:
+		allowed = publisher
+	case from == article.Published || from == article.Archived:
+		allowed = articleTemp.User_ID == claims.UserID || publisher || userRole.Check(role.CanManageOtherArticle)
+	default: // between draft and review
+		allowed = worksOnArticle(r, articleTemp) || (to == article.Draft && publisher)
+	}
+	if !allowed {
+		render.Render(w, r, status.ErrUnauthorized("You can't move this article to "+to+"."))
+		return
+	}
+
+	articleRepo := r.Context().Value(ArticleRepoKey).(*article.Repo)
+	if err := articleRepo.SetStatus(articleTemp.ID, to, publishAt); err != nil {
+		render.Render(w, r, status.ErrInternal(err))
+		return
+	}
+
+	if articleTemp.User_ID != claims.UserID {
+		recordAudit(r, audit.ArticleSetStatus, audit.TargetArticle, articleTemp.ID,
+			map[string]interface{}{"status": from, "publish_at": articleTemp.Publish_At},
+			map[string]interface{}{"status": to, "publish_at": publishAt})
+	}
+	articleTemp.Status, articleTemp.Publish_At = to, publishAt
+
+	render.Render(w, r, article.NewArticlePayload(articleTemp, user.NotAuthenticated, nil, nil))
+}
+
 func ArticleDelete(w http.ResponseWriter, r *http.Request) {
 	articleTemp := r.Context().Value(ArticleKey).(*article.Article)
 	articleRepo := r.Context().Value(ArticleRepoKey).(*article.Repo)
 	roleRepo := r.Context().Value(RoleRepoKey).(*role.Repo)
 
 	claims := r.Context().Value(ClaimsKey).(user.Claims)
-	tempRole, err := roleRepo.GetByID(claims.RoleID)
+	tempRole, err := claimsRole(roleRepo, claims)
 	if err != nil {
 		render.Render(w, r, status.ErrInternal(err))
 		return
@@ -33,6 +226,10 @@ func ArticleDelete(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if articleTemp.User_ID != claims.UserID {
+		recordAudit(r, audit.ArticleDelete, audit.TargetArticle, articleTemp.ID, articleTemp, nil)
+	}
+
 	render.Render(w, r, status.DelSuccess())
 }
 
@@ -43,6 +240,13 @@ func ArticleToggleFavorite(w http.ResponseWriter, r *http.Request) {
 
 	articleID := articleTemp.ID
 
+	if !articleVisible(w, r, articleTemp) {
+		return
+	} else if articleTemp.Status != article.Published {
+		render.Render(w, r, status.ErrInvalidRequest(errors.New("Only published articles can be liked.")))
+		return
+	}
+
 	if articleTemp.User_ID == claims.UserID {
 		render.Render(w, r, status.ErrInvalidRequest(errors.New("You cant like your own article.")))
 		return
@@ -63,7 +267,11 @@ func ArticleToggleFavorite(w http.ResponseWriter, r *http.Request) {
 func ArticleUpdate(w http.ResponseWriter, r *http.Request) {
 	articleTemp := r.Context().Value(ArticleKey).(*article.Article)
 
-	created_at := articleTemp.Created_At
+	id, created_at := articleTemp.ID, articleTemp.Created_At
+	articleStatus, publishAt := articleTemp.Status, articleTemp.Publish_At
+	before := *articleTemp
+	// decoding the body writes into the tags' array, the audit needs its own.
+	before.Tags = append([]string(nil), articleTemp.Tags...)
 
 	articlePayload := article.NewArticlePayload(articleTemp, user.NotAuthenticated, nil, nil)
 
@@ -72,30 +280,32 @@ func ArticleUpdate(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	articlePayload.ID = id                 // the body can't move the update to another article.
 	articlePayload.Created_At = created_at // keep the created date same as before.
+	articlePayload.Status = articleStatus  // changes go through ArticleSetStatus.
+	articlePayload.Publish_At = publishAt
 
 	articleTemp = articlePayload.Article
 
 	articleRepo := r.Context().Value(ArticleRepoKey).(*article.Repo)
-	roleRepo := r.Context().Value(RoleRepoKey).(*role.Repo)
 	claims := r.Context().Value(ClaimsKey).(user.Claims)
 
-	tempRole, err := roleRepo.GetByID(claims.RoleID)
-	if err != nil {
-		render.Render(w, r, status.ErrInternal(err))
+	if !canEditArticle(w, r, articleTemp) || !categoryExists(w, r, articleTemp.Category_ID) {
 		return
 	}
 
-	if articleTemp.User_ID != claims.UserID && !tempRole.Check(role.CanManageOtherArticle) {
-		render.Render(w, r, status.ErrUnauthorized("You are not the author."))
+	if err := articleRepo.Update(articleTemp, claims.UserID); err == article.ErrSlugTaken {
+		render.Render(w, r, status.ErrConflict(err.Error()))
 		return
-	}
-
-	if err := articleRepo.Update(articleTemp); err != nil {
+	} else if err != nil {
 		render.Render(w, r, status.ErrInternal(err))
 		return
 	}
 
+	if articleTemp.User_ID != claims.UserID {
+		recordAudit(r, audit.ArticleUpdate, audit.TargetArticle, articleTemp.ID, &before, articleTemp)
+	}
+
 	render.Status(r, http.StatusOK)
 	render.Render(w, r, article.NewArticlePayload(articleTemp, user.NotAuthenticated, nil, nil))
 }
@@ -107,6 +317,10 @@ func ArticleGetByID(w http.ResponseWriter, r *http.Request) {
 	var roleRepo *role.Repo
 	userRepo = r.Context().Value(UserRepoKey).(*user.Repo)
 
+	if !articleVisible(w, r, articleTemp) {
+		return
+	}
+
 	if r.FormValue("user") != "0" {
 		roleRepo = r.Context().Value(RoleRepoKey).(*role.Repo)
 	}
@@ -122,6 +336,9 @@ func ArticleGetMultiple(w http.ResponseWriter, r *http.Request) {
 	search := article.NewSearch()
 	search.QueryDate(dates[0], dates[1])
 	search.QueryKeyword(r.FormValue("search"))
+	if !queryArticleStatus(w, r, search) || !queryArticleTaxonomy(w, r, search) {
+		return
+	}
 	search.Limit(page, r.FormValue("sort"))
 	articles := articleRepo.GetMultiple(search)
 
@@ -151,7 +368,7 @@ func ArticlePost(w http.ResponseWriter, r *http.Request) {
 	claims := r.Context().Value(ClaimsKey).(user.Claims)
 
 	articleTemp.User_ID = claims.UserID
-	tempRole, err := roleRepo.GetByID(claims.RoleID)
+	tempRole, err := claimsRole(roleRepo, claims)
 	if err != nil {
 		render.Render(w, r, status.ErrInternal(err))
 		return
@@ -162,7 +379,41 @@ func ArticlePost(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if id, err := articleRepo.Add(articleTemp); err != nil {
+	if !categoryExists(w, r, articleTemp.Category_ID) {
+		return
+	}
+
+	switch articleTemp.Status {
+	case article.Draft, article.InReview:
+		articleTemp.Publish_At = 0
+	case article.Published, article.Scheduled:
+		if !tempRole.Check(role.CanPublishArticle) {
+			render.Render(w, r, status.ErrUnauthorized("You are not authorized to publish articles."))
+			return
+		}
+		if articleTemp.Status == article.Published {
+			articleTemp.Publish_At = articleTemp.Created_At
+		}
+	default:
+		render.Render(w, r, status.ErrInvalidRequest(errors.New("New articles can't be "+articleTemp.Status+".")))
+		return
+	}
+
+	if tempRole.Require_Verified {
+		userRepo := r.Context().Value(UserRepoKey).(*user.Repo)
+		if userTemp, err := userRepo.GetByID(claims.UserID); err != nil {
+			render.Render(w, r, status.ErrInternal(err))
+			return
+		} else if !userTemp.Verified {
+			render.Render(w, r, status.ErrUnauthorized("You need to verify your email first."))
+			return
+		}
+	}
+
+	if id, err := articleRepo.Add(articleTemp); err == article.ErrSlugTaken {
+		render.Render(w, r, status.ErrConflict(err.Error()))
+		return
+	} else if err != nil {
 		render.Render(w, r, status.ErrInternal(err))
 		return
 	} else {
@@ -0,0 +1,74 @@
+package handler
+
+import (
+	"go-blog/platform/audit"
+	"go-blog/platform/role"
+	"go-blog/platform/status"
+	"go-blog/platform/user"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/middleware"
+	"github.com/go-chi/render"
+)
+
+// recordAudit appends a privileged action of the authenticated user to the
+// audit log. It is written after the action's own transaction committed, so
+// an action whose entry fails to write still stands, the failure is logged.
+func recordAudit(r *http.Request, action string, targetType string, targetID int64, before interface{}, after interface{}) {
+	auditRepo := r.Context().Value(AuditRepoKey).(*audit.Repo)
+	claims := r.Context().Value(ClaimsKey).(user.Claims)
+
+	auditRepo.Add(&audit.Entry{
+		Actor_ID:    claims.UserID,
+		Action:      action,
+		Target_Type: targetType,
+		Target_ID:   targetID,
+		Before:      audit.Snapshot(before),
+		After:       audit.Snapshot(after),
+		Request_ID:  middleware.GetReqID(r.Context()),
+		Created_At:  time.Now().Unix(),
+	})
+}
+
+// userSnapshot is what the audit log keeps of a user, never the password.
+func userSnapshot(userTemp *user.User) *user.User {
+	if userTemp == nil {
+		return nil
+	}
+	snapshot := *userTemp
+	snapshot.Password = ""
+	return &snapshot
+}
+
+// AuditGetMultiple lists the audit log, newest first. It can be filtered by
+// 'actor', 'action', 'target_type', 'target_id', 'request_id' and 'date'.
+func AuditGetMultiple(w http.ResponseWriter, r *http.Request) {
+	roleRepo := r.Context().Value(RoleRepoKey).(*role.Repo)
+	claims := r.Context().Value(ClaimsKey).(user.Claims)
+
+	if userRole, err := claimsRole(roleRepo, claims); err != nil {
+		render.Render(w, r, status.ErrInternal(err))
+		return
+	} else if !userRole.Check(role.CanReadAudit) {
+		render.Render(w, r, status.ErrUnauthorized("You are not authorized to read the audit log."))
+		return
+	} else if missingTOTP(userRole, claims) {
+		render.Render(w, r, status.ErrUnauthorized("Two-factor authentication is required for this action."))
+		return
+	}
+
+	auditRepo := r.Context().Value(AuditRepoKey).(*audit.Repo)
+	page := r.Context().Value(PageKey).(int)
+	dates := r.Context().Value(DatesKey).([2]int64)
+
+	search := audit.NewSearch()
+	search.QueryDate(dates[0], dates[1])
+	search.QueryActorID(r.FormValue("actor"))
+	search.QueryAction(r.FormValue("action"))
+	search.QueryTarget(r.FormValue("target_type"), r.FormValue("target_id"))
+	search.QueryRequestID(r.FormValue("request_id"))
+	search.Limit(page)
+
+	render.RenderList(w, r, audit.NewEntryListPayload(auditRepo.GetMultiple(search)))
+}
@@ -0,0 +1,151 @@
+package handler
+
+import (
+	"database/sql"
+	"errors"
+	"go-blog/platform/audit"
+	"go-blog/platform/category"
+	"go-blog/platform/status"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi"
+	"github.com/go-chi/render"
+)
+
+// categoryExists renders an error and reports false when an article is
+// given a category that doesn't exist. 0 is no category.
+func categoryExists(w http.ResponseWriter, r *http.Request, categoryID int64) bool {
+	if categoryID == 0 {
+		return true
+	}
+
+	categoryRepo := r.Context().Value(CategoryRepoKey).(*category.Repo)
+	if _, err := categoryRepo.GetByID(categoryID); err == sql.ErrNoRows {
+		render.Render(w, r, status.ErrInvalidRequest(errors.New("Category does not exist.")))
+		return false
+	} else if err != nil {
+		render.Render(w, r, status.ErrInternal(err))
+		return false
+	}
+
+	return true
+}
+
+// managedCategory loads the category in the url for a tag manager, or
+// renders an error and returns nil.
+func managedCategory(w http.ResponseWriter, r *http.Request) *category.Category {
+	if !canManageTags(w, r, "categories") {
+		return nil
+	}
+
+	id, err := strconv.ParseInt(chi.URLParam(r, "categoryID"), 10, 64)
+	if err != nil || id < 1 {
+		render.Render(w, r, status.ErrInvalidRequest(errors.New("Invalid category id.")))
+		return nil
+	}
+
+	categoryRepo := r.Context().Value(CategoryRepoKey).(*category.Repo)
+	categoryTemp, err := categoryRepo.GetByID(id)
+	if err == sql.ErrNoRows {
+		render.Render(w, r, status.ErrNotFound)
+		return nil
+	} else if err != nil {
+		render.Render(w, r, status.ErrInternal(err))
+		return nil
+	}
+
+	return categoryTemp
+}
+
+// categoryError renders what went wrong saving a category.
+func categoryError(w http.ResponseWriter, r *http.Request, err error) {
+	switch err {
+	case sql.ErrNoRows:
+		render.Render(w, r, status.ErrInvalidRequest(errors.New("Parent category does not exist.")))
+	case category.ErrExists, category.ErrCycle:
+		render.Render(w, r, status.ErrConflict(err.Error()))
+	default:
+		render.Render(w, r, status.ErrInternal(err))
+	}
+}
+
+func CategoryGetAll(w http.ResponseWriter, r *http.Request) {
+	categoryRepo := r.Context().Value(CategoryRepoKey).(*category.Repo)
+	render.RenderList(w, r, category.NewCategoryListPayload(categoryRepo.GetAll()))
+}
+
+func CategoryPost(w http.ResponseWriter, r *http.Request) {
+	if !canManageTags(w, r, "categories") {
+		return
+	}
+
+	data := &category.CategoryPayload{}
+	if err := render.Bind(r, data); err != nil {
+		render.Render(w, r, status.ErrInvalidRequest(err))
+		return
+	}
+
+	categoryTemp := data.Category
+	categoryTemp.ID = 0
+	categoryTemp.Article_Count = 0
+
+	categoryRepo := r.Context().Value(CategoryRepoKey).(*category.Repo)
+	id, err := categoryRepo.Add(categoryTemp)
+	if err != nil {
+		categoryError(w, r, err)
+		return
+	}
+	categoryTemp.ID = id
+
+	recordAudit(r, audit.CategoryCreate, audit.TargetCategory, id, nil, categoryTemp)
+
+	render.Status(r, http.StatusCreated)
+	render.Render(w, r, category.NewCategoryPayload(categoryTemp))
+}
+
+// CategoryUpdate renames a category or moves it under another 'parent_id'.
+func CategoryUpdate(w http.ResponseWriter, r *http.Request) {
+	categoryTemp := managedCategory(w, r)
+	if categoryTemp == nil {
+		return
+	}
+
+	before := *categoryTemp
+	data := category.NewCategoryPayload(categoryTemp)
+	if err := render.Bind(r, data); err != nil {
+		render.Render(w, r, status.ErrInvalidRequest(err))
+		return
+	}
+
+	data.ID = before.ID                 // the body can't move the update to another category.
+	data.Created_At = before.Created_At // keep the created date same as before.
+
+	categoryRepo := r.Context().Value(CategoryRepoKey).(*category.Repo)
+	if err := categoryRepo.Update(data.Category); err != nil {
+		categoryError(w, r, err)
+		return
+	}
+
+	recordAudit(r, audit.CategoryUpdate, audit.TargetCategory, before.ID, &before, data.Category)
+
+	render.Render(w, r, data)
+}
+
+// CategoryDelete deletes a category, its articles and subcategories move up to its parent.
+func CategoryDelete(w http.ResponseWriter, r *http.Request) {
+	categoryTemp := managedCategory(w, r)
+	if categoryTemp == nil {
+		return
+	}
+
+	categoryRepo := r.Context().Value(CategoryRepoKey).(*category.Repo)
+	if err := categoryRepo.Delete(categoryTemp); err != nil {
+		render.Render(w, r, status.ErrInternal(err))
+		return
+	}
+
+	recordAudit(r, audit.CategoryDelete, audit.TargetCategory, categoryTemp.ID, categoryTemp, nil)
+
+	render.Render(w, r, status.DelSuccess())
+}
@@ -0,0 +1,132 @@
+package handler
+
+import (
+	"database/sql"
+	"errors"
+	"go-blog/platform/article"
+	"go-blog/platform/audit"
+	"go-blog/platform/role"
+	"go-blog/platform/status"
+	"go-blog/platform/user"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/go-chi/render"
+)
+
+// collaboratorUserID reads the userID url parameter, or renders an error and returns 0.
+func collaboratorUserID(w http.ResponseWriter, r *http.Request) int64 {
+	userID, err := strconv.ParseInt(chi.URLParam(r, "userID"), 10, 64)
+	if err != nil || userID < 1 {
+		render.Render(w, r, status.ErrInvalidRequest(errors.New("Invalid user id.")))
+		return 0
+	}
+	return userID
+}
+
+// CollaboratorGetAll lists the editors and co-authors of an article to the
+// people working on it.
+func CollaboratorGetAll(w http.ResponseWriter, r *http.Request) {
+	articleTemp := r.Context().Value(ArticleKey).(*article.Article)
+	articleRepo := r.Context().Value(ArticleRepoKey).(*article.Repo)
+
+	if !canEditArticle(w, r, articleTemp) {
+		return
+	}
+
+	userRepo := r.Context().Value(UserRepoKey).(*user.Repo)
+	roleRepo := r.Context().Value(RoleRepoKey).(*role.Repo)
+	collaborators := articleRepo.GetCollaborators(articleTemp.ID)
+	render.RenderList(w, r, article.NewCollaboratorListPayload(collaborators, userRepo, roleRepo))
+}
+
+// CollaboratorPut invites a user to the article with the given 'role',
+// or changes the role of someone already on it.
+func CollaboratorPut(w http.ResponseWriter, r *http.Request) {
+	articleTemp := r.Context().Value(ArticleKey).(*article.Article)
+	claims := r.Context().Value(ClaimsKey).(user.Claims)
+
+	userID := collaboratorUserID(w, r)
+	if userID == 0 {
+		return
+	}
+
+	collaboratorRole := r.FormValue("role")
+	if collaboratorRole != article.Editor && collaboratorRole != article.CoAuthor {
+		render.Render(w, r, status.ErrInvalidRequest(errors.New("Role must be 'editor' or 'co-author'.")))
+		return
+	}
+
+	// collaborators can't invite others, only the author and moderators.
+	if articleTemp.User_ID != claims.UserID && !canModerateArticles(w, r) {
+		return
+	}
+
+	if userID == articleTemp.User_ID {
+		render.Render(w, r, status.ErrInvalidRequest(errors.New("The author can't be a collaborator.")))
+		return
+	}
+
+	userRepo := r.Context().Value(UserRepoKey).(*user.Repo)
+	if _, err := userRepo.GetByID(userID); err == sql.ErrNoRows {
+		render.Render(w, r, status.ErrNotFound)
+		return
+	} else if err != nil {
+		render.Render(w, r, status.ErrInternal(err))
+		return
+	}
+
+	collaborator := &article.Collaborator{
+		Article_ID: articleTemp.ID,
+		User_ID:    userID,
+		Role:       collaboratorRole,
+		Created_At: time.Now().Unix(),
+	}
+
+	articleRepo := r.Context().Value(ArticleRepoKey).(*article.Repo)
+	if err := articleRepo.SetCollaborator(collaborator); err != nil {
+		render.Render(w, r, status.ErrInternal(err))
+		return
+	}
+
+	if articleTemp.User_ID != claims.UserID {
+		recordAudit(r, audit.CollaboratorSet, audit.TargetArticle, articleTemp.ID, nil, collaborator)
+	}
+
+	roleRepo := r.Context().Value(RoleRepoKey).(*role.Repo)
+	render.RenderList(w, r, article.NewCollaboratorListPayload(articleRepo.GetCollaborators(articleTemp.ID), userRepo, roleRepo))
+}
+
+// CollaboratorDelete removes a user from the article. Collaborators can
+// remove themselves.
+func CollaboratorDelete(w http.ResponseWriter, r *http.Request) {
+	articleTemp := r.Context().Value(ArticleKey).(*article.Article)
+	articleRepo := r.Context().Value(ArticleRepoKey).(*article.Repo)
+	claims := r.Context().Value(ClaimsKey).(user.Claims)
+
+	userID := collaboratorUserID(w, r)
+	if userID == 0 {
+		return
+	}
+
+	if userID != claims.UserID && articleTemp.User_ID != claims.UserID && !canModerateArticles(w, r) {
+		return
+	}
+
+	if err := articleRepo.RemoveCollaborator(articleTemp.ID, userID); err == sql.ErrNoRows {
+		render.Render(w, r, status.ErrNotFound)
+		return
+	} else if err != nil {
+		render.Render(w, r, status.ErrInternal(err))
+		return
+	}
+
+	if articleTemp.User_ID != claims.UserID && userID != claims.UserID {
+		recordAudit(r, audit.CollaboratorUnset, audit.TargetArticle, articleTemp.ID,
+			map[string]int64{"user_id": userID}, nil)
+	}
+
+	render.Render(w, r, status.DelSuccess())
+}
@@ -1,12 +1,15 @@
 package handler
 
 import (
+	"errors"
 	"go-blog/platform/article"
+	"go-blog/platform/audit"
 	"go-blog/platform/comment"
 	"go-blog/platform/role"
 	"go-blog/platform/status"
 	"go-blog/platform/user"
 	"net/http"
+	"strconv"
 
 	"github.com/go-chi/render"
 )
@@ -17,7 +20,12 @@ func CommentDelete(w http.ResponseWriter, r *http.Request) {
 	roleRepo := r.Context().Value(RoleRepoKey).(*role.Repo)
 	claims := r.Context().Value(ClaimsKey).(user.Claims)
 
-	tempRole, err := roleRepo.GetByID(claims.RoleID)
+	if commentTemp.Deleted {
+		render.Render(w, r, status.ErrNotFound)
+		return
+	}
+
+	tempRole, err := claimsRole(roleRepo, claims)
 	if err != nil {
 		render.Render(w, r, status.ErrInternal(err))
 		return
@@ -29,19 +37,121 @@ func CommentDelete(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := commentRepo.Delete(commentTemp.ID); err != nil {
+	if err := commentRepo.Delete(commentTemp); err != nil {
 		render.Render(w, r, status.ErrInvalidRequest(err))
 		return
 	}
 
+	if commentTemp.User_ID != claims.UserID {
+		recordAudit(r, audit.CommentDelete, audit.TargetComment, commentTemp.ID, commentTemp, nil)
+	}
+
 	render.Render(w, r, status.DelSuccess())
 }
 
+// canSeeShadowed reports whether the caller sees the shadowed comments of others.
+func canSeeShadowed(r *http.Request) bool {
+	claims := r.Context().Value(ClaimsKey).(user.Claims)
+	if !claims.Authenticated {
+		return false
+	}
+
+	roleRepo := r.Context().Value(RoleRepoKey).(*role.Repo)
+	userRole, err := claimsRole(roleRepo, claims)
+	return err == nil && userRole.Check(role.CanManageOtherComments)
+}
+
+// hideShadowed limits the search to comments the caller may see.
+func hideShadowed(r *http.Request, search *comment.Search) {
+	if !canSeeShadowed(r) {
+		claims := r.Context().Value(ClaimsKey).(user.Claims)
+		search.QueryVisibleTo(claims.UserID)
+	}
+}
+
+// commentArticle loads the article of the comment, or renders not found and
+// returns nil when the caller can't see either.
+func commentArticle(w http.ResponseWriter, r *http.Request, commentTemp *comment.Comment) *article.Article {
+	claims := r.Context().Value(ClaimsKey).(user.Claims)
+	ownComment := commentTemp.User_ID == claims.UserID && !commentTemp.Deleted
+	if commentTemp.Shadowed && !ownComment && !canSeeShadowed(r) {
+		render.Render(w, r, status.ErrNotFound)
+		return nil
+	}
+
+	articleRepo := r.Context().Value(ArticleRepoKey).(*article.Repo)
+	articleTemp, err := articleRepo.GetByID(strconv.FormatInt(commentTemp.Article_ID, 10))
+	if err != nil {
+		render.Render(w, r, status.ErrNotFound)
+		return nil
+	} else if !articleVisible(w, r, articleTemp) {
+		return nil
+	}
+
+	return articleTemp
+}
+
+// commentAsSeen loads the comment the way lists show it to the caller, with
+// the replies they can get counted, or nil when they can't see it.
+func commentAsSeen(r *http.Request, id int64) *comment.Comment {
+	commentRepo := r.Context().Value(CommentRepoKey).(*comment.Repo)
+	search := comment.NewSearch()
+	search.QueryID(id)
+	hideShadowed(r, search)
+
+	if comments := commentRepo.GetMultiple(search); len(comments) > 0 {
+		return comments[0]
+	}
+	return nil
+}
+
+// replyDepth reads how many levels of replies to nest under the comments
+// listed, 'depth'.
+func replyDepth(w http.ResponseWriter, r *http.Request) (int, bool) {
+	depth := comment.REPLY_DEPTH
+	if value := r.FormValue("depth"); value != "" {
+		var err error
+		if depth, err = strconv.Atoi(value); err != nil || depth < 0 || depth > comment.MAX_REPLY_DEPTH {
+			render.Render(w, r, status.ErrInvalidRequest(errors.New("Invalid depth.")))
+			return 0, false
+		}
+	}
+
+	return depth, true
+}
+
+// commentReplies loads the replies the caller may see under the comments,
+// depth levels down.
+func commentReplies(r *http.Request, comments []*comment.Comment, depth int) []*comment.Comment {
+	if depth == 0 || len(comments) == 0 {
+		return nil
+	}
+
+	ids := []int64{}
+	for _, commentTemp := range comments {
+		ids = append(ids, commentTemp.ID)
+	}
+
+	commentRepo := r.Context().Value(CommentRepoKey).(*comment.Repo)
+	search := comment.NewSearch()
+	search.QueryRepliesTo(ids, depth)
+	hideShadowed(r, search)
+	search.LimitReplies()
+	return commentRepo.GetMultiple(search)
+}
+
 func CommentGetByID(w http.ResponseWriter, r *http.Request) {
 	commentTemp := r.Context().Value(CommentKey).(*comment.Comment)
 	var userRepo *user.Repo
 	var roleRepo *role.Repo
 
+	if commentArticle(w, r, commentTemp) == nil {
+		return
+	} else if commentTemp = commentAsSeen(r, commentTemp.ID); commentTemp == nil {
+		render.Render(w, r, status.ErrNotFound)
+		return
+	}
+
 	if r.FormValue("user") != "0" {
 		userRepo = r.Context().Value(UserRepoKey).(*user.Repo)
 		roleRepo = r.Context().Value(RoleRepoKey).(*role.Repo)
@@ -53,8 +163,13 @@ func CommentGetByID(w http.ResponseWriter, r *http.Request) {
 
 func CommentUpdate(w http.ResponseWriter, r *http.Request) {
 	commentTemp := r.Context().Value(CommentKey).(*comment.Comment)
+	if commentTemp.Deleted {
+		render.Render(w, r, status.ErrNotFound)
+		return
+	}
 
-	created_at := commentTemp.Created_At
+	id, created_at := commentTemp.ID, commentTemp.Created_At
+	before := *commentTemp
 
 	commentPayload := comment.NewCommentPayload(commentTemp, nil, nil)
 
@@ -63,7 +178,11 @@ func CommentUpdate(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	commentPayload.Created_At = created_at // keep the created date same as before.
+	commentPayload.ID = id                      // the body can't move the update to another comment.
+	commentPayload.Created_At = created_at      // keep the created date same as before.
+	commentPayload.Parent_ID = before.Parent_ID // replies stay where they were posted.
+	commentPayload.Deleted = before.Deleted
+	commentPayload.Reply_Count = before.Reply_Count
 
 	commentTemp = commentPayload.Comment
 
@@ -72,7 +191,7 @@ func CommentUpdate(w http.ResponseWriter, r *http.Request) {
 	roleRepo := r.Context().Value(RoleRepoKey).(*role.Repo)
 	claims := r.Context().Value(ClaimsKey).(user.Claims)
 
-	tempRole, err := roleRepo.GetByID(claims.RoleID)
+	tempRole, err := claimsRole(roleRepo, claims)
 	if err != nil {
 		render.Render(w, r, status.ErrInternal(err))
 		return
@@ -88,6 +207,14 @@ func CommentUpdate(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if commentTemp.User_ID != claims.UserID {
+		recordAudit(r, audit.CommentUpdate, audit.TargetComment, commentTemp.ID, &before, commentTemp)
+	}
+
+	if seen := commentAsSeen(r, commentTemp.ID); seen != nil {
+		commentTemp.Reply_Count = seen.Reply_Count
+	}
+
 	render.Status(r, http.StatusOK)
 	render.Render(w, r, comment.NewCommentPayload(commentTemp, userRepo, roleRepo))
 }
@@ -98,6 +225,15 @@ func CommentsGet(w http.ResponseWriter, r *http.Request) {
 	userRepo := r.Context().Value(UserRepoKey).(*user.Repo)
 	roleRepo := r.Context().Value(RoleRepoKey).(*role.Repo)
 
+	if !articleVisible(w, r, articleTemp) {
+		return
+	}
+
+	depth, ok := replyDepth(w, r)
+	if !ok {
+		return
+	}
+
 	page := r.Context().Value(PageKey).(int)
 	dates := r.Context().Value(DatesKey).([2]int64)
 
@@ -105,10 +241,50 @@ func CommentsGet(w http.ResponseWriter, r *http.Request) {
 	search.QueryDate(dates[0], dates[1])
 	search.QueryKeyword(r.FormValue("search"))
 	search.QueryArticleID(articleTemp.ID)
-	search.Limit(page)
+	hideShadowed(r, search)
+
+	// A search lists what matches wherever it is in its thread.
+	if r.FormValue("search") != "" {
+		search.Limit(page, r.FormValue("sort"))
+		comments := commentRepo.GetMultiple(search)
+		render.RenderList(w, r, comment.NewCommentListPayload(comments, false, userRepo, roleRepo))
+		return
+	}
+
+	search.QueryParentID(0)
+	search.Limit(page, r.FormValue("sort"))
 	comments := commentRepo.GetMultiple(search)
 
-	render.RenderList(w, r, comment.NewCommentListPayload(comments, false, userRepo, roleRepo))
+	render.RenderList(w, r, comment.NewCommentTreePayload(comments, commentReplies(r, comments, depth), userRepo, roleRepo))
+}
+
+// CommentRepliesGet lists the replies to a comment, oldest first, with
+// 'depth' levels of their own replies nested.
+func CommentRepliesGet(w http.ResponseWriter, r *http.Request) {
+	commentTemp := r.Context().Value(CommentKey).(*comment.Comment)
+	userRepo := r.Context().Value(UserRepoKey).(*user.Repo)
+	roleRepo := r.Context().Value(RoleRepoKey).(*role.Repo)
+
+	if commentArticle(w, r, commentTemp) == nil {
+		return
+	}
+
+	depth, ok := replyDepth(w, r)
+	if !ok {
+		return
+	}
+
+	// the replies and theirs are one thread, sharing its limit.
+	replies, nested := []*comment.Comment{}, []*comment.Comment{}
+	for _, reply := range commentReplies(r, []*comment.Comment{commentTemp}, depth+1) {
+		if reply.Parent_ID == commentTemp.ID {
+			replies = append(replies, reply)
+		} else {
+			nested = append(nested, reply)
+		}
+	}
+
+	render.RenderList(w, r, comment.NewCommentTreePayload(replies, nested, userRepo, roleRepo))
 }
 
 func CommentPost(w http.ResponseWriter, r *http.Request) {
@@ -118,15 +294,43 @@ func CommentPost(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	commentTemp := data.Comment
+	data.Parent_ID = 0 // replies are posted to the comment.
+	postComment(w, r, data.Comment, r.Context().Value(ArticleKey).(*article.Article))
+}
+
+// CommentReply posts a comment as a reply to the one in the url.
+func CommentReply(w http.ResponseWriter, r *http.Request) {
+	parent := r.Context().Value(CommentKey).(*comment.Comment)
+
+	articleTemp := commentArticle(w, r, parent)
+	if articleTemp == nil {
+		return
+	}
+
+	if parent.Deleted {
+		render.Render(w, r, status.ErrInvalidRequest(errors.New("Deleted comments can't be replied to.")))
+		return
+	}
+
+	data := &comment.CommentPayload{}
+	if err := render.Bind(r, data); err != nil {
+		render.Render(w, r, status.ErrInvalidRequest(err))
+		return
+	}
+
+	data.Parent_ID = parent.ID
+	postComment(w, r, data.Comment, articleTemp)
+}
 
+// postComment adds a comment to the article for the caller.
+func postComment(w http.ResponseWriter, r *http.Request, commentTemp *comment.Comment, articleTemp *article.Article) {
 	commentRepo := r.Context().Value(CommentRepoKey).(*comment.Repo)
 	userRepo := r.Context().Value(UserRepoKey).(*user.Repo)
 	roleRepo := r.Context().Value(RoleRepoKey).(*role.Repo)
 	claims := r.Context().Value(ClaimsKey).(user.Claims)
 
 	commentTemp.User_ID = claims.UserID
-	tempRole, err := roleRepo.GetByID(claims.RoleID)
+	tempRole, err := claimsRole(roleRepo, claims)
 	if err != nil {
 		render.Render(w, r, status.ErrInternal(err))
 		return
@@ -137,7 +341,23 @@ func CommentPost(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	articleTemp := r.Context().Value(ArticleKey).(*article.Article)
+	if tempRole.Require_Verified {
+		if userTemp, err := userRepo.GetByID(claims.UserID); err != nil {
+			render.Render(w, r, status.ErrInternal(err))
+			return
+		} else if !userTemp.Verified {
+			render.Render(w, r, status.ErrUnauthorized("You need to verify your email first."))
+			return
+		}
+	}
+
+	if suspension, err := userRepo.GetSuspension(claims.UserID); err == nil {
+		commentTemp.Shadowed = suspension.Mode == user.Shadowed
+	}
+
+	if !articleVisible(w, r, articleTemp) {
+		return
+	}
 	commentTemp.Article_ID = articleTemp.ID
 
 	if id, err := commentRepo.Add(commentTemp); err != nil {
@@ -4,11 +4,22 @@ import (
 	"context"
 	"database/sql"
 	"errors"
+	"go-blog/platform/apikey"
 	"go-blog/platform/article"
+	"go-blog/platform/audit"
+	"go-blog/platform/category"
 	"go-blog/platform/comment"
+	"go-blog/platform/keyring"
+	"go-blog/platform/oidc"
 	"go-blog/platform/role"
+	"go-blog/platform/session"
 	"go-blog/platform/status"
+	"go-blog/platform/tag"
+	"go-blog/platform/throttle"
+	"go-blog/platform/totp"
 	"go-blog/platform/user"
+	"go-blog/platform/usertoken"
+	"net"
 	"net/http"
 	"strconv"
 	"strings"
@@ -27,18 +38,29 @@ const (
 type key int
 
 const (
-	ArticleRepoKey key = 0
-	ArticleKey     key = 1
-	UserRepoKey    key = 2
-	UserKey        key = 3
-	RoleRepoKey    key = 4
-	RoleKey        key = 5
-	CommentRepoKey key = 6
-	CommentKey     key = 7
-	PageKey        key = 8
-	DatesKey       key = 9
-	UserIDKey      key = 10
-	ClaimsKey      key = 11
+	ArticleRepoKey  key = 0
+	ArticleKey      key = 1
+	UserRepoKey     key = 2
+	UserKey         key = 3
+	RoleRepoKey     key = 4
+	RoleKey         key = 5
+	CommentRepoKey  key = 6
+	CommentKey      key = 7
+	PageKey         key = 8
+	DatesKey        key = 9
+	UserIDKey       key = 10
+	ClaimsKey       key = 11
+	SessionRepoKey  key = 12
+	TokenRepoKey    key = 13
+	TOTPRepoKey     key = 14
+	APIKeyRepoKey   key = 15
+	APIKeyKey       key = 16
+	ThrottleRepoKey key = 17
+	OIDCRepoKey     key = 18
+	CookieAuthKey   key = 19
+	AuditRepoKey    key = 20
+	TagRepoKey      key = 21
+	CategoryRepoKey key = 22
 )
 
 func ProvideCommentRepo(db *sql.DB) func(http.Handler) http.Handler {
@@ -81,6 +103,96 @@ func ProvideUserRepo(db *sql.DB) func(http.Handler) http.Handler {
 	}
 }
 
+func ProvideSessionRepo(db *sql.DB) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			repo := session.NewRepo(db)
+			ctx := context.WithValue(r.Context(), SessionRepoKey, repo)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+func ProvideTokenRepo(db *sql.DB) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			repo := usertoken.NewRepo(db)
+			ctx := context.WithValue(r.Context(), TokenRepoKey, repo)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+func ProvideTOTPRepo(db *sql.DB) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			repo := totp.NewRepo(db)
+			ctx := context.WithValue(r.Context(), TOTPRepoKey, repo)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+func ProvideAPIKeyRepo(db *sql.DB) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			repo := apikey.NewRepo(db)
+			ctx := context.WithValue(r.Context(), APIKeyRepoKey, repo)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+func ProvideThrottleRepo(db *sql.DB) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			repo := throttle.NewRepo(db)
+			ctx := context.WithValue(r.Context(), ThrottleRepoKey, repo)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+func ProvideOIDCRepo(db *sql.DB) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			repo := oidc.NewRepo(db)
+			ctx := context.WithValue(r.Context(), OIDCRepoKey, repo)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+func ProvideAuditRepo(db *sql.DB) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			repo := audit.NewRepo(db)
+			ctx := context.WithValue(r.Context(), AuditRepoKey, repo)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+func ProvideTagRepo(db *sql.DB) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			repo := tag.NewRepo(db)
+			ctx := context.WithValue(r.Context(), TagRepoKey, repo)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+func ProvideCategoryRepo(db *sql.DB) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			repo := category.NewRepo(db)
+			ctx := context.WithValue(r.Context(), CategoryRepoKey, repo)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
 func RoleIDContext(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		repo := r.Context().Value(RoleRepoKey).(*role.Repo)
@@ -152,15 +264,20 @@ func UserSelfID(next http.Handler) http.Handler {
 
 		roleRepo := r.Context().Value(RoleRepoKey).(*role.Repo)
 		claims := r.Context().Value(ClaimsKey).(user.Claims)
-		userRole, err := roleRepo.GetByID(claims.RoleID)
+		userRole, err := claimsRole(roleRepo, claims)
 		if err != nil {
 			render.Render(w, r, status.ErrInternal(err))
 			return
 		}
 
-		if userID != claims.UserID && !userRole.Check(role.CanManageOtherUsers) {
-			render.Render(w, r, status.ErrUnauthorized("You are not the user."))
-			return
+		if userID != claims.UserID {
+			if !userRole.Check(role.CanManageOtherUsers) {
+				render.Render(w, r, status.ErrUnauthorized("You are not the user."))
+				return
+			} else if missingTOTP(userRole, claims) {
+				render.Render(w, r, status.ErrUnauthorized("Two-factor authentication is required for this action."))
+				return
+			}
 		}
 
 		ctx := context.WithValue(r.Context(), UserKey, userID)
@@ -168,6 +285,8 @@ func UserSelfID(next http.Handler) http.Handler {
 	})
 }
 
+// ArticleIDContext loads the article by id or by slug. Old slugs redirect
+// to the current one, keeping the method for anything but reads.
 func ArticleIDContext(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		repo := r.Context().Value(ArticleRepoKey).(*article.Repo)
@@ -178,17 +297,57 @@ func ArticleIDContext(next http.Handler) http.Handler {
 			return
 		}
 
-		article, err := repo.GetByID(articleID)
+		var tempArticle *article.Article
+		var moved bool
+		var err error
+		if article.IsNumericID(articleID) {
+			tempArticle, err = repo.GetByID(articleID)
+		} else {
+			tempArticle, moved, err = repo.GetBySlug(articleID)
+		}
 		if err != nil {
 			render.Render(w, r, status.ErrNotFound)
 			return
 		}
 
-		ctx := context.WithValue(r.Context(), ArticleKey, article)
+		if moved {
+			// the new slug of an article the caller can't see is as secret
+			// as the article, the routes authenticate only after this.
+			claims, _ := authenticate(r)
+			if !articleVisible(w, r.WithContext(context.WithValue(r.Context(), ClaimsKey, claims)), tempArticle) {
+				return
+			}
+
+			code := http.StatusPermanentRedirect
+			if r.Method == http.MethodGet || r.Method == http.MethodHead {
+				code = http.StatusMovedPermanently
+			}
+
+			target := *r.URL
+			target.Path = movedArticlePath(r, tempArticle.Slug)
+			target.RawPath = ""
+			http.Redirect(w, r, target.String(), code)
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), ArticleKey, tempArticle)
 		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
 
+// movedArticlePath is the path of the request with the segment the route
+// matched as the article, and only that one, changed to the current slug.
+func movedArticlePath(r *http.Request, slug string) string {
+	segments := strings.Split(r.URL.Path, "/")
+	pattern := strings.Split(chi.RouteContext(r.Context()).RoutePattern(), "/")
+	for i, segment := range pattern {
+		if segment == "{articleID}" && i < len(segments) {
+			segments[i] = slug
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
 func Paginate(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		var pageNum int = 0
@@ -240,29 +399,249 @@ func ParseDate(next http.Handler) http.Handler {
 	})
 }
 
-func AuthenticatorNoPass(next http.Handler) http.Handler {
+// Verifier looks for a jwt in the Authorization header, then in the jwt
+// cookie, as far as Cookies.Lookup allows. It verifies it with the keyring
+// and stores the outcome in the context the same way jwtauth.Verifier does.
+func Verifier(keys *keyring.Keyring) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			token, fromCookie, err := verifyRequest(keys, r)
+			ctx := jwtauth.NewContext(r.Context(), token, err)
+			ctx = context.WithValue(ctx, CookieAuthKey, fromCookie)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+func verifyRequest(keys *keyring.Keyring, r *http.Request) (jwt.Token, bool, error) {
+	var tokenString string
+	fromCookie := false
+
+	if Cookies.HeaderAllowed() {
+		tokenString = jwtauth.TokenFromHeader(r)
+		if apikey.IsKey(tokenString) {
+			tokenString = ""
+		}
+	}
+	if tokenString == "" && Cookies.CookieAllowed() {
+		tokenString = jwtauth.TokenFromCookie(r)
+		fromCookie = tokenString != ""
+	}
+	if tokenString == "" {
+		return nil, false, jwtauth.ErrNoTokenFound
+	}
+
+	token, err := keys.Decode(tokenString)
+	if err != nil {
+		return nil, fromCookie, jwtauth.ErrorReason(err)
+	}
+
+	if err = jwt.Validate(token); err != nil {
+		return token, fromCookie, jwtauth.ErrorReason(err)
+	}
+
+	return token, fromCookie, nil
+}
+
+// CSRFProtect requires the double submitted csrf token on state changing
+// requests authenticated by the jwt cookie. Header tokens and API keys
+// can't be sent by another site, so they don't need it.
+func CSRFProtect(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		fromCookie, _ := r.Context().Value(CookieAuthKey).(bool)
+		_, withAPIKey := r.Context().Value(APIKeyKey).(*apikey.Key)
+
+		if fromCookie && !withAPIKey && !validCSRF(r) {
+			render.Render(w, r, status.ErrForbidden("Missing or invalid CSRF token."))
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// APIKeyVerifier runs next to Verifier and picks up API keys sent
+// in the X-API-Key header or as an 'Authorization: Bearer' token.
+func APIKeyVerifier(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		token, claims, err := jwtauth.FromContext(r.Context())
-		if err != nil || token == nil || jwt.Validate(token) != nil {
-			render.Render(w, r, status.ErrUnauthorized("Incorrect token."))
+		plain := r.Header.Get("X-API-Key")
+		if bearer := r.Header.Get("Authorization"); plain == "" && len(bearer) > 7 && strings.EqualFold(bearer[:7], "BEARER ") {
+			if apikey.IsKey(bearer[7:]) {
+				plain = bearer[7:]
+			}
+		}
+
+		if plain == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		repo := r.Context().Value(APIKeyRepoKey).(*apikey.Repo)
+		key, err := repo.Authenticate(plain)
+		if err == apikey.ErrInvalidKey {
+			render.Render(w, r, status.ErrUnauthorized(err.Error()))
+			return
+		} else if err != nil {
+			render.Render(w, r, status.ErrInternal(err))
 			return
 		}
-		ctx := context.WithValue(r.Context(), ClaimsKey, user.NewClaimsFromMap(claims))
+
+		ctx := context.WithValue(r.Context(), APIKeyKey, key)
 		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
 
-func AuthenticatorPass(next http.Handler) http.Handler {
+// authenticate resolves the caller either from an API key or from a valid
+// jwt whose session hasn't been revoked.
+func authenticate(r *http.Request) (user.Claims, error) {
+	if key, ok := r.Context().Value(APIKeyKey).(*apikey.Key); ok {
+		return user.Claims{
+			Authenticated: true,
+			RoleID:        key.Role_ID,
+			UserID:        key.User_ID,
+			APIKeyID:      key.ID,
+			Permissions:   key.Permissions,
+		}, nil
+	}
+
+	token, claims, err := jwtauth.FromContext(r.Context())
+	if err != nil || token == nil || jwt.Validate(token) != nil {
+		return user.NotAuthenticated, errors.New("Incorrect token.")
+	}
+
+	userClaims := user.NewClaimsFromMap(claims)
+	sessionRepo := r.Context().Value(SessionRepoKey).(*session.Repo)
+	userAgent, ip := session.Client(r)
+	if !sessionRepo.Seen(userClaims.SessionID, userClaims.UserID, userAgent, ip) {
+		return user.NotAuthenticated, errors.New("Session has been revoked.")
+	}
+
+	return userClaims, nil
+}
+
+// claimsRole loads the role of the caller, narrowed to the permissions
+// of the API key the request was made with.
+func claimsRole(roleRepo *role.Repo, claims user.Claims) (*role.Role, error) {
+	userRole, err := roleRepo.GetByID(claims.RoleID)
+	if err != nil {
+		return nil, err
+	}
+
+	if claims.Permissions != nil {
+		userRole.Restrict(claims.Permissions)
+	}
+
+	return userRole, nil
+}
+
+// AuthenticatorNoPass rejects unauthenticated requests, and every request
+// but reads from suspended users.
+func AuthenticatorNoPass(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		token, claims, err := jwtauth.FromContext(r.Context())
-		var ctx context.Context
+		claims, err := authenticate(r)
+		if err != nil {
+			render.Render(w, r, status.ErrUnauthorized(err.Error()))
+			return
+		}
 
-		if err != nil || token == nil || jwt.Validate(token) != nil {
-			ctx = context.WithValue(r.Context(), ClaimsKey, user.NotAuthenticated)
-		} else {
-			ctx = context.WithValue(r.Context(), ClaimsKey, user.NewClaimsFromMap(claims))
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+		default:
+			if isSuspended(w, r, claims.UserID) {
+				return
+			}
 		}
 
+		ctx := context.WithValue(r.Context(), ClaimsKey, claims)
 		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
+
+func AuthenticatorPass(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		claims, _ := authenticate(r)
+
+		ctx := context.WithValue(r.Context(), ClaimsKey, claims)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// ParseTrustedProxies reads a comma separated list of addresses and CIDR
+// ranges of the reverse proxies in front of the server.
+func ParseTrustedProxies(value string) ([]*net.IPNet, error) {
+	var proxies []*net.IPNet
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, errors.New("invalid proxy address " + entry)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			proxies = append(proxies, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, errors.New("invalid proxy range " + entry)
+		}
+		proxies = append(proxies, network)
+	}
+	return proxies, nil
+}
+
+// RealIP replaces RemoteAddr with the client address that trusted proxies
+// appended to X-Forwarded-For. Requests from anyone else keep their peer
+// address, the header is only as honest as whoever sent it. The addresses
+// are read from the right, up to the first one that isn't a trusted proxy,
+// so a client can't pick its address by sending the header itself.
+func RealIP(proxies []*net.IPNet) func(http.Handler) http.Handler {
+	trusted := func(addr string) bool {
+		ip := net.ParseIP(addr)
+		for _, proxy := range proxies {
+			if ip != nil && proxy.Contains(ip) {
+				return true
+			}
+		}
+		return false
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			peer := r.RemoteAddr
+			if host, _, err := net.SplitHostPort(peer); err == nil {
+				peer = host
+			}
+
+			if trusted(peer) {
+				hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+				for i := len(hops) - 1; i >= 0; i-- {
+					hop := strings.TrimSpace(hops[i])
+					if net.ParseIP(hop) == nil {
+						break
+					}
+					r.RemoteAddr = hop
+					if !trusted(hop) {
+						break
+					}
+				}
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
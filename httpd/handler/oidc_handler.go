@@ -0,0 +1,266 @@
+package handler
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"errors"
+	"go-blog/platform/keyring"
+	"go-blog/platform/oidc"
+	"go-blog/platform/role"
+	"go-blog/platform/status"
+	"go-blog/platform/throttle"
+	"go-blog/platform/token"
+	"go-blog/platform/user"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/go-chi/render"
+)
+
+const (
+	OIDCStateLifetime = 10 * time.Minute
+	OIDCStateCookie   = "oidc_state"
+	oidcCookiePath    = "/login/oidc/"
+)
+
+func oidcRedirectURL(publicURL string, provider string) string {
+	return publicURL + "/login/oidc/" + provider + "/callback"
+}
+
+// setOIDCState ties the login to the browser that started it, a callback
+// only goes through with the state this cookie holds. It is Lax whatever
+// the other cookies are since the provider redirects back cross-site.
+func setOIDCState(w http.ResponseWriter, state string, expires time.Time) {
+	cookie := &http.Cookie{
+		Name:     OIDCStateCookie,
+		Value:    state,
+		Path:     oidcCookiePath,
+		HttpOnly: true,
+		Secure:   Cookies.Secure,
+		SameSite: http.SameSiteLaxMode,
+	}
+	if expires.IsZero() {
+		cookie.MaxAge = -1
+	} else {
+		cookie.Expires = expires
+	}
+	http.SetCookie(w, cookie)
+}
+
+func oidcProvider(w http.ResponseWriter, r *http.Request, providers map[string]*oidc.Provider) *oidc.Provider {
+	provider, ok := providers[chi.URLParam(r, "provider")]
+	if !ok {
+		render.Render(w, r, status.ErrNotFound)
+		return nil
+	}
+	return provider
+}
+
+// OIDCProviders lists the providers a login page can offer.
+func OIDCProviders(providers map[string]*oidc.Provider) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		names := make([]string, 0, len(providers))
+		for name := range providers {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		render.JSON(w, r, map[string]interface{}{"providers": names})
+	}
+}
+
+// OIDCLogin sends the user to the provider with a fresh state, nonce and PKCE
+// challenge. Every start stores a state until it expires, so starts are
+// limited per client address and a restart replaces the browser's last one.
+func OIDCLogin(providers map[string]*oidc.Provider, publicURL string, limit throttle.Policy) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		provider := oidcProvider(w, r, providers)
+		if provider == nil {
+			return
+		}
+
+		throttleRepo := r.Context().Value(ThrottleRepoKey).(*throttle.Repo)
+		policies := map[string]throttle.Policy{throttle.OIDCKey(r.RemoteAddr): limit}
+		if wait, err := throttleRepo.Take(policies, time.Now()); err != nil {
+			render.Render(w, r, status.ErrInternal(err))
+			return
+		} else if wait > 0 {
+			render.Render(w, r, status.ErrTooManyRequests("Too many logins started.", wait))
+			return
+		}
+
+		var values [3]string
+		for i := range values {
+			value, err := token.Random()
+			if err != nil {
+				render.Render(w, r, status.ErrInternal(err))
+				return
+			}
+			values[i] = value
+		}
+		state, nonce, verifier := values[0], values[1], values[2]
+
+		redirectURL := oidcRedirectURL(publicURL, provider.Name)
+		authURL, err := provider.AuthURL(r.Context(), redirectURL, state, nonce, verifier)
+		if err != nil {
+			log.Println(err)
+			render.Render(w, r, status.ErrInternal(errors.New("Login provider is unavailable.")))
+			return
+		}
+
+		oidcRepo := r.Context().Value(OIDCRepoKey).(*oidc.Repo)
+		if previous, err := r.Cookie(OIDCStateCookie); err == nil {
+			if err = oidcRepo.DeleteState(previous.Value); err != nil {
+				render.Render(w, r, status.ErrInternal(err))
+				return
+			}
+		}
+
+		expires := time.Now().Add(OIDCStateLifetime)
+		err = oidcRepo.SaveState(state, &oidc.State{
+			Provider:   provider.Name,
+			Nonce:      nonce,
+			Verifier:   verifier,
+			Remember:   r.FormValue("remember") == "1",
+			Expires_At: expires.Unix(),
+		})
+		if err != nil {
+			render.Render(w, r, status.ErrInternal(err))
+			return
+		}
+
+		setOIDCState(w, state, expires)
+		http.Redirect(w, r, authURL, http.StatusFound)
+	}
+}
+
+// OIDCCallback finishes the login the provider redirected back from, in the
+// browser that started it so nobody can log others in with their own code.
+// The identity is looked up by its subject, linked to a verified account with
+// the same e-mail, or else registered with the default role.
+func OIDCCallback(keys *keyring.Keyring, providers map[string]*oidc.Provider, publicURL string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		provider := oidcProvider(w, r, providers)
+		if provider == nil {
+			return
+		}
+
+		if reason := r.FormValue("error"); reason != "" {
+			if description := r.FormValue("error_description"); description != "" {
+				reason = description
+			}
+			render.Render(w, r, status.ErrUnauthorized(reason))
+			return
+		}
+
+		// the state is single use either way, so the cookie goes too.
+		setOIDCState(w, "", time.Time{})
+		cookie, err := r.Cookie(OIDCStateCookie)
+		if err != nil || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(r.FormValue("state"))) != 1 {
+			render.Render(w, r, status.ErrUnauthorized(oidc.ErrInvalidState.Error()))
+			return
+		}
+
+		oidcRepo := r.Context().Value(OIDCRepoKey).(*oidc.Repo)
+		state, err := oidcRepo.ConsumeState(cookie.Value, provider.Name)
+		if err == oidc.ErrInvalidState {
+			render.Render(w, r, status.ErrUnauthorized(err.Error()))
+			return
+		} else if err != nil {
+			render.Render(w, r, status.ErrInternal(err))
+			return
+		}
+
+		identity, err := provider.Exchange(r.Context(), oidcRedirectURL(publicURL, provider.Name), r.FormValue("code"), state)
+		if err != nil {
+			log.Println(err)
+			render.Render(w, r, status.ErrUnauthorized("Login with "+provider.Name+" failed."))
+			return
+		}
+
+		repo := r.Context().Value(UserRepoKey).(*user.Repo)
+
+		userID, err := oidcRepo.GetUserID(provider.Name, identity.Subject)
+		if err == sql.ErrNoRows {
+			userID, err = oidcLinkUser(w, r, repo, oidcRepo, provider.Name, identity)
+			if userID == 0 {
+				return
+			}
+		}
+		if err != nil {
+			render.Render(w, r, status.ErrInternal(err))
+			return
+		}
+
+		userTemp, err := repo.GetByID(userID)
+		if err != nil {
+			render.Render(w, r, status.ErrInternal(err))
+			return
+		}
+
+		finishLogin(w, r, keys, userTemp, state.Remember)
+	}
+}
+
+// oidcLinkUser links a first time identity to a user and returns its id, or
+// renders an error and returns 0. Unverified accounts are never linked since
+// anyone could have registered them with somebody else's address.
+func oidcLinkUser(w http.ResponseWriter, r *http.Request, repo *user.Repo, oidcRepo *oidc.Repo, provider string, identity *oidc.Identity) (int64, error) {
+	if !user.EmailRegex.MatchString(identity.Email) {
+		render.Render(w, r, status.ErrInvalidRequest(errors.New("The provider did not share a valid e-mail.")))
+		return 0, nil
+	}
+
+	var userID int64
+	existing, err := repo.GetByEmail(identity.Email)
+	if err == nil {
+		if !identity.EmailVerified || !existing.Verified {
+			render.Render(w, r, status.ErrConflict("Email already registered."))
+			return 0, nil
+		}
+		userID = existing.ID
+	} else if err == sql.ErrNoRows {
+		roleRepo := r.Context().Value(RoleRepoKey).(*role.Repo)
+		defaultRole, err := roleRepo.GetDefault()
+		if err != nil {
+			render.Render(w, r, status.ErrInternal(err))
+			return 0, nil
+		}
+
+		newUser := &user.User{
+			Role_ID:    defaultRole.ID,
+			Name:       oidcUserName(identity),
+			Email:      identity.Email,
+			Created_At: time.Now().Unix(),
+		}
+		// no password, these users log in with the provider or reset one.
+		if userID, err = repo.Add(newUser); err != nil {
+			render.Render(w, r, status.ErrInternal(err))
+			return 0, nil
+		}
+		if err = repo.Update(userID, "verified", identity.EmailVerified); err != nil {
+			render.Render(w, r, status.ErrInternal(err))
+			return 0, nil
+		}
+	} else {
+		render.Render(w, r, status.ErrInternal(err))
+		return 0, nil
+	}
+
+	return userID, oidcRepo.Link(userID, provider, identity.Subject)
+}
+
+// oidcUserName picks a name that passes the registration rules.
+func oidcUserName(identity *oidc.Identity) string {
+	candidates := []string{identity.Name, strings.SplitN(identity.Email, "@", 2)[0]}
+	for _, name := range candidates {
+		if user.NameRegex.MatchString(name) {
+			return name
+		}
+	}
+	return "Reader"
+}
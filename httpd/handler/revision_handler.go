@@ -0,0 +1,153 @@
+package handler
+
+import (
+	"database/sql"
+	"errors"
+	"go-blog/platform/article"
+	"go-blog/platform/audit"
+	"go-blog/platform/role"
+	"go-blog/platform/status"
+	"go-blog/platform/user"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/go-chi/render"
+)
+
+// canSeeRevisions reports whether the caller may read the history of the
+// article, rendering an error if not. Besides the people who can edit it,
+// reviewers can.
+func canSeeRevisions(w http.ResponseWriter, r *http.Request, articleTemp *article.Article) bool {
+	if reviewsArticles(r) {
+		return true
+	}
+	return canEditArticle(w, r, articleTemp)
+}
+
+// articleRevision loads the revision in the url, or renders an error and returns nil.
+func articleRevision(w http.ResponseWriter, r *http.Request, articleTemp *article.Article) *article.Revision {
+	revisionID, err := strconv.ParseInt(chi.URLParam(r, "revisionID"), 10, 64)
+	if err != nil || revisionID < 1 {
+		render.Render(w, r, status.ErrInvalidRequest(errors.New("Invalid revision id.")))
+		return nil
+	}
+
+	articleRepo := r.Context().Value(ArticleRepoKey).(*article.Repo)
+	revision, err := articleRepo.GetRevision(articleTemp.ID, revisionID)
+	if err == sql.ErrNoRows {
+		render.Render(w, r, status.ErrNotFound)
+		return nil
+	} else if err != nil {
+		render.Render(w, r, status.ErrInternal(err))
+		return nil
+	}
+
+	return revision
+}
+
+// RevisionGetAll lists the revisions of an article, newest first.
+func RevisionGetAll(w http.ResponseWriter, r *http.Request) {
+	articleTemp := r.Context().Value(ArticleKey).(*article.Article)
+	if !canSeeRevisions(w, r, articleTemp) {
+		return
+	}
+
+	articleRepo := r.Context().Value(ArticleRepoKey).(*article.Repo)
+	userRepo := r.Context().Value(UserRepoKey).(*user.Repo)
+	roleRepo := r.Context().Value(RoleRepoKey).(*role.Repo)
+	render.RenderList(w, r, article.NewRevisionListPayload(articleRepo.GetRevisions(articleTemp.ID), userRepo, roleRepo))
+}
+
+func RevisionGetByID(w http.ResponseWriter, r *http.Request) {
+	articleTemp := r.Context().Value(ArticleKey).(*article.Article)
+	if !canSeeRevisions(w, r, articleTemp) {
+		return
+	}
+
+	revision := articleRevision(w, r, articleTemp)
+	if revision == nil {
+		return
+	}
+
+	userRepo := r.Context().Value(UserRepoKey).(*user.Repo)
+	roleRepo := r.Context().Value(RoleRepoKey).(*role.Repo)
+	render.Render(w, r, article.NewRevisionPayload(revision, userRepo, roleRepo))
+}
+
+// RevisionDiff shows what changed in a revision, since the revision before it
+// or since the one given as 'from'.
+func RevisionDiff(w http.ResponseWriter, r *http.Request) {
+	articleTemp := r.Context().Value(ArticleKey).(*article.Article)
+	if !canSeeRevisions(w, r, articleTemp) {
+		return
+	}
+
+	revision := articleRevision(w, r, articleTemp)
+	if revision == nil {
+		return
+	}
+
+	articleRepo := r.Context().Value(ArticleRepoKey).(*article.Repo)
+
+	var from *article.Revision
+	var err error
+	if fromID := r.FormValue("from"); fromID != "" {
+		id, parseErr := strconv.ParseInt(fromID, 10, 64)
+		if parseErr != nil || id < 1 {
+			render.Render(w, r, status.ErrInvalidRequest(errors.New("Invalid revision id.")))
+			return
+		}
+		from, err = articleRepo.GetRevision(articleTemp.ID, id)
+	} else {
+		from, err = articleRepo.GetPreviousRevision(articleTemp.ID, revision.ID)
+		if err == sql.ErrNoRows { // the first revision, everything was added.
+			from, err = nil, nil
+		}
+	}
+
+	if err == sql.ErrNoRows {
+		render.Render(w, r, status.ErrNotFound)
+		return
+	} else if err != nil {
+		render.Render(w, r, status.ErrInternal(err))
+		return
+	}
+
+	render.Render(w, r, article.NewRevisionDiff(from, revision))
+}
+
+// RevisionRestore brings back the title and body of a revision, saving them
+// as a new revision so the history stays intact.
+func RevisionRestore(w http.ResponseWriter, r *http.Request) {
+	articleTemp := r.Context().Value(ArticleKey).(*article.Article)
+	if !canEditArticle(w, r, articleTemp) {
+		return
+	}
+
+	revision := articleRevision(w, r, articleTemp)
+	if revision == nil {
+		return
+	}
+
+	claims := r.Context().Value(ClaimsKey).(user.Claims)
+	articleRepo := r.Context().Value(ArticleRepoKey).(*article.Repo)
+
+	before := *articleTemp
+	articleTemp.Title = revision.Title
+	articleTemp.Body = revision.Body
+	articleTemp.Format = revision.Format
+	articleTemp.Updated_At = time.Now().Unix()
+
+	if err := articleRepo.Update(articleTemp, claims.UserID); err != nil {
+		render.Render(w, r, status.ErrInternal(err))
+		return
+	}
+
+	if articleTemp.User_ID != claims.UserID {
+		recordAudit(r, audit.ArticleRestore, audit.TargetArticle, articleTemp.ID, &before, articleTemp)
+	}
+
+	render.Render(w, r, article.NewArticlePayload(articleTemp, user.NotAuthenticated, nil, nil))
+}
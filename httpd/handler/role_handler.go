@@ -1,53 +1,150 @@
 package handler
 
 import (
+	"database/sql"
+	"errors"
+	"go-blog/platform/audit"
 	"go-blog/platform/role"
 	"go-blog/platform/status"
 	"go-blog/platform/user"
 	"net/http"
+	"strconv"
 
 	"github.com/go-chi/render"
 )
 
+// RoleDelete moves the users of the role to the role given as 'replacement'
+// before deleting it.
 func RoleDelete(w http.ResponseWriter, r *http.Request) {
 	roleTemp := r.Context().Value(RoleKey).(*role.Role)
 	roleRepo := r.Context().Value(RoleRepoKey).(*role.Repo)
 	claims := r.Context().Value(ClaimsKey).(user.Claims)
 
-	if userRole, err := roleRepo.GetByID(claims.RoleID); err != nil {
+	userRole, err := claimsRole(roleRepo, claims)
+	if err != nil {
 		render.Render(w, r, status.ErrInternal(err))
 		return
 	} else if !userRole.Check(role.CanManageRole) {
 		render.Render(w, r, status.ErrUnauthorized("You are not authorized to manage roles."))
 		return
+	} else if missingTOTP(userRole, claims) {
+		render.Render(w, r, status.ErrUnauthorized("Two-factor authentication is required for this action."))
+		return
 	}
 
-	if err := roleRepo.Delete(roleTemp.ID); err != nil {
-		render.Render(w, r, status.ErrInvalidRequest(err))
+	if roleTemp.Protected {
+		render.Render(w, r, status.ErrConflict(role.ErrProtected.Error()))
+		return
+	} else if !userRole.Covers(roleTemp) {
+		// its users would all lose permissions this user doesn't have.
+		render.Render(w, r, status.ErrForbidden("You can't delete a role with permissions you don't have."))
+		return
+	}
+
+	replacementID, err := strconv.ParseInt(r.FormValue("replacement"), 10, 64)
+	if err != nil || replacementID < 1 || replacementID == roleTemp.ID {
+		render.Render(w, r, status.ErrInvalidRequest(errors.New("A replacement role for its users is required.")))
+		return
+	}
+
+	replacement, err := roleRepo.GetByID(replacementID)
+	if err == sql.ErrNoRows {
+		render.Render(w, r, status.ErrInvalidRequest(errors.New("Replacement role does not exist.")))
+		return
+	} else if err != nil {
+		render.Render(w, r, status.ErrInternal(err))
+		return
+	}
+
+	if !userRole.Covers(replacement) {
+		render.Render(w, r, status.ErrUnauthorized("You can't assign a role with permissions you don't have."))
+		return
+	}
+
+	moved, err := roleRepo.Delete(roleTemp.ID, replacement.ID, claims.UserID)
+	if err == role.ErrProtected {
+		render.Render(w, r, status.ErrConflict(err.Error()))
+		return
+	} else if err != nil {
+		render.Render(w, r, status.ErrInternal(err))
 		return
 	}
 
-	render.Render(w, r, status.DelSuccess())
+	recordAudit(r, audit.RoleDelete, audit.TargetRole, roleTemp.ID, roleTemp,
+		map[string]int64{"replacement_id": replacement.ID, "moved_users": moved})
+
+	render.JSON(w, r, map[string]interface{}{"status": "Successfuly deleted.", "moved_users": moved})
 }
 
-func RoleUpdate(w http.ResponseWriter, r *http.Request) {
+// RoleSetDefault makes the role the one new users are registered with.
+func RoleSetDefault(w http.ResponseWriter, r *http.Request) {
 	roleTemp := r.Context().Value(RoleKey).(*role.Role)
-	rolePayload := role.NewRolePayload(roleTemp)
+	roleRepo := r.Context().Value(RoleRepoKey).(*role.Repo)
+	claims := r.Context().Value(ClaimsKey).(user.Claims)
 
-	if err := render.Bind(r, rolePayload); err != nil {
-		render.Render(w, r, status.ErrInvalidRequest(err))
+	if userRole, err := claimsRole(roleRepo, claims); err != nil {
+		render.Render(w, r, status.ErrInternal(err))
+		return
+	} else if !userRole.Check(role.CanManageRole) {
+		render.Render(w, r, status.ErrUnauthorized("You are not authorized to manage roles."))
+		return
+	} else if missingTOTP(userRole, claims) {
+		render.Render(w, r, status.ErrUnauthorized("Two-factor authentication is required for this action."))
+		return
+	} else if !userRole.Covers(roleTemp) {
+		// every new user would get it, including the ones this user registers.
+		render.Render(w, r, status.ErrForbidden("You can't make a role with permissions you don't have the default."))
 		return
 	}
-	roleTemp = rolePayload.Role
+
+	if err := roleRepo.SetDefault(roleTemp.ID); err != nil {
+		render.Render(w, r, status.ErrInternal(err))
+		return
+	}
+
+	recordAudit(r, audit.RoleSetDefault, audit.TargetRole, roleTemp.ID, nil, nil)
+
+	roleTemp.Default = true
+	render.Render(w, r, role.NewRolePayload(roleTemp))
+}
+
+func RoleUpdate(w http.ResponseWriter, r *http.Request) {
+	roleTemp := r.Context().Value(RoleKey).(*role.Role)
 	roleRepo := r.Context().Value(RoleRepoKey).(*role.Repo)
 	claims := r.Context().Value(ClaimsKey).(user.Claims)
 
-	if userRole, err := roleRepo.GetByID(claims.RoleID); err != nil {
+	userRole, err := claimsRole(roleRepo, claims)
+	if err != nil {
 		render.Render(w, r, status.ErrInternal(err))
 		return
 	} else if !userRole.Check(role.CanManageRole) {
 		render.Render(w, r, status.ErrUnauthorized("You are not authorized to manage roles."))
 		return
+	} else if missingTOTP(userRole, claims) {
+		render.Render(w, r, status.ErrUnauthorized("Two-factor authentication is required for this action."))
+		return
+	} else if !userRole.Covers(roleTemp) {
+		// like its users, a role above this user's is out of their reach.
+		render.Render(w, r, status.ErrForbidden("You can't change a role with permissions you don't have."))
+		return
+	}
+
+	before := *roleTemp
+	// decoding the body writes into the permissions' array, the audit needs its own.
+	before.Permissions = append([]string(nil), roleTemp.Permissions...)
+	id, protected, isDefault := roleTemp.ID, roleTemp.Protected, roleTemp.Default
+	rolePayload := role.NewRolePayload(roleTemp)
+
+	if err := render.Bind(r, rolePayload); err != nil {
+		render.Render(w, r, status.ErrInvalidRequest(err))
+		return
+	}
+	roleTemp = rolePayload.Role
+	roleTemp.ID, roleTemp.Protected, roleTemp.Default = id, protected, isDefault
+
+	if !userRole.Covers(roleTemp) {
+		render.Render(w, r, status.ErrUnauthorized("You can't grant permissions you don't have."))
+		return
 	}
 
 	if err := roleRepo.Update(roleTemp); err != nil {
@@ -55,6 +152,8 @@ func RoleUpdate(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	recordAudit(r, audit.RoleUpdate, audit.TargetRole, roleTemp.ID, &before, roleTemp)
+
 	render.Status(r, http.StatusOK)
 	render.Render(w, r, role.NewRolePayload(roleTemp))
 }
@@ -70,6 +169,11 @@ func RoleGetAll(w http.ResponseWriter, r *http.Request) {
 	render.RenderList(w, r, role.NewRoleListPayload(roles))
 }
 
+// PermissionGetAll lists the permissions roles can be made of.
+func PermissionGetAll(w http.ResponseWriter, r *http.Request) {
+	render.RenderList(w, r, role.NewPermissionListPayload(role.Permissions))
+}
+
 func RolePost(w http.ResponseWriter, r *http.Request) {
 	data := &role.RolePayload{}
 
@@ -79,15 +183,22 @@ func RolePost(w http.ResponseWriter, r *http.Request) {
 	}
 
 	roleTemp := data.Role
+	roleTemp.Protected, roleTemp.Default = false, false
 	roleRepo := r.Context().Value(RoleRepoKey).(*role.Repo)
 	claims := r.Context().Value(ClaimsKey).(user.Claims)
 
-	if userRole, err := roleRepo.GetByID(claims.RoleID); err != nil {
+	if userRole, err := claimsRole(roleRepo, claims); err != nil {
 		render.Render(w, r, status.ErrInternal(err))
 		return
 	} else if !userRole.Check(role.CanManageRole) {
 		render.Render(w, r, status.ErrUnauthorized("You are not authorized to manage roles."))
 		return
+	} else if missingTOTP(userRole, claims) {
+		render.Render(w, r, status.ErrUnauthorized("Two-factor authentication is required for this action."))
+		return
+	} else if !userRole.Covers(roleTemp) {
+		render.Render(w, r, status.ErrUnauthorized("You can't grant permissions you don't have."))
+		return
 	}
 
 	if id, err := roleRepo.Add(roleTemp); err != nil {
@@ -97,6 +208,8 @@ func RolePost(w http.ResponseWriter, r *http.Request) {
 		roleTemp.ID = id
 	}
 
+	recordAudit(r, audit.RoleCreate, audit.TargetRole, roleTemp.ID, nil, roleTemp)
+
 	render.Status(r, http.StatusCreated)
 	render.Render(w, r, role.NewRolePayload(roleTemp))
 }
@@ -0,0 +1,356 @@
+package handler
+
+import (
+	"crypto/subtle"
+	"errors"
+	"go-blog/platform/keyring"
+	"go-blog/platform/role"
+	"go-blog/platform/session"
+	"go-blog/platform/status"
+	"go-blog/platform/throttle"
+	"go-blog/platform/token"
+	"go-blog/platform/totp"
+	"go-blog/platform/user"
+	"go-blog/platform/usertoken"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/go-chi/jwtauth"
+	"github.com/go-chi/render"
+)
+
+const (
+	AccessTokenLifetime       = 15 * time.Minute
+	SessionLifetime           = 24 * time.Hour
+	RememberedSessionLifetime = 365 * 24 * time.Hour
+	RefreshCookiePath         = "/token"
+	CSRFCookie                = "csrf_token"
+	CSRFHeader                = "X-CSRF-Token"
+)
+
+// TokenLookup tells Verifier where access tokens may come from.
+type TokenLookup int
+
+const (
+	LookupBoth TokenLookup = iota
+	LookupHeader
+	LookupCookie
+)
+
+type CookieConfig struct {
+	Lookup   TokenLookup
+	SameSite http.SameSite
+	Secure   bool
+}
+
+// Cookies is set up by main before serving. With header only lookup no
+// token cookies are set at all.
+var Cookies = CookieConfig{Lookup: LookupBoth, SameSite: http.SameSiteLaxMode}
+
+func (c CookieConfig) HeaderAllowed() bool {
+	return c.Lookup != LookupCookie
+}
+
+func (c CookieConfig) CookieAllowed() bool {
+	return c.Lookup != LookupHeader
+}
+
+func ParseTokenLookup(value string) (TokenLookup, error) {
+	switch strings.ToLower(value) {
+	case "", "both":
+		return LookupBoth, nil
+	case "header":
+		return LookupHeader, nil
+	case "cookie":
+		return LookupCookie, nil
+	}
+	return LookupBoth, errors.New("token lookup must be header, cookie or both")
+}
+
+func ParseSameSite(value string) (http.SameSite, error) {
+	switch strings.ToLower(value) {
+	case "", "lax":
+		return http.SameSiteLaxMode, nil
+	case "strict":
+		return http.SameSiteStrictMode, nil
+	case "none":
+		return http.SameSiteNoneMode, nil
+	}
+	return http.SameSiteLaxMode, errors.New("same site must be lax, strict or none")
+}
+
+func setCookie(w http.ResponseWriter, name string, value string, path string, expires time.Time, httpOnly bool) {
+	cookie := &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     path,
+		HttpOnly: httpOnly,
+		Secure:   Cookies.Secure,
+		SameSite: Cookies.SameSite,
+	}
+	if expires.IsZero() {
+		cookie.MaxAge = -1
+	} else {
+		cookie.Expires = expires
+	}
+	http.SetCookie(w, cookie)
+}
+
+// validCSRF checks the double submitted csrf token: the header has to echo
+// the csrf cookie, which other sites can neither read nor set.
+func validCSRF(r *http.Request) bool {
+	cookie, err := r.Cookie(CSRFCookie)
+	if err != nil || cookie.Value == "" {
+		return false
+	}
+	header := r.Header.Get(CSRFHeader)
+	return subtle.ConstantTimeCompare([]byte(header), []byte(cookie.Value)) == 1
+}
+
+// issueTokens signs a short-lived access token for the session and sets both
+// the access and refresh token cookies.
+func issueTokens(w http.ResponseWriter, keys *keyring.Keyring, userTemp *user.User, sess *session.Session, refreshToken string) (string, error) {
+	claims := user.Claims{UserID: userTemp.ID, RoleID: userTemp.Role_ID, SessionID: sess.ID, MFA: sess.MFA}
+	mapClaims := claims.ToMap()
+
+	expiration := time.Now().Add(AccessTokenLifetime)
+	jwtauth.SetExpiry(mapClaims, expiration)
+	jwtauth.SetIssuedNow(mapClaims)
+
+	tokenString, err := keys.Encode(mapClaims)
+	if err != nil {
+		return "", err
+	}
+
+	if !Cookies.CookieAllowed() {
+		return tokenString, nil
+	}
+
+	csrfToken, err := token.Random()
+	if err != nil {
+		return "", err
+	}
+
+	sessionExpiration := time.Unix(sess.Expires_At, 0)
+	setCookie(w, "jwt", tokenString, "/", expiration, true)
+	setCookie(w, "refresh_token", refreshToken, RefreshCookiePath, sessionExpiration, true)
+	setCookie(w, CSRFCookie, csrfToken, "/", sessionExpiration, false)
+
+	return tokenString, nil
+}
+
+// startSession opens a session for an authenticated user and renders
+// the user together with its tokens.
+func startSession(w http.ResponseWriter, r *http.Request, keys *keyring.Keyring, userTemp *user.User, remember bool, mfa bool) {
+	lifetime := SessionLifetime
+	if remember {
+		lifetime = RememberedSessionLifetime
+	}
+
+	sessionRepo := r.Context().Value(SessionRepoKey).(*session.Repo)
+	userAgent, ip := session.Client(r)
+	sess, refreshToken, err := sessionRepo.Create(userTemp.ID, time.Now().Add(lifetime).Unix(), mfa, userAgent, ip)
+	if err != nil {
+		render.Render(w, r, status.ErrInternal(err))
+		return
+	}
+
+	tokenString, err := issueTokens(w, keys, userTemp, sess, refreshToken)
+	if err != nil {
+		render.Render(w, r, status.ErrInternal(err))
+		return
+	}
+
+	roleRepo := r.Context().Value(RoleRepoKey).(*role.Repo)
+	userData := user.NewUserPayload(userTemp, roleRepo)
+	userData.Token = tokenString
+	userData.RefreshToken = refreshToken
+
+	render.Status(r, http.StatusOK)
+	render.Render(w, r, userData)
+}
+
+// finishLogin completes a first factor login, either by asking for the
+// second factor when the user has one or by starting the session.
+func finishLogin(w http.ResponseWriter, r *http.Request, keys *keyring.Keyring, userTemp *user.User, remember bool) {
+	if isSuspended(w, r, userTemp.ID) {
+		return
+	}
+
+	totpRepo := r.Context().Value(TOTPRepoKey).(*totp.Repo)
+	if !totpRepo.IsEnabled(userTemp.ID) {
+		startSession(w, r, keys, userTemp, remember, false)
+		return
+	}
+
+	data := "0"
+	if remember {
+		data = "1"
+	}
+
+	tokenRepo := r.Context().Value(TokenRepoKey).(*usertoken.Repo)
+	challenge, err := tokenRepo.Issue(userTemp.ID, usertoken.TOTPChallenge, data, TOTPChallengeLifetime)
+	if err != nil {
+		render.Render(w, r, status.ErrInternal(err))
+		return
+	}
+
+	render.Status(r, http.StatusAccepted)
+	render.JSON(w, r, map[string]interface{}{
+		"status":        "Second factor required.",
+		"totp_required": true,
+		"challenge":     challenge,
+	})
+}
+
+// takeLoginAttempt counts a login attempt against the account and the
+// client address, or returns how long they have to wait if either is
+// throttled. A successful attempt is given back with Refund.
+func takeLoginAttempt(repo *throttle.Repo, limits throttle.Limits, accountKey string, ipKey string) (time.Duration, error) {
+	return repo.Take(map[string]throttle.Policy{accountKey: limits.Account, ipKey: limits.IP}, time.Now())
+}
+
+// JWKS publishes the public signing keys so other services can verify tokens.
+func JWKS(keys *keyring.Keyring) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		set, err := keys.PublicSet()
+		if err != nil {
+			render.Render(w, r, status.ErrInternal(err))
+			return
+		}
+
+		w.Header().Set("Cache-Control", "public, max-age=300")
+		render.JSON(w, r, set)
+	}
+}
+
+func clearTokenCookies(w http.ResponseWriter) {
+	if !Cookies.CookieAllowed() {
+		return
+	}
+	setCookie(w, "jwt", "", "/", time.Time{}, true)
+	setCookie(w, "refresh_token", "", RefreshCookiePath, time.Time{}, true)
+	setCookie(w, CSRFCookie, "", "/", time.Time{}, false)
+}
+
+func TokenRefresh(keys *keyring.Keyring) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		refreshToken := r.FormValue("refresh_token")
+		if refreshToken == "" && Cookies.CookieAllowed() {
+			if cookie, err := r.Cookie("refresh_token"); err == nil {
+				if !validCSRF(r) {
+					render.Render(w, r, status.ErrForbidden("Missing or invalid CSRF token."))
+					return
+				}
+				refreshToken = cookie.Value
+			}
+		}
+
+		if refreshToken == "" {
+			render.Render(w, r, status.ErrInvalidRequest(errors.New("Missing refresh token.")))
+			return
+		}
+
+		sessionRepo := r.Context().Value(SessionRepoKey).(*session.Repo)
+
+		userAgent, ip := session.Client(r)
+		sess, newRefreshToken, err := sessionRepo.Rotate(refreshToken, userAgent, ip)
+		if err == session.ErrInvalidToken || err == session.ErrTokenReused {
+			clearTokenCookies(w)
+			render.Render(w, r, status.ErrUnauthorized(err.Error()))
+			return
+		} else if err != nil {
+			render.Render(w, r, status.ErrInternal(err))
+			return
+		}
+
+		userRepo := r.Context().Value(UserRepoKey).(*user.Repo)
+		userTemp, err := userRepo.GetByID(sess.User_ID)
+		if err != nil {
+			render.Render(w, r, status.ErrUnauthorized("User no longer exists."))
+			return
+		}
+
+		tokenString, err := issueTokens(w, keys, userTemp, sess, newRefreshToken)
+		if err != nil {
+			render.Render(w, r, status.ErrInternal(err))
+			return
+		}
+
+		roleRepo := r.Context().Value(RoleRepoKey).(*role.Repo)
+		userData := user.NewUserPayload(userTemp, roleRepo)
+		userData.Token = tokenString
+		userData.RefreshToken = newRefreshToken
+
+		render.Status(r, http.StatusOK)
+		render.Render(w, r, userData)
+	}
+}
+
+func UserLogout(w http.ResponseWriter, r *http.Request) {
+	sessionRepo := r.Context().Value(SessionRepoKey).(*session.Repo)
+	claims := r.Context().Value(ClaimsKey).(user.Claims)
+
+	if err := sessionRepo.Revoke(claims.SessionID); err != nil {
+		render.Render(w, r, status.ErrInternal(err))
+		return
+	}
+
+	clearTokenCookies(w)
+	render.Status(r, http.StatusOK)
+	render.JSON(w, r, map[string]interface{}{"status": "Logged out."})
+}
+
+func SessionGetAll(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(UserKey).(int64)
+	claims := r.Context().Value(ClaimsKey).(user.Claims)
+	sessionRepo := r.Context().Value(SessionRepoKey).(*session.Repo)
+
+	sessions := sessionRepo.GetActiveFor(userID)
+	for _, sess := range sessions {
+		sess.Current = sess.ID == claims.SessionID
+	}
+
+	render.RenderList(w, r, session.NewSessionListPayload(sessions))
+}
+
+func SessionDelete(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(UserKey).(int64)
+	claims := r.Context().Value(ClaimsKey).(user.Claims)
+
+	sessionID, err := strconv.ParseInt(chi.URLParam(r, "sessionID"), 10, 64)
+	if err != nil || sessionID < 1 {
+		render.Render(w, r, status.ErrInvalidRequest(errors.New("Invalid session id.")))
+		return
+	}
+
+	sessionRepo := r.Context().Value(SessionRepoKey).(*session.Repo)
+	if err := sessionRepo.RevokeFor(sessionID, userID); err != nil {
+		render.Render(w, r, status.ErrNotFound)
+		return
+	}
+
+	if sessionID == claims.SessionID {
+		clearTokenCookies(w)
+	}
+
+	render.Render(w, r, status.DelSuccess())
+}
+
+// SessionDeleteOthers signs the user out everywhere but the current session.
+func SessionDeleteOthers(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(UserKey).(int64)
+	claims := r.Context().Value(ClaimsKey).(user.Claims)
+	sessionRepo := r.Context().Value(SessionRepoKey).(*session.Repo)
+
+	revoked, err := sessionRepo.RevokeOthers(userID, claims.SessionID)
+	if err != nil {
+		render.Render(w, r, status.ErrInternal(err))
+		return
+	}
+
+	render.JSON(w, r, map[string]interface{}{"status": "Signed out of other sessions.", "revoked": revoked})
+}
@@ -0,0 +1,92 @@
+package handler
+
+import (
+	"context"
+	"go-blog/platform/apikey"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+const testCSRF = "csrf-token-value"
+
+func TestValidCSRF(t *testing.T) {
+	tests := []struct {
+		name   string
+		cookie *string
+		header *string
+		want   bool
+	}{
+		{"matching", str(testCSRF), str(testCSRF), true},
+		{"no cookie", nil, str(testCSRF), false},
+		{"no header", str(testCSRF), nil, false},
+		{"neither", nil, nil, false},
+		{"empty cookie and header", str(""), str(""), false},
+		{"different header", str(testCSRF), str("csrf-token-valuf"), false},
+		{"header prefix", str(testCSRF), str(testCSRF[:len(testCSRF)-1]), false},
+		{"header longer", str(testCSRF), str(testCSRF + "x"), false},
+		{"other case", str(testCSRF), str("CSRF-TOKEN-VALUE"), false},
+	}
+
+	for _, test := range tests {
+		r := httptest.NewRequest(http.MethodPost, "/", nil)
+		if test.cookie != nil {
+			r.AddCookie(&http.Cookie{Name: CSRFCookie, Value: *test.cookie})
+		}
+		if test.header != nil {
+			r.Header.Set(CSRFHeader, *test.header)
+		}
+
+		if got := validCSRF(r); got != test.want {
+			t.Errorf("%s: validCSRF = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestCSRFProtect(t *testing.T) {
+	tests := []struct {
+		name       string
+		method     string
+		fromCookie bool
+		apiKey     bool
+		csrf       string
+		want       int
+	}{
+		{"get from cookie", http.MethodGet, true, false, "", http.StatusOK},
+		{"head from cookie", http.MethodHead, true, false, "", http.StatusOK},
+		{"options from cookie", http.MethodOptions, true, false, "", http.StatusOK},
+		{"post from cookie with token", http.MethodPost, true, false, testCSRF, http.StatusOK},
+		{"post from cookie without token", http.MethodPost, true, false, "", http.StatusForbidden},
+		{"put from cookie with wrong token", http.MethodPut, true, false, "wrong", http.StatusForbidden},
+		{"delete from cookie without token", http.MethodDelete, true, false, "", http.StatusForbidden},
+		{"post from header token", http.MethodPost, false, false, "", http.StatusOK},
+		{"post with api key", http.MethodPost, true, true, "", http.StatusOK},
+	}
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	for _, test := range tests {
+		r := httptest.NewRequest(test.method, "/", nil)
+		r.AddCookie(&http.Cookie{Name: CSRFCookie, Value: testCSRF})
+		if test.csrf != "" {
+			r.Header.Set(CSRFHeader, test.csrf)
+		}
+
+		ctx := context.WithValue(r.Context(), CookieAuthKey, test.fromCookie)
+		if test.apiKey {
+			ctx = context.WithValue(ctx, APIKeyKey, &apikey.Key{})
+		}
+
+		w := httptest.NewRecorder()
+		CSRFProtect(next).ServeHTTP(w, r.WithContext(ctx))
+		if w.Code != test.want {
+			t.Errorf("%s: status = %d, want %d", test.name, w.Code, test.want)
+		}
+	}
+}
+
+func str(s string) *string {
+	return &s
+}
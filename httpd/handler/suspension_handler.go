@@ -0,0 +1,160 @@
+package handler
+
+import (
+	"database/sql"
+	"errors"
+	"go-blog/platform/audit"
+	"go-blog/platform/role"
+	"go-blog/platform/status"
+	"go-blog/platform/user"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/go-chi/render"
+)
+
+// isSuspended renders an error and reports true when the user is suspended.
+// Shadow banned users pass, they aren't supposed to notice.
+func isSuspended(w http.ResponseWriter, r *http.Request, userID int64) bool {
+	userRepo := r.Context().Value(UserRepoKey).(*user.Repo)
+	suspension, err := userRepo.GetSuspension(userID)
+	if err == sql.ErrNoRows {
+		return false
+	} else if err != nil {
+		render.Render(w, r, status.ErrInternal(err))
+		return true
+	}
+
+	if suspension.Mode != user.Suspended {
+		return false
+	}
+
+	message := "Your account is suspended: " + suspension.Reason
+	if suspension.Expires_At != 0 {
+		message += " (until " + time.Unix(suspension.Expires_At, 0).UTC().Format(time.RFC3339) + ")"
+	}
+	render.Render(w, r, status.ErrForbidden(message))
+	return true
+}
+
+// suspensionTarget loads the user a moderator wants to suspend, or renders
+// an error and returns nil. Moderators can't act on themselves or on users
+// with permissions they don't have.
+func suspensionTarget(w http.ResponseWriter, r *http.Request) *user.User {
+	userID, err := strconv.ParseInt(chi.URLParam(r, "userID"), 10, 64)
+	if err != nil || userID < 1 {
+		render.Render(w, r, status.ErrInvalidRequest(errors.New("Invalid user id.")))
+		return nil
+	}
+
+	roleRepo := r.Context().Value(RoleRepoKey).(*role.Repo)
+	claims := r.Context().Value(ClaimsKey).(user.Claims)
+
+	userRole, err := claimsRole(roleRepo, claims)
+	if err != nil {
+		render.Render(w, r, status.ErrInternal(err))
+		return nil
+	} else if !userRole.Check(role.CanManageOtherUsers) {
+		render.Render(w, r, status.ErrUnauthorized("You are not authorized to suspend users."))
+		return nil
+	} else if missingTOTP(userRole, claims) {
+		render.Render(w, r, status.ErrUnauthorized("Two-factor authentication is required for this action."))
+		return nil
+	}
+
+	if userID == claims.UserID {
+		render.Render(w, r, status.ErrUnauthorized("You can't suspend yourself."))
+		return nil
+	}
+
+	userRepo := r.Context().Value(UserRepoKey).(*user.Repo)
+	userTemp, err := userRepo.GetByID(userID)
+	if err != nil {
+		render.Render(w, r, status.ErrNotFound)
+		return nil
+	}
+
+	if targetRole, err := roleRepo.GetByID(userTemp.Role_ID); err == nil && !userRole.Covers(targetRole) {
+		render.Render(w, r, status.ErrUnauthorized("You can't suspend a user with permissions you don't have."))
+		return nil
+	}
+
+	return userTemp
+}
+
+// UserSuspensionGet shows the suspension in effect for a user.
+func UserSuspensionGet(w http.ResponseWriter, r *http.Request) {
+	userTemp := suspensionTarget(w, r)
+	if userTemp == nil {
+		return
+	}
+
+	userRepo := r.Context().Value(UserRepoKey).(*user.Repo)
+	suspension, err := userRepo.GetSuspension(userTemp.ID)
+	if err == sql.ErrNoRows {
+		render.Render(w, r, status.ErrNotFound)
+		return
+	} else if err != nil {
+		render.Render(w, r, status.ErrInternal(err))
+		return
+	}
+
+	render.Render(w, r, user.NewSuspensionPayload(suspension))
+}
+
+// UserSuspend suspends or shadow bans a user, replacing any earlier suspension.
+func UserSuspend(w http.ResponseWriter, r *http.Request) {
+	data := &user.SuspensionPayload{}
+	if err := render.Bind(r, data); err != nil {
+		render.Render(w, r, status.ErrInvalidRequest(err))
+		return
+	}
+
+	userTemp := suspensionTarget(w, r)
+	if userTemp == nil {
+		return
+	}
+
+	claims := r.Context().Value(ClaimsKey).(user.Claims)
+	userRepo := r.Context().Value(UserRepoKey).(*user.Repo)
+
+	suspension := data.Suspension
+	suspension.User_ID = userTemp.ID
+	suspension.Actor_ID = claims.UserID
+
+	before, _ := userRepo.GetSuspension(userTemp.ID)
+
+	if err := userRepo.Suspend(suspension); err != nil {
+		render.Render(w, r, status.ErrInternal(err))
+		return
+	}
+
+	recordAudit(r, audit.UserSuspend, audit.TargetUser, userTemp.ID, before, suspension)
+
+	render.Render(w, r, user.NewSuspensionPayload(suspension))
+}
+
+// UserUnsuspend lifts the suspension of a user.
+func UserUnsuspend(w http.ResponseWriter, r *http.Request) {
+	userTemp := suspensionTarget(w, r)
+	if userTemp == nil {
+		return
+	}
+
+	userRepo := r.Context().Value(UserRepoKey).(*user.Repo)
+	before, _ := userRepo.GetSuspension(userTemp.ID)
+
+	if err := userRepo.Unsuspend(userTemp.ID); err == sql.ErrNoRows {
+		render.Render(w, r, status.ErrNotFound)
+		return
+	} else if err != nil {
+		render.Render(w, r, status.ErrInternal(err))
+		return
+	}
+
+	recordAudit(r, audit.UserUnsuspend, audit.TargetUser, userTemp.ID, before, nil)
+
+	render.Render(w, r, status.DelSuccess())
+}
@@ -0,0 +1,183 @@
+package handler
+
+import (
+	"database/sql"
+	"errors"
+	"go-blog/platform/article"
+	"go-blog/platform/audit"
+	"go-blog/platform/role"
+	"go-blog/platform/status"
+	"go-blog/platform/tag"
+	"go-blog/platform/user"
+	"net/http"
+	"net/url"
+
+	"github.com/go-chi/chi"
+	"github.com/go-chi/render"
+)
+
+// managesTags reports whether the caller may rename, merge and delete tags
+// and manage categories, to show them what they manage.
+func managesTags(r *http.Request) bool {
+	claims := r.Context().Value(ClaimsKey).(user.Claims)
+	if !claims.Authenticated {
+		return false
+	}
+
+	roleRepo := r.Context().Value(RoleRepoKey).(*role.Repo)
+	userRole, err := claimsRole(roleRepo, claims)
+	return err == nil && userRole.Check(role.CanManageTags)
+}
+
+// canManageTags is managesTags for the changes, it renders an error and
+// returns false when the caller can't manage 'what' or still has to give
+// the second factor their role requires.
+func canManageTags(w http.ResponseWriter, r *http.Request, what string) bool {
+	claims := r.Context().Value(ClaimsKey).(user.Claims)
+	if !claims.Authenticated {
+		render.Render(w, r, status.ErrUnauthorized("You are not authorized to manage "+what+"."))
+		return false
+	}
+
+	roleRepo := r.Context().Value(RoleRepoKey).(*role.Repo)
+	userRole, err := claimsRole(roleRepo, claims)
+	if err != nil {
+		render.Render(w, r, status.ErrInternal(err))
+		return false
+	} else if !userRole.Check(role.CanManageTags) {
+		render.Render(w, r, status.ErrUnauthorized("You are not authorized to manage "+what+"."))
+		return false
+	} else if missingTOTP(userRole, claims) {
+		render.Render(w, r, status.ErrUnauthorized("Two-factor authentication is required for this action."))
+		return false
+	}
+
+	return true
+}
+
+// managedTag loads the tag in the url for a tag manager, or renders an error and returns nil.
+func managedTag(w http.ResponseWriter, r *http.Request) *tag.Tag {
+	if !canManageTags(w, r, "tags") {
+		return nil
+	}
+
+	name, err := url.PathUnescape(chi.URLParam(r, "tagName"))
+	if err != nil {
+		render.Render(w, r, status.ErrInvalidRequest(err))
+		return nil
+	}
+
+	tagRepo := r.Context().Value(TagRepoKey).(*tag.Repo)
+	tagTemp, err := tagRepo.GetByName(name, article.PublishedCondition)
+	if err == sql.ErrNoRows {
+		render.Render(w, r, status.ErrNotFound)
+		return nil
+	} else if err != nil {
+		render.Render(w, r, status.ErrInternal(err))
+		return nil
+	}
+
+	return tagTemp
+}
+
+// TagGetAll lists the tags by how many published articles have them, the
+// ones starting with 'search' if given. Tag managers also see unused tags.
+func TagGetAll(w http.ResponseWriter, r *http.Request) {
+	tagRepo := r.Context().Value(TagRepoKey).(*tag.Repo)
+	page := r.Context().Value(PageKey).(int)
+
+	search := tag.NewSearch(article.PublishedCondition)
+	search.QueryPrefix(r.FormValue("search"))
+	if !managesTags(r) {
+		search.QueryUsed()
+	}
+	search.Limit(page)
+
+	render.RenderList(w, r, tag.NewTagListPayload(tagRepo.GetMultiple(search)))
+}
+
+// TagRename renames a tag to 'name' on every article.
+func TagRename(w http.ResponseWriter, r *http.Request) {
+	tagTemp := managedTag(w, r)
+	if tagTemp == nil {
+		return
+	}
+
+	name := tag.Normalize(r.FormValue("name"))
+	if !tag.IsValid(name) {
+		render.Render(w, r, status.ErrInvalidRequest(tag.ErrInvalid))
+		return
+	}
+
+	tagRepo := r.Context().Value(TagRepoKey).(*tag.Repo)
+	if err := tagRepo.Rename(tagTemp.ID, name); err == tag.ErrExists {
+		render.Render(w, r, status.ErrConflict(err.Error()))
+		return
+	} else if err != nil {
+		render.Render(w, r, status.ErrInternal(err))
+		return
+	}
+
+	recordAudit(r, audit.TagRename, audit.TargetTag, tagTemp.ID,
+		map[string]string{"name": tagTemp.Name}, map[string]string{"name": name})
+
+	tagTemp.Name = name
+	render.Render(w, r, &tag.TagPayload{Tag: tagTemp})
+}
+
+// TagMerge moves the articles of a tag to the tag given as 'into' and deletes it.
+func TagMerge(w http.ResponseWriter, r *http.Request) {
+	tagTemp := managedTag(w, r)
+	if tagTemp == nil {
+		return
+	}
+
+	tagRepo := r.Context().Value(TagRepoKey).(*tag.Repo)
+	into, err := tagRepo.GetByName(r.FormValue("into"), article.PublishedCondition)
+	if err == sql.ErrNoRows {
+		render.Render(w, r, status.ErrInvalidRequest(errors.New("The tag to merge into does not exist.")))
+		return
+	} else if err != nil {
+		render.Render(w, r, status.ErrInternal(err))
+		return
+	}
+
+	if into.ID == tagTemp.ID {
+		render.Render(w, r, status.ErrInvalidRequest(errors.New("A tag can't be merged into itself.")))
+		return
+	}
+
+	moved, err := tagRepo.Merge(tagTemp.ID, into.ID)
+	if err != nil {
+		render.Render(w, r, status.ErrInternal(err))
+		return
+	}
+
+	recordAudit(r, audit.TagMerge, audit.TargetTag, tagTemp.ID, tagTemp,
+		map[string]interface{}{"into_id": into.ID, "into": into.Name, "moved_articles": moved})
+
+	if into, err = tagRepo.GetByName(into.Name, article.PublishedCondition); err != nil {
+		render.Render(w, r, status.ErrInternal(err))
+		return
+	}
+
+	render.Render(w, r, &tag.TagPayload{Tag: into})
+}
+
+// TagDelete removes a tag from every article.
+func TagDelete(w http.ResponseWriter, r *http.Request) {
+	tagTemp := managedTag(w, r)
+	if tagTemp == nil {
+		return
+	}
+
+	tagRepo := r.Context().Value(TagRepoKey).(*tag.Repo)
+	if err := tagRepo.Delete(tagTemp.ID); err != nil {
+		render.Render(w, r, status.ErrInternal(err))
+		return
+	}
+
+	recordAudit(r, audit.TagDelete, audit.TargetTag, tagTemp.ID, tagTemp, nil)
+
+	render.Render(w, r, status.DelSuccess())
+}
@@ -0,0 +1,169 @@
+package handler
+
+import (
+	"errors"
+	"go-blog/platform/audit"
+	"go-blog/platform/password"
+	"go-blog/platform/role"
+	"go-blog/platform/status"
+	"go-blog/platform/totp"
+	"go-blog/platform/user"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/render"
+)
+
+const TOTPIssuer = "go-blog"
+
+// missingTOTP reports whether the role's 2FA policy asks for a second factor
+// the current session didn't provide.
+func missingTOTP(userRole *role.Role, claims user.Claims) bool {
+	return userRole.Require_TOTP && !claims.MFA
+}
+
+func TOTPEnroll(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(UserKey).(int64)
+	claims := r.Context().Value(ClaimsKey).(user.Claims)
+
+	if userID != claims.UserID {
+		render.Render(w, r, status.ErrUnauthorized("Only the user can enroll a device."))
+		return
+	}
+
+	totpRepo := r.Context().Value(TOTPRepoKey).(*totp.Repo)
+	if totpRepo.IsEnabled(userID) {
+		render.Render(w, r, status.ErrConflict("Two-factor authentication is already enabled."))
+		return
+	}
+
+	userRepo := r.Context().Value(UserRepoKey).(*user.Repo)
+	userTemp, err := userRepo.GetByID(userID)
+	if err != nil {
+		render.Render(w, r, status.ErrNotFound)
+		return
+	}
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		render.Render(w, r, status.ErrInternal(err))
+		return
+	}
+
+	if err = totpRepo.SetPending(userID, secret); err != nil {
+		render.Render(w, r, status.ErrInternal(err))
+		return
+	}
+
+	render.Status(r, http.StatusCreated)
+	render.JSON(w, r, &totp.Enrollment{Secret: secret, URI: totp.URI(TOTPIssuer, userTemp.Email, secret)})
+}
+
+func TOTPConfirm(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(UserKey).(int64)
+	claims := r.Context().Value(ClaimsKey).(user.Claims)
+
+	if userID != claims.UserID {
+		render.Render(w, r, status.ErrUnauthorized("Only the user can enroll a device."))
+		return
+	}
+
+	var code string
+	if code = r.FormValue("code"); code == "" {
+		render.Render(w, r, status.ErrInvalidRequest(errors.New("Missing code field")))
+		return
+	}
+
+	totpRepo := r.Context().Value(TOTPRepoKey).(*totp.Repo)
+	pending, err := totpRepo.GetByUserID(userID)
+	if err != nil || pending.Enabled {
+		render.Render(w, r, status.ErrInvalidRequest(errors.New("No pending enrollment.")))
+		return
+	}
+
+	step := totp.Match(pending.Secret, code, time.Now())
+	if step == 0 {
+		render.Render(w, r, status.ErrUnauthorized("Wrong code."))
+		return
+	}
+
+	codes, err := totp.GenerateRecoveryCodes()
+	if err != nil {
+		render.Render(w, r, status.ErrInternal(err))
+		return
+	}
+
+	if err = totpRepo.Enable(userID, step, codes); err != nil {
+		render.Render(w, r, status.ErrInternal(err))
+		return
+	}
+
+	render.Status(r, http.StatusOK)
+	render.JSON(w, r, map[string]interface{}{"recovery_codes": codes})
+}
+
+func TOTPRecoveryCodes(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(UserKey).(int64)
+	claims := r.Context().Value(ClaimsKey).(user.Claims)
+
+	if userID != claims.UserID {
+		render.Render(w, r, status.ErrUnauthorized("You are not the user."))
+		return
+	}
+
+	totpRepo := r.Context().Value(TOTPRepoKey).(*totp.Repo)
+	if ok, err := totpRepo.Verify(userID, r.FormValue("code")); err != nil {
+		render.Render(w, r, status.ErrInternal(err))
+		return
+	} else if !ok {
+		render.Render(w, r, status.ErrUnauthorized("Wrong code."))
+		return
+	}
+
+	codes, err := totp.GenerateRecoveryCodes()
+	if err != nil {
+		render.Render(w, r, status.ErrInternal(err))
+		return
+	}
+
+	if err = totpRepo.ReplaceRecoveryCodes(userID, codes); err != nil {
+		render.Render(w, r, status.ErrInternal(err))
+		return
+	}
+
+	render.Status(r, http.StatusOK)
+	render.JSON(w, r, map[string]interface{}{"recovery_codes": codes})
+}
+
+// TOTPDisable needs the password when users turn it off for themselves,
+// moderators passing UserSelfID can reset it for users who lost their device.
+func TOTPDisable(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(UserKey).(int64)
+	claims := r.Context().Value(ClaimsKey).(user.Claims)
+
+	if userID == claims.UserID {
+		userRepo := r.Context().Value(UserRepoKey).(*user.Repo)
+		userTemp, err := userRepo.GetByID(userID)
+		if err != nil {
+			render.Render(w, r, status.ErrNotFound)
+			return
+		}
+
+		if ok, _ := password.Default.Verify(userTemp.Password, r.FormValue("password")); !ok {
+			render.Render(w, r, status.ErrUnauthorized("Password is wrong."))
+			return
+		}
+	}
+
+	totpRepo := r.Context().Value(TOTPRepoKey).(*totp.Repo)
+	if err := totpRepo.Disable(userID); err != nil {
+		render.Render(w, r, status.ErrInternal(err))
+		return
+	}
+
+	if userID != claims.UserID {
+		recordAudit(r, audit.UserDisableTOTP, audit.TargetUser, userID, nil, nil)
+	}
+
+	render.Render(w, r, status.DelSuccess())
+}
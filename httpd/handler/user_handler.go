@@ -1,43 +1,67 @@
 package handler
 
 import (
+	"database/sql"
 	"errors"
 	"go-blog/platform/article"
+	"go-blog/platform/audit"
 	"go-blog/platform/comment"
+	"go-blog/platform/keyring"
+	"go-blog/platform/mail"
+	"go-blog/platform/password"
 	"go-blog/platform/role"
+	"go-blog/platform/session"
 	"go-blog/platform/status"
+	"go-blog/platform/throttle"
+	"go-blog/platform/totp"
 	"go-blog/platform/user"
+	"go-blog/platform/usertoken"
+	"html/template"
 	"io/ioutil"
+	"log"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
 	"strconv"
 	"time"
 
 	"github.com/go-chi/chi"
-	"github.com/go-chi/jwtauth"
 	"github.com/go-chi/render"
-	"golang.org/x/crypto/bcrypt"
 )
 
 const (
 	PROFILE_PICS = "/profile-pics"
 	SERVE_PATH   = "/static"
 	DEFAULT_PIC  = SERVE_PATH + PROFILE_PICS + "/user.png"
+
+	PasswordResetLifetime = time.Hour
+	EmailVerifyLifetime   = 48 * time.Hour
+	TOTPChallengeLifetime = 5 * time.Minute
 )
 
 func UserDelete(w http.ResponseWriter, r *http.Request) {
 	userID := r.Context().Value(UserKey).(int64)
 	repo := r.Context().Value(UserRepoKey).(*user.Repo)
+	claims := r.Context().Value(ClaimsKey).(user.Claims)
+
+	before, _ := repo.GetByID(userID)
 
 	if err := repo.Delete(userID); err != nil {
 		render.Render(w, r, status.ErrInvalidRequest(err))
 		return
 	}
 
+	if userID != claims.UserID {
+		recordAudit(r, audit.UserDelete, audit.TargetUser, userID, userSnapshot(before), nil)
+	}
+
 	render.Render(w, r, status.DelSuccess())
 }
 
+// AssignRole changes the role of another user. The assigner can only hand out
+// roles made of permissions they hold, and only to users whose current role
+// they could have assigned themselves.
 func AssignRole(w http.ResponseWriter, r *http.Request) {
 	var strUserID string
 
@@ -52,36 +76,156 @@ func AssignRole(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	roleRepo := r.Context().Value(RoleRepoKey).(*role.Repo)
-
-	var roleID string
-	if roleID = r.FormValue("id"); roleID == "" {
-		render.Render(w, r, status.ErrInvalidRequest(errors.New("Missing role ID")))
+	roleID, err := strconv.ParseInt(r.FormValue("id"), 10, 64)
+	if err != nil || roleID < 1 {
+		render.Render(w, r, status.ErrInvalidRequest(errors.New("Missing or invalid role ID.")))
 		return
 	}
 
+	roleRepo := r.Context().Value(RoleRepoKey).(*role.Repo)
 	claims := r.Context().Value(ClaimsKey).(user.Claims)
 
-	if userRole, err := roleRepo.GetByID(claims.RoleID); err != nil {
+	userRole, err := claimsRole(roleRepo, claims)
+	if err != nil {
 		render.Render(w, r, status.ErrInternal(err))
 		return
-	} else if !userRole.Check(role.CanManageRole) {
+	} else if !userRole.Check(role.CanAssignRole) {
 		render.Render(w, r, status.ErrUnauthorized("You are not authorized to assign a role."))
 		return
+	} else if missingTOTP(userRole, claims) {
+		render.Render(w, r, status.ErrUnauthorized("Two-factor authentication is required for this action."))
+		return
 	}
 
-	userRepo := r.Context().Value(UserRepoKey).(*user.Repo)
+	if userID == claims.UserID {
+		render.Render(w, r, status.ErrUnauthorized("You can't change your own role."))
+		return
+	}
 
-	if err := userRepo.Update(userID, "role_id", roleID); err != nil {
+	newRole, err := roleRepo.GetByID(roleID)
+	if err == sql.ErrNoRows {
+		render.Render(w, r, status.ErrInvalidRequest(errors.New("Role does not exist.")))
+		return
+	} else if err != nil {
 		render.Render(w, r, status.ErrInternal(err))
 		return
 	}
 
-	if userTemp, err := userRepo.GetByID(userID); err != nil {
+	userRepo := r.Context().Value(UserRepoKey).(*user.Repo)
+	userTemp, err := userRepo.GetByID(userID)
+	if err != nil {
 		render.Render(w, r, status.ErrNotFound)
-	} else {
+		return
+	}
+
+	if !userRole.Covers(newRole) {
+		render.Render(w, r, status.ErrUnauthorized("You can't assign a role with permissions you don't have."))
+		return
+	}
+
+	if oldRole, err := roleRepo.GetByID(userTemp.Role_ID); err == nil && !userRole.Covers(oldRole) {
+		render.Render(w, r, status.ErrUnauthorized("You can't change the role of a user with permissions you don't have."))
+		return
+	}
+
+	if userTemp.Role_ID == newRole.ID {
 		render.Render(w, r, user.NewUserPayload(userTemp, roleRepo))
+		return
+	}
+
+	err = roleRepo.Assign(&role.Assignment{
+		User_ID:     userID,
+		Actor_ID:    claims.UserID,
+		Old_Role_ID: userTemp.Role_ID,
+		New_Role_ID: newRole.ID,
+		Created_At:  time.Now().Unix(),
+	})
+	if err != nil {
+		render.Render(w, r, status.ErrInternal(err))
+		return
+	}
+
+	sessionRepo := r.Context().Value(SessionRepoKey).(*session.Repo)
+	if err := sessionRepo.RevokeAllFor(userID); err != nil {
+		render.Render(w, r, status.ErrInternal(err))
+		return
+	}
+
+	recordAudit(r, audit.RoleAssign, audit.TargetUser, userID,
+		map[string]int64{"role_id": userTemp.Role_ID}, map[string]int64{"role_id": newRole.ID})
+
+	userTemp.Role_ID = newRole.ID
+	render.Render(w, r, user.NewUserPayload(userTemp, roleRepo))
+}
+
+// RoleAssignments lists the role changes of a user, newest first.
+func RoleAssignments(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.ParseInt(chi.URLParam(r, "userID"), 10, 64)
+	if err != nil || userID < 1 {
+		render.Render(w, r, status.ErrInvalidRequest(errors.New("Invalid user id.")))
+		return
 	}
+
+	roleRepo := r.Context().Value(RoleRepoKey).(*role.Repo)
+	claims := r.Context().Value(ClaimsKey).(user.Claims)
+
+	if userRole, err := claimsRole(roleRepo, claims); err != nil {
+		render.Render(w, r, status.ErrInternal(err))
+		return
+	} else if userID != claims.UserID && !userRole.Check(role.CanAssignRole) {
+		render.Render(w, r, status.ErrUnauthorized("You are not authorized to see role changes."))
+		return
+	}
+
+	render.RenderList(w, r, role.NewAssignmentListPayload(roleRepo.GetAssignments(userID)))
+}
+
+// UserUnlock lifts the login lockout of an account.
+func UserUnlock(w http.ResponseWriter, r *http.Request) {
+	var strUserID string
+
+	if strUserID = chi.URLParam(r, "userID"); strUserID == "" {
+		render.Render(w, r, status.ErrInvalidRequest(errors.New("Missing user ID.")))
+		return
+	}
+
+	userID, err := strconv.ParseInt(strUserID, 10, 64)
+	if err != nil || userID < 1 {
+		render.Render(w, r, status.ErrInvalidRequest(errors.New("Invalid user id.")))
+		return
+	}
+
+	roleRepo := r.Context().Value(RoleRepoKey).(*role.Repo)
+	claims := r.Context().Value(ClaimsKey).(user.Claims)
+
+	if userRole, err := claimsRole(roleRepo, claims); err != nil {
+		render.Render(w, r, status.ErrInternal(err))
+		return
+	} else if !userRole.Check(role.CanManageOtherUsers) {
+		render.Render(w, r, status.ErrUnauthorized("You are not authorized to unlock users."))
+		return
+	} else if missingTOTP(userRole, claims) {
+		render.Render(w, r, status.ErrUnauthorized("Two-factor authentication is required for this action."))
+		return
+	}
+
+	userRepo := r.Context().Value(UserRepoKey).(*user.Repo)
+	userTemp, err := userRepo.GetByID(userID)
+	if err != nil {
+		render.Render(w, r, status.ErrNotFound)
+		return
+	}
+
+	throttleRepo := r.Context().Value(ThrottleRepoKey).(*throttle.Repo)
+	if err = throttleRepo.Reset(throttle.AccountKey(userTemp.Email)); err != nil {
+		render.Render(w, r, status.ErrInternal(err))
+		return
+	}
+
+	recordAudit(r, audit.UserUnlock, audit.TargetUser, userID, nil, nil)
+
+	render.Status(r, http.StatusOK)
+	render.JSON(w, r, map[string]interface{}{"status": "Account unlocked."})
 }
 
 // only accepts 2mb png and jpeg
@@ -157,51 +301,155 @@ func UserUpdateImage(w http.ResponseWriter, r *http.Request) {
 		os.Remove(filepath.Join(workDir, userTemp.Image))
 	}
 
+	if claims := r.Context().Value(ClaimsKey).(user.Claims); userID != claims.UserID {
+		recordAudit(r, audit.UserUpdateImage, audit.TargetUser, userID,
+			map[string]string{"image": userTemp.Image}, map[string]string{"image": imagePath})
+	}
+
 	userTemp.Image = imagePath
 	render.Render(w, r, user.NewUserPayload(userTemp, roleRepo))
 }
 
-func UserUpdateEmail(w http.ResponseWriter, r *http.Request) {
-	var data user.UpdateEmail
+// UserUpdateEmail doesn't switch the address right away, it mails a confirmation
+// link to the new one and the change happens in UserConfirmEmail.
+func UserUpdateEmail(mailer mail.Mailer, publicURL string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var data user.UpdateEmail
 
-	if err := render.Bind(r, &data); err != nil {
-		render.Render(w, r, status.ErrInvalidRequest(err))
+		if err := render.Bind(r, &data); err != nil {
+			render.Render(w, r, status.ErrInvalidRequest(err))
+			return
+		}
+
+		userRepo := r.Context().Value(UserRepoKey).(*user.Repo)
+
+		exist, err := userRepo.DoesEmailExist(data.Email)
+		if err != nil {
+			render.Render(w, r, status.ErrInternal(err))
+			return
+		}
+		if exist {
+			render.Render(w, r, status.ErrConflict("Email already registered."))
+			return
+		}
+
+		userID := r.Context().Value(UserKey).(int64)
+		tempUser, _ := userRepo.GetByID(userID)
+
+		if ok, _ := password.Default.Verify(tempUser.Password, data.Password); !ok {
+			render.Render(w, r, status.ErrUnauthorized("Password is wrong."))
+			return
+		}
+
+		tokenRepo := r.Context().Value(TokenRepoKey).(*usertoken.Repo)
+		if err = sendEmailVerification(mailer, publicURL, tokenRepo, userID, data.Email); err != nil {
+			render.Render(w, r, status.ErrInternal(err))
+			return
+		}
+
+		render.Status(r, http.StatusAccepted)
+		render.JSON(w, r, map[string]interface{}{"status": "A confirmation link has been sent to the new address."})
+	}
+}
+
+func UserResendVerification(mailer mail.Mailer, publicURL string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID := r.Context().Value(UserKey).(int64)
+		userRepo := r.Context().Value(UserRepoKey).(*user.Repo)
+		tokenRepo := r.Context().Value(TokenRepoKey).(*usertoken.Repo)
+
+		tempUser, err := userRepo.GetByID(userID)
+		if err != nil {
+			render.Render(w, r, status.ErrNotFound)
+			return
+		}
+
+		if tempUser.Verified {
+			render.Render(w, r, status.ErrConflict("Email is already verified."))
+			return
+		}
+
+		if err = sendEmailVerification(mailer, publicURL, tokenRepo, userID, tempUser.Email); err != nil {
+			render.Render(w, r, status.ErrInternal(err))
+			return
+		}
+
+		render.Status(r, http.StatusAccepted)
+		render.JSON(w, r, map[string]interface{}{"status": "A confirmation link has been sent."})
+	}
+}
+
+// UserConfirmEmail consumes a verification token. If the token was issued for
+// a different address than the current one, the address is switched too.
+func UserConfirmEmail(w http.ResponseWriter, r *http.Request) {
+	var strToken string
+	if strToken = r.FormValue("token"); strToken == "" {
+		render.Render(w, r, status.ErrInvalidRequest(errors.New("Missing token field")))
 		return
 	}
 
-	userRepo := r.Context().Value(UserRepoKey).(*user.Repo)
+	tokenRepo := r.Context().Value(TokenRepoKey).(*usertoken.Repo)
 
-	exist, err := userRepo.DoesEmailExist(data.Email)
-	if err != nil {
+	token, err := tokenRepo.Consume(strToken, usertoken.EmailVerify)
+	if err == usertoken.ErrInvalidToken {
+		render.Render(w, r, status.ErrUnauthorized(err.Error()))
+		return
+	} else if err != nil {
 		render.Render(w, r, status.ErrInternal(err))
 		return
 	}
-	if exist {
-		render.Render(w, r, status.ErrConflict("Email already registered."))
+
+	userRepo := r.Context().Value(UserRepoKey).(*user.Repo)
+	tempUser, err := userRepo.GetByID(token.User_ID)
+	if err != nil {
+		render.Render(w, r, status.ErrNotFound)
 		return
 	}
 
-	userID := r.Context().Value(UserKey).(int64)
-	tempUser, _ := userRepo.GetByID(userID)
+	if token.Data != tempUser.Email {
+		exist, err := userRepo.DoesEmailExist(token.Data)
+		if err != nil {
+			render.Render(w, r, status.ErrInternal(err))
+			return
+		}
+		if exist {
+			render.Render(w, r, status.ErrConflict("Email already registered."))
+			return
+		}
 
-	err = bcrypt.CompareHashAndPassword([]byte(tempUser.Password), []byte(data.Password))
-	if err != nil {
-		render.Render(w, r, status.ErrUnauthorized("Password is wrong."))
-		return
+		if err = userRepo.Update(tempUser.ID, "email", token.Data); err != nil {
+			render.Render(w, r, status.ErrInternal(err))
+			return
+		}
+		tempUser.Email = token.Data
 	}
 
-	if err = userRepo.Update(userID, "email", data.Email); err != nil {
+	if err = userRepo.Update(tempUser.ID, "verified", true); err != nil {
 		render.Render(w, r, status.ErrInternal(err))
 		return
 	}
-
-	tempUser.Email = data.Email
+	tempUser.Verified = true
 
 	roleRepo := r.Context().Value(RoleRepoKey).(*role.Repo)
 	render.Status(r, http.StatusOK)
 	render.Render(w, r, user.NewUserPayload(tempUser, roleRepo))
 }
 
+func sendEmailVerification(mailer mail.Mailer, publicURL string, tokenRepo *usertoken.Repo, userID int64, email string) error {
+	token, err := tokenRepo.Issue(userID, usertoken.EmailVerify, email, EmailVerifyLifetime)
+	if err != nil {
+		return err
+	}
+
+	return mailer.Send(&mail.Message{
+		To:      email,
+		Subject: "Confirm your email address",
+		Body: "Please confirm this address for your go-blog account by opening the link below:\n\n" +
+			publicURL + "/email/confirm?token=" + url.QueryEscape(token) + "\n\n" +
+			"If you didn't ask for this, you can ignore this message.",
+	})
+}
+
 func UserUpdatePassword(w http.ResponseWriter, r *http.Request) {
 	var data user.UpdatePassword
 
@@ -214,29 +462,159 @@ func UserUpdatePassword(w http.ResponseWriter, r *http.Request) {
 	userRepo := r.Context().Value(UserRepoKey).(*user.Repo)
 	tempUser, _ := userRepo.GetByID(userID)
 
-	err := bcrypt.CompareHashAndPassword([]byte(tempUser.Password), []byte(data.OldPassword))
-	if err != nil {
+	if ok, _ := password.Default.Verify(tempUser.Password, data.OldPassword); !ok {
 		render.Render(w, r, status.ErrUnauthorized("Current password is wrong."))
 		return
 	}
 
-	if hashedPassword, err := bcrypt.GenerateFromPassword([]byte(data.Password), bcrypt.DefaultCost); err == nil {
-		data.Password = string(hashedPassword)
-	} else {
+	hashedPassword, err := password.Default.Hash(data.Password)
+	if err != nil {
 		render.Render(w, r, status.ErrInternal(err))
 		return
 	}
+	data.Password = hashedPassword
 
 	if err = userRepo.Update(userID, "password", data.Password); err != nil {
 		render.Render(w, r, status.ErrInternal(err))
 		return
 	}
 
+	sessionRepo := r.Context().Value(SessionRepoKey).(*session.Repo)
+	if err = sessionRepo.RevokeAllFor(userID); err != nil {
+		render.Render(w, r, status.ErrInternal(err))
+		return
+	}
+
 	roleRepo := r.Context().Value(RoleRepoKey).(*role.Repo)
 	render.Status(r, http.StatusOK)
 	render.Render(w, r, user.NewUserPayload(tempUser, roleRepo))
 }
 
+// UserForgotPassword mails a reset link if the email is registered. It answers
+// the same way either way so it can't be used to probe for accounts.
+func UserForgotPassword(mailer mail.Mailer, publicURL string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var data user.ForgotPassword
+
+		if err := render.Bind(r, &data); err != nil {
+			render.Render(w, r, status.ErrInvalidRequest(err))
+			return
+		}
+
+		userRepo := r.Context().Value(UserRepoKey).(*user.Repo)
+		tokenRepo := r.Context().Value(TokenRepoKey).(*usertoken.Repo)
+
+		if userTemp, err := userRepo.GetByEmail(data.Email); err == nil {
+			token, err := tokenRepo.Issue(userTemp.ID, usertoken.PasswordReset, "", PasswordResetLifetime)
+			if err != nil {
+				render.Render(w, r, status.ErrInternal(err))
+				return
+			}
+
+			err = mailer.Send(&mail.Message{
+				To:      userTemp.Email,
+				Subject: "Reset your password",
+				Body: "Someone asked to reset the password of your account.\n" +
+					"Use the link below within an hour to choose a new one:\n\n" +
+					publicURL + "/password/reset?token=" + url.QueryEscape(token) + "\n\n" +
+					"If it wasn't you, you can ignore this message.",
+			})
+			if err != nil {
+				log.Println(err)
+			}
+		}
+
+		render.Status(r, http.StatusOK)
+		render.JSON(w, r, map[string]interface{}{"status": "If the email is registered, a reset link has been sent."})
+	}
+}
+
+// resetPasswordPage is what the link in the reset mail opens, it posts the
+// token with the new password back to the same path.
+var resetPasswordPage = template.Must(template.New("reset").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="referrer" content="no-referrer">
+<title>Reset your password</title>
+</head>
+<body>
+<form method="post" action="/password/reset">
+<input type="hidden" name="token" value="{{.}}">
+<label>New password <input type="password" name="password" autocomplete="new-password" required></label>
+<button type="submit">Reset password</button>
+</form>
+</body>
+</html>
+`))
+
+func UserResetPasswordPage(w http.ResponseWriter, r *http.Request) {
+	token := r.FormValue("token")
+	if token == "" {
+		render.Render(w, r, status.ErrInvalidRequest(errors.New("Missing token field")))
+		return
+	}
+
+	// The token is in the url, it shouldn't be kept or sent anywhere else.
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	if err := resetPasswordPage.Execute(w, token); err != nil {
+		log.Println(err)
+	}
+}
+
+// UserResetPassword takes the token and new password as json, or as the
+// form of the reset page.
+func UserResetPassword(w http.ResponseWriter, r *http.Request) {
+	var data user.ResetPassword
+
+	var err error
+	if render.GetRequestContentType(r) == render.ContentTypeForm {
+		data.Token, data.Password = r.PostFormValue("token"), r.PostFormValue("password")
+		err = data.Bind(r)
+	} else {
+		err = render.Bind(r, &data)
+	}
+	if err != nil {
+		render.Render(w, r, status.ErrInvalidRequest(err))
+		return
+	}
+
+	tokenRepo := r.Context().Value(TokenRepoKey).(*usertoken.Repo)
+
+	token, err := tokenRepo.Consume(data.Token, usertoken.PasswordReset)
+	if err == usertoken.ErrInvalidToken {
+		render.Render(w, r, status.ErrUnauthorized(err.Error()))
+		return
+	} else if err != nil {
+		render.Render(w, r, status.ErrInternal(err))
+		return
+	}
+
+	if hashedPassword, err := password.Default.Hash(data.Password); err == nil {
+		data.Password = hashedPassword
+	} else {
+		render.Render(w, r, status.ErrInternal(err))
+		return
+	}
+
+	userRepo := r.Context().Value(UserRepoKey).(*user.Repo)
+	if err = userRepo.Update(token.User_ID, "password", data.Password); err != nil {
+		render.Render(w, r, status.ErrInternal(err))
+		return
+	}
+
+	sessionRepo := r.Context().Value(SessionRepoKey).(*session.Repo)
+	if err = sessionRepo.RevokeAllFor(token.User_ID); err != nil {
+		render.Render(w, r, status.ErrInternal(err))
+		return
+	}
+
+	render.Status(r, http.StatusOK)
+	render.JSON(w, r, map[string]interface{}{"status": "Password has been reset."})
+}
+
 func UserUpdateName(w http.ResponseWriter, r *http.Request) {
 	userID := r.Context().Value(UserKey).(int64)
 	userRepo := r.Context().Value(UserRepoKey).(*user.Repo)
@@ -253,6 +631,12 @@ func UserUpdateName(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	before, err := userRepo.GetByID(userID)
+	if err != nil {
+		render.Render(w, r, status.ErrNotFound)
+		return
+	}
+
 	if err := userRepo.Update(userID, "name", name); err != nil {
 		render.Render(w, r, status.ErrInternal(err))
 		return
@@ -264,6 +648,11 @@ func UserUpdateName(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if claims := r.Context().Value(ClaimsKey).(user.Claims); userID != claims.UserID {
+		recordAudit(r, audit.UserUpdateName, audit.TargetUser, userID,
+			map[string]string{"name": before.Name}, map[string]string{"name": userTemp.Name})
+	}
+
 	render.Status(r, http.StatusOK)
 	render.Render(w, r, user.NewUserPayload(userTemp, roleRepo))
 }
@@ -284,7 +673,11 @@ func UserGetComments(w http.ResponseWriter, r *http.Request) {
 	search.QueryDate(dates[0], dates[1])
 	search.QueryKeyword(r.FormValue("search"))
 	search.QueryUserID(userID)
-	search.Limit(page)
+	hideShadowed(r, search)
+	if !reviewsArticles(r) {
+		search.QueryPublished()
+	}
+	search.Limit(page, r.FormValue("sort"))
 	comments := commentRepo.GetMultiple(search)
 
 	render.RenderList(w, r, comment.NewCommentListPayload(comments, true, nil, nil))
@@ -306,6 +699,7 @@ func UserGetFavArticles(w http.ResponseWriter, r *http.Request) {
 	search.QueryDate(dates[0], dates[1])
 	search.QueryKeyword(r.FormValue("search"))
 	search.QueryFavoriteBy(userID)
+	search.QueryStatus(article.Published)
 	search.Limit(page, r.FormValue("sort"))
 	articles := articleRepo.GetMultiple(search)
 
@@ -331,6 +725,9 @@ func UserGetArticles(w http.ResponseWriter, r *http.Request) {
 	search.QueryDate(dates[0], dates[1])
 	search.QueryKeyword(r.FormValue("search"))
 	search.QueryUserID(userID)
+	if !queryArticleStatus(w, r, search) || !queryArticleTaxonomy(w, r, search) {
+		return
+	}
 	search.Limit(page, r.FormValue("sort"))
 	articles := articleRepo.GetMultiple(search)
 
@@ -380,7 +777,7 @@ func UserGetMultiple(w http.ResponseWriter, r *http.Request) {
 	render.RenderList(w, r, user.NewUserListPayload(users, roleRepo))
 }
 
-func UserLoginPost(tokenAuth *jwtauth.JWTAuth) http.HandlerFunc {
+func UserLoginPost(keys *keyring.Keyring, limits throttle.Limits) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		data := &user.UserPayload{}
 		if err := render.Bind(r, data); err != nil {
@@ -393,96 +790,188 @@ func UserLoginPost(tokenAuth *jwtauth.JWTAuth) http.HandlerFunc {
 			render.Render(w, r, status.ErrInvalidRequest(errors.New("Invalid e-mail.")))
 			return
 		}
-		if !user.PasswordRegex.MatchString(userTemp.Password) {
+		if !password.DefaultPolicy.Plausible(userTemp.Password) {
 			render.Render(w, r, status.ErrInvalidRequest(errors.New("Password requirements does not match.")))
 			return
 		}
 
+		throttleRepo := r.Context().Value(ThrottleRepoKey).(*throttle.Repo)
+		accountKey := throttle.AccountKey(userTemp.Email)
+		ipKey := throttle.IPKey(r.RemoteAddr)
+
+		if wait, err := takeLoginAttempt(throttleRepo, limits, accountKey, ipKey); err != nil {
+			render.Render(w, r, status.ErrInternal(err))
+			return
+		} else if wait > 0 {
+			render.Render(w, r, status.ErrTooManyRequests("Too many failed login attempts.", wait))
+			return
+		}
+
 		repo := r.Context().Value(UserRepoKey).(*user.Repo)
 
 		resultUser, err := repo.GetByEmail(userTemp.Email)
-		if err != nil {
+		if err != nil || resultUser.Password == "" {
+			password.Default.Waste(userTemp.Password)
+			render.Render(w, r, status.ErrUnauthorized("Wrong Credentials."))
+			return
+		}
+
+		ok, rehash := password.Default.Verify(resultUser.Password, userTemp.Password)
+		if !ok {
 			render.Render(w, r, status.ErrUnauthorized("Wrong Credentials."))
 			return
 		}
 
-		err = bcrypt.CompareHashAndPassword([]byte(resultUser.Password), []byte(userTemp.Password))
+		// the hash is from an older scheme or cost, replace it while we have the password.
+		// A password the current hasher can't take keeps its old hash.
+		if rehash {
+			if hashedPassword, err := password.Default.Hash(userTemp.Password); err != nil {
+				log.Println(err)
+			} else if err = repo.Update(resultUser.ID, "password", hashedPassword); err != nil {
+				render.Render(w, r, status.ErrInternal(err))
+				return
+			}
+		}
+
+		if err = throttleRepo.Reset(accountKey); err != nil {
+			render.Render(w, r, status.ErrInternal(err))
+			return
+		}
+		if err = throttleRepo.Refund(ipKey); err != nil {
+			render.Render(w, r, status.ErrInternal(err))
+			return
+		}
+
+		finishLogin(w, r, keys, resultUser, r.FormValue("remember") == "1")
+	}
+}
+
+// UserLoginTOTP finishes a login that UserLoginPost answered with a challenge.
+// A wrong code burns the challenge so guesses need the password every time.
+func UserLoginTOTP(keys *keyring.Keyring, limits throttle.Limits) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var data user.TOTPLogin
+
+		if err := render.Bind(r, &data); err != nil {
+			render.Render(w, r, status.ErrInvalidRequest(err))
+			return
+		}
+
+		tokenRepo := r.Context().Value(TokenRepoKey).(*usertoken.Repo)
+		challenge, err := tokenRepo.Consume(data.Challenge, usertoken.TOTPChallenge)
+		if err == usertoken.ErrInvalidToken {
+			render.Render(w, r, status.ErrUnauthorized(err.Error()))
+			return
+		} else if err != nil {
+			render.Render(w, r, status.ErrInternal(err))
+			return
+		}
+
+		repo := r.Context().Value(UserRepoKey).(*user.Repo)
+		resultUser, err := repo.GetByID(challenge.User_ID)
 		if err != nil {
 			render.Render(w, r, status.ErrUnauthorized("Wrong Credentials."))
 			return
 		}
 
-		roleRepo := r.Context().Value(RoleRepoKey).(*role.Repo)
-		userData := user.NewUserPayload(resultUser, roleRepo)
-		claims := map[string]interface{}{"user_id": userData.ID, "role_id": userData.Role_ID}
+		throttleRepo := r.Context().Value(ThrottleRepoKey).(*throttle.Repo)
+		accountKey := throttle.AccountKey(resultUser.Email)
+		ipKey := throttle.IPKey(r.RemoteAddr)
 
-		var expiration time.Time
+		if wait, err := takeLoginAttempt(throttleRepo, limits, accountKey, ipKey); err != nil {
+			render.Render(w, r, status.ErrInternal(err))
+			return
+		} else if wait > 0 {
+			render.Render(w, r, status.ErrTooManyRequests("Too many failed login attempts.", wait))
+			return
+		}
 
-		if r.FormValue("remember") == "1" {
-			expiration = time.Now().Add(365 * 24 * time.Hour)
-		} else {
-			expiration = time.Now().Add(time.Hour)
+		totpRepo := r.Context().Value(TOTPRepoKey).(*totp.Repo)
+		if ok, err := totpRepo.Verify(challenge.User_ID, data.Code); err != nil {
+			render.Render(w, r, status.ErrInternal(err))
+			return
+		} else if !ok {
+			render.Render(w, r, status.ErrUnauthorized("Wrong code."))
+			return
 		}
 
-		jwtauth.SetExpiry(claims, expiration)
-		_, tokenString, _ := tokenAuth.Encode(claims)
-		userData.Token = tokenString
+		for _, key := range []string{accountKey, ipKey} {
+			if err = throttleRepo.Refund(key); err != nil {
+				render.Render(w, r, status.ErrInternal(err))
+				return
+			}
+		}
 
-		http.SetCookie(w, &http.Cookie{Name: "jwt", Value: tokenString, Expires: expiration, HttpOnly: true})
-		render.Status(r, http.StatusOK)
-		render.Render(w, r, userData)
+		if isSuspended(w, r, resultUser.ID) {
+			return
+		}
+
+		startSession(w, r, keys, resultUser, challenge.Data == "1", true)
 	}
 }
 
-func UserRegisterPost(w http.ResponseWriter, r *http.Request) {
-	data := &user.UserPayload{}
-	if err := render.Bind(r, data); err != nil {
-		render.Render(w, r, status.ErrInvalidRequest(err))
-		return
-	}
-	userTemp := data.User
+func UserRegisterPost(mailer mail.Mailer, publicURL string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		data := &user.UserPayload{}
+		if err := render.Bind(r, data); err != nil {
+			render.Render(w, r, status.ErrInvalidRequest(err))
+			return
+		}
+		userTemp := data.User
 
-	if !user.NameRegex.MatchString(userTemp.Name) {
-		render.Render(w, r, status.ErrInvalidRequest(errors.New("Invalid name.")))
-		return
-	}
-	if !user.EmailRegex.MatchString(userTemp.Email) {
-		render.Render(w, r, status.ErrInvalidRequest(errors.New("Invalid e-mail.")))
-		return
-	}
-	if !user.PasswordRegex.MatchString(userTemp.Password) {
-		render.Render(w, r, status.ErrInvalidRequest(errors.New("Password requirements does not match.")))
-		return
-	}
+		if !user.NameRegex.MatchString(userTemp.Name) {
+			render.Render(w, r, status.ErrInvalidRequest(errors.New("Invalid name.")))
+			return
+		}
+		if !user.EmailRegex.MatchString(userTemp.Email) {
+			render.Render(w, r, status.ErrInvalidRequest(errors.New("Invalid e-mail.")))
+			return
+		}
+		if err := password.DefaultPolicy.Check(userTemp.Password); err != nil {
+			render.Render(w, r, status.ErrInvalidRequest(err))
+			return
+		}
 
-	repo := r.Context().Value(UserRepoKey).(*user.Repo)
+		repo := r.Context().Value(UserRepoKey).(*user.Repo)
 
-	exist, err := repo.DoesEmailExist(userTemp.Email)
-	if err != nil {
-		render.Render(w, r, status.ErrInternal(err))
-		return
-	}
-	if exist {
-		render.Render(w, r, status.ErrConflict("Email already registered."))
-		return
-	}
+		exist, err := repo.DoesEmailExist(userTemp.Email)
+		if err != nil {
+			render.Render(w, r, status.ErrInternal(err))
+			return
+		}
+		if exist {
+			render.Render(w, r, status.ErrConflict("Email already registered."))
+			return
+		}
 
-	if hashedPassword, err := bcrypt.GenerateFromPassword([]byte(userTemp.Password), bcrypt.DefaultCost); err == nil {
-		userTemp.Password = string(hashedPassword)
-	} else {
-		render.Render(w, r, status.ErrInternal(err))
-		return
-	}
+		if hashedPassword, err := password.Default.Hash(userTemp.Password); err == nil {
+			userTemp.Password = hashedPassword
+		} else {
+			render.Render(w, r, status.ErrInternal(err))
+			return
+		}
 
-	if id, err := repo.Add(userTemp); err == nil {
-		data.User.ID = id
-		data.User.Role_ID = 1
-	} else {
-		render.Render(w, r, status.ErrInternal(err))
-		return
-	}
+		roleRepo := r.Context().Value(RoleRepoKey).(*role.Repo)
+		defaultRole, err := roleRepo.GetDefault()
+		if err != nil {
+			render.Render(w, r, status.ErrInternal(err))
+			return
+		}
+		userTemp.Role_ID = defaultRole.ID
 
-	roleRepo := r.Context().Value(RoleRepoKey).(*role.Repo)
-	render.Status(r, http.StatusCreated)
-	render.Render(w, r, user.NewUserPayload(data.User, roleRepo))
+		if id, err := repo.Add(userTemp); err == nil {
+			data.User.ID = id
+		} else {
+			render.Render(w, r, status.ErrInternal(err))
+			return
+		}
+
+		tokenRepo := r.Context().Value(TokenRepoKey).(*usertoken.Repo)
+		if err := sendEmailVerification(mailer, publicURL, tokenRepo, data.User.ID, data.User.Email); err != nil {
+			log.Println(err)
+		}
+
+		render.Status(r, http.StatusCreated)
+		render.Render(w, r, user.NewUserPayload(data.User, roleRepo))
+	}
 }
@@ -2,41 +2,121 @@ package main
 
 import (
 	"database/sql"
+	"fmt"
 	"go-blog/httpd/handler"
+	"go-blog/platform/apikey"
+	"go-blog/platform/article"
+	"go-blog/platform/audit"
+	"go-blog/platform/keyring"
+	"go-blog/platform/mail"
+	"go-blog/platform/oidc"
+	"go-blog/platform/password"
+	"go-blog/platform/role"
+	"go-blog/platform/throttle"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/go-chi/chi"
 	"github.com/go-chi/chi/middleware"
-	"github.com/go-chi/jwtauth"
 	_ "github.com/mattn/go-sqlite3"
+	"golang.org/x/crypto/bcrypt"
 )
 
 const (
-	port        = ":3000"
-	dbName      = "./blog.db"
-	tokenSecret = "my_secret"
-	servePath   = "static"
+	port      = ":3000"
+	dbName    = "./blog.db"
+	keysDir   = "./keys"
+	servePath = "static"
+	mailLog   = "./mail.log"
+	oidcFile  = "./oidc.json"
+	// extra passwords to refuse, one per line, like a breached password list.
+	commonPasswordsFile = "./common-passwords.txt"
+
+	defaultAuditRetentionDays = 365
 )
 
+// Failed login limits per account and per client address.
+var loginLimits = throttle.Limits{
+	Account: throttle.Policy{
+		FreeAttempts:     3,
+		BaseDelay:        time.Second,
+		MaxDelay:         5 * time.Minute,
+		LockoutThreshold: 10,
+		LockoutDuration:  15 * time.Minute,
+		Window:           time.Hour,
+	},
+	IP: throttle.Policy{
+		FreeAttempts:     20,
+		BaseDelay:        time.Second,
+		MaxDelay:         time.Minute,
+		LockoutThreshold: 100,
+		LockoutDuration:  time.Hour,
+		Window:           15 * time.Minute,
+	},
+}
+
+// Provider logins started per client address, each leaves a state behind
+// until it expires.
+var oidcStartLimit = throttle.Policy{
+	FreeAttempts:     30,
+	BaseDelay:        time.Second,
+	MaxDelay:         time.Minute,
+	LockoutThreshold: 300,
+	LockoutDuration:  time.Hour,
+	Window:           handler.OIDCStateLifetime,
+}
+
 func main() {
 	//Setup db
 	db := setupDB(dbName)
 	defer db.Close()
 
-	//Create jwt authorization token
-	tokenAuth := jwtauth.New("HS256", []byte(tokenSecret), nil)
+	//Setup the address links in mails and provider redirects point to
+	publicURL := setupPublicURL()
+
+	//Setup mail delivery
+	mailer := setupMailer()
+
+	//Drop audit entries older than AUDIT_RETENTION_DAYS, once a day
+	auditRetention := setupAuditRetention()
+	guardAudit(db, auditRetention)
+	go purgeAudit(audit.NewRepo(db), auditRetention)
+	go publishScheduled(article.NewRepo(db))
+
+	//Setup how passwords are hashed and which ones are refused
+	setupPasswords()
+
+	//Setup where tokens are looked up and how cookies are set
+	handler.Cookies = setupCookies(publicURL)
+
+	//Setup which proxies are trusted to tell the client address
+	proxies := setupProxies()
+
+	//Load jwt signing keys, JWT_SIGNING_KID picks the one to sign with
+	keys, err := keyring.Load(keysDir, os.Getenv("JWT_SIGNING_KID"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	//Load the OpenID Connect providers users can log in with
+	providers, err := oidc.LoadProviders(oidcFile)
+	if err != nil {
+		log.Fatal(err)
+	}
 
 	//Create a router
 	r := chi.NewRouter()
 
 	//Good base middleware stack
 	r.Use(middleware.RequestID)
-	r.Use(middleware.RealIP)
+	r.Use(handler.RealIP(proxies))
 	r.Use(middleware.Logger)
 	r.Use(middleware.Recoverer)
 	r.Use(middleware.Timeout(60 * time.Second))
@@ -45,6 +125,8 @@ func main() {
 		w.Write([]byte("TODO-Index-Page"))
 	})
 
+	r.Get("/.well-known/jwks.json", handler.JWKS(keys))
+
 	r.NotFound(func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(404)
 		w.Write([]byte("Your page is in another castle."))
@@ -53,27 +135,57 @@ func main() {
 	r.Group(func(r chi.Router) {
 		r.Use(handler.ProvideUserRepo(db))
 		r.Use(handler.ProvideRoleRepo(db))
+		r.Use(handler.ProvideSessionRepo(db))
+		r.Use(handler.ProvideTokenRepo(db))
+		r.Use(handler.ProvideTOTPRepo(db))
+		r.Use(handler.ProvideThrottleRepo(db))
+		r.Use(handler.ProvideOIDCRepo(db))
 		r.Route("/login", func(r chi.Router) {
 			r.Get("/", func(w http.ResponseWriter, r *http.Request) {
 				w.Write([]byte("TODO-Login-Page"))
 			})
-			r.Post("/", handler.UserLoginPost(tokenAuth))
+			r.Post("/", handler.UserLoginPost(keys, loginLimits))
+			r.Post("/totp", handler.UserLoginTOTP(keys, loginLimits))
+			r.Get("/oidc", handler.OIDCProviders(providers))
+			r.Get("/oidc/{provider}", handler.OIDCLogin(providers, publicURL, oidcStartLimit))
+			r.Get("/oidc/{provider}/callback", handler.OIDCCallback(keys, providers, publicURL))
 		})
 
 		r.Route("/register", func(r chi.Router) {
 			r.Get("/", func(w http.ResponseWriter, r *http.Request) {
 				w.Write([]byte("TODO-Register-Page"))
 			})
-			r.Post("/", handler.UserRegisterPost)
+			r.Post("/", handler.UserRegisterPost(mailer, publicURL))
 		})
+
+		r.Get("/email/confirm", handler.UserConfirmEmail)
+		r.Post("/email/confirm", handler.UserConfirmEmail)
+
+		r.Route("/password", func(r chi.Router) {
+			r.Post("/forgot", handler.UserForgotPassword(mailer, publicURL))
+			r.Get("/reset", handler.UserResetPasswordPage)
+			r.Post("/reset", handler.UserResetPassword)
+		})
+
+		r.With(handler.Verifier(keys), handler.CSRFProtect, handler.AuthenticatorNoPass).Post("/logout", handler.UserLogout)
+		r.Post("/token/refresh", handler.TokenRefresh(keys))
 	})
 
 	r.Route("/api", func(r chi.Router) {
 		r.Use(handler.ProvideArticleRepo(db))
 		r.Use(handler.ProvideUserRepo(db))
 		r.Use(handler.ProvideRoleRepo(db))
-
-		r.Use(jwtauth.Verifier(tokenAuth)) // inits auth but does not check yet
+		r.Use(handler.ProvideSessionRepo(db))
+		r.Use(handler.ProvideTokenRepo(db))
+		r.Use(handler.ProvideTOTPRepo(db))
+		r.Use(handler.ProvideAPIKeyRepo(db))
+		r.Use(handler.ProvideAuditRepo(db))
+		r.Use(handler.ProvideTagRepo(db))
+		r.Use(handler.ProvideCategoryRepo(db))
+
+		r.Use(handler.Verifier(keys)) // inits auth but does not check yet
+		r.Use(handler.APIKeyVerifier)
+		r.Use(handler.CSRFProtect)
 
 		r.Route("/users", func(r chi.Router) {
 			r.With(handler.Paginate, handler.ParseDate).Get("/", handler.UserGetMultiple)
@@ -81,21 +193,61 @@ func main() {
 			r.Route("/{userID}", func(r chi.Router) {
 				r.Get("/", handler.UserGetByID)
 				r.With(handler.Paginate, handler.ParseDate, handler.AuthenticatorPass).Get("/articles", handler.UserGetArticles)
-				r.With(handler.Paginate, handler.ParseDate, handler.ProvideCommentRepo(db)).Get("/comments", handler.UserGetComments)
+				r.With(handler.Paginate, handler.ParseDate, handler.ProvideCommentRepo(db), handler.AuthenticatorPass).Get("/comments", handler.UserGetComments)
 				r.With(handler.Paginate, handler.ParseDate, handler.AuthenticatorPass).Get("/favorites", handler.UserGetFavArticles)
 				r.With(handler.AuthenticatorNoPass).Put("/role", handler.AssignRole)
+				r.With(handler.AuthenticatorNoPass).Get("/role/history", handler.RoleAssignments)
+				r.With(handler.AuthenticatorNoPass, handler.ProvideThrottleRepo(db)).Delete("/lockout", handler.UserUnlock)
+				r.With(handler.AuthenticatorNoPass).Get("/suspension", handler.UserSuspensionGet)
+				r.With(handler.AuthenticatorNoPass).Put("/suspension", handler.UserSuspend)
+				r.With(handler.AuthenticatorNoPass).Delete("/suspension", handler.UserUnsuspend)
 
 				r.Group(func(r chi.Router) {
 					r.Use(handler.AuthenticatorNoPass, handler.UserSelfID)
 					r.Put("/name", handler.UserUpdateName)
-					r.Put("/password", handler.UserUpdatePassword)
-					r.Put("/email", handler.UserUpdateEmail)
 					r.Post("/image", handler.UserUpdateImage)
-					r.Delete("/", handler.UserDelete)
+
+					r.Group(func(r chi.Router) {
+						r.Use(handler.NoAPIKey)
+						r.Put("/password", handler.UserUpdatePassword)
+						r.Put("/email", handler.UserUpdateEmail(mailer, publicURL))
+						r.Post("/email/verify", handler.UserResendVerification(mailer, publicURL))
+						r.Post("/totp", handler.TOTPEnroll)
+						r.Post("/totp/confirm", handler.TOTPConfirm)
+						r.Post("/totp/recovery", handler.TOTPRecoveryCodes)
+						r.Delete("/totp", handler.TOTPDisable)
+						r.Delete("/", handler.UserDelete)
+
+						r.Get("/keys", handler.APIKeyGetAll)
+						r.Post("/keys", handler.APIKeyPost)
+						r.Delete("/keys/{keyID}", handler.APIKeyDelete)
+
+						r.Get("/sessions", handler.SessionGetAll)
+						r.Delete("/sessions", handler.SessionDeleteOthers)
+						r.Delete("/sessions/{sessionID}", handler.SessionDelete)
+					})
 				})
 			})
 		})
 
+		r.Get("/permissions", handler.PermissionGetAll)
+
+		r.With(handler.Paginate, handler.ParseDate, handler.AuthenticatorNoPass).Get("/audit", handler.AuditGetMultiple)
+
+		r.Route("/tags", func(r chi.Router) {
+			r.With(handler.Paginate, handler.AuthenticatorPass).Get("/", handler.TagGetAll)
+			r.With(handler.AuthenticatorNoPass).Put("/{tagName}", handler.TagRename)
+			r.With(handler.AuthenticatorNoPass).Delete("/{tagName}", handler.TagDelete)
+			r.With(handler.AuthenticatorNoPass).Post("/{tagName}/merge", handler.TagMerge)
+		})
+
+		r.Route("/categories", func(r chi.Router) {
+			r.Get("/", handler.CategoryGetAll)
+			r.With(handler.AuthenticatorNoPass).Post("/", handler.CategoryPost)
+			r.With(handler.AuthenticatorNoPass).Put("/{categoryID}", handler.CategoryUpdate)
+			r.With(handler.AuthenticatorNoPass).Delete("/{categoryID}", handler.CategoryDelete)
+		})
+
 		r.Route("/roles", func(r chi.Router) {
 			r.Get("/", handler.RoleGetAll)
 
@@ -106,6 +258,7 @@ func main() {
 				r.Get("/", handler.RoleGetByID)
 				r.With(handler.AuthenticatorNoPass).Put("/", handler.RoleUpdate)
 				r.With(handler.AuthenticatorNoPass).Delete("/", handler.RoleDelete)
+				r.With(handler.AuthenticatorNoPass).Put("/default", handler.RoleSetDefault)
 			})
 		})
 
@@ -114,14 +267,16 @@ func main() {
 
 			r.Route("/id/{commentID}", func(r chi.Router) {
 				r.Use(handler.CommentIDContext)
-				r.Get("/", handler.CommentGetByID)
+				r.With(handler.AuthenticatorPass).Get("/", handler.CommentGetByID)
 				r.With(handler.AuthenticatorNoPass).Put("/", handler.CommentUpdate)
 				r.With(handler.AuthenticatorNoPass).Delete("/", handler.CommentDelete)
+				r.With(handler.AuthenticatorPass).Get("/replies", handler.CommentRepliesGet)
+				r.With(handler.AuthenticatorNoPass).Post("/replies", handler.CommentReply)
 			})
 
 			r.Route("/{articleID}", func(r chi.Router) {
 				r.Use(handler.ArticleIDContext)
-				r.With(handler.Paginate, handler.ParseDate).Get("/", handler.CommentsGet)
+				r.With(handler.Paginate, handler.ParseDate, handler.AuthenticatorPass).Get("/", handler.CommentsGet)
 				r.With(handler.AuthenticatorNoPass).Post("/", handler.CommentPost)
 			})
 		})
@@ -136,6 +291,22 @@ func main() {
 				r.With(handler.AuthenticatorNoPass).Put("/", handler.ArticleUpdate)
 				r.With(handler.AuthenticatorNoPass).Delete("/", handler.ArticleDelete)
 				r.With(handler.AuthenticatorNoPass).Post("/", handler.ArticleToggleFavorite)
+				r.With(handler.AuthenticatorNoPass).Put("/status", handler.ArticleSetStatus)
+
+				r.Route("/collaborators", func(r chi.Router) {
+					r.Use(handler.AuthenticatorNoPass)
+					r.Get("/", handler.CollaboratorGetAll)
+					r.Put("/{userID}", handler.CollaboratorPut)
+					r.Delete("/{userID}", handler.CollaboratorDelete)
+				})
+
+				r.Route("/revisions", func(r chi.Router) {
+					r.Use(handler.AuthenticatorNoPass)
+					r.Get("/", handler.RevisionGetAll)
+					r.Get("/{revisionID}", handler.RevisionGetByID)
+					r.Get("/{revisionID}/diff", handler.RevisionDiff)
+					r.Post("/{revisionID}/restore", handler.RevisionRestore)
+				})
 
 			})
 		})
@@ -169,11 +340,207 @@ func FileServer(r chi.Router, path string) {
 	})
 }
 
+// setupPublicURL reads PUBLIC_URL, where users reach the server, like
+// https://blog.example.com. Links in mails and provider redirects are made
+// from it, so it has to be set.
+func setupPublicURL() string {
+	value := os.Getenv("PUBLIC_URL")
+	if value == "" {
+		log.Fatal("PUBLIC_URL is not set, it is where users reach the server, like http://localhost" + port)
+	}
+
+	publicURL, err := url.Parse(value)
+	if err != nil || (publicURL.Scheme != "http" && publicURL.Scheme != "https") || publicURL.Host == "" ||
+		publicURL.User != nil || publicURL.RawQuery != "" || publicURL.Fragment != "" {
+		log.Fatal("PUBLIC_URL must be an http or https address without a query, like https://blog.example.com")
+	}
+
+	return strings.TrimSuffix(publicURL.String(), "/")
+}
+
+// setupMailer sends mail over SMTP when SMTP_HOST is set,
+// otherwise messages are written to mailLog.
+func setupMailer() mail.Mailer {
+	host := os.Getenv("SMTP_HOST")
+	if host == "" {
+		log.Println("SMTP_HOST is not set, writing mails to " + mailLog)
+		return mail.NewFileMailer(mailLog)
+	}
+
+	port, err := strconv.Atoi(os.Getenv("SMTP_PORT"))
+	if err != nil {
+		port = 587
+	}
+
+	return mail.NewSMTPMailer(host, port, os.Getenv("SMTP_USER"), os.Getenv("SMTP_PASSWORD"), os.Getenv("SMTP_FROM"))
+}
+
+// setupPasswords reads PASSWORD_HASHER (argon2id or bcrypt) and the cost
+// settings ARGON2_TIME, ARGON2_MEMORY (KiB), ARGON2_THREADS and BCRYPT_COST.
+// Hashes of the other scheme or with other costs are replaced on login.
+func setupPasswords() {
+	argon := *password.DefaultArgon2id
+	argon.Time = uint32(envInt("ARGON2_TIME", int(argon.Time), 1, 100))
+	argon.Memory = uint32(envInt("ARGON2_MEMORY", int(argon.Memory), 8*1024, 4*1024*1024))
+	argon.Threads = uint8(envInt("ARGON2_THREADS", int(argon.Threads), 1, 255))
+
+	bcryptHasher := &password.Bcrypt{Cost: envInt("BCRYPT_COST", password.DefaultBcrypt.Cost, bcrypt.MinCost, bcrypt.MaxCost)}
+
+	switch os.Getenv("PASSWORD_HASHER") {
+	case "", "argon2id":
+		password.Default = &password.Hashers{Current: &argon, Others: []password.Hasher{bcryptHasher}}
+	case "bcrypt":
+		password.Default = &password.Hashers{Current: bcryptHasher, Others: []password.Hasher{&argon}}
+	default:
+		log.Fatal("PASSWORD_HASHER must be argon2id or bcrypt")
+	}
+	// new passwords have to fit the hasher, bcrypt would cut them short.
+	password.DefaultPolicy.MaxBytes = password.Default.MaxBytes()
+
+	if err := password.DefaultPolicy.LoadCommon(commonPasswordsFile); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// envInt reads a number setting, falling back to def when it isn't set.
+func envInt(name string, def int, min int, max int) int {
+	value := os.Getenv(name)
+	if value == "" {
+		return def
+	}
+
+	number, err := strconv.Atoi(value)
+	if err != nil || number < min || number > max {
+		log.Fatalf("%s must be a number between %d and %d", name, min, max)
+	}
+
+	return number
+}
+
+// setupCookies reads TOKEN_LOOKUP (header, cookie or both), COOKIE_SAMESITE
+// (lax, strict or none) and COOKIE_SECURE, which is on by default for https.
+func setupCookies(publicURL string) handler.CookieConfig {
+	lookup, err := handler.ParseTokenLookup(os.Getenv("TOKEN_LOOKUP"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	sameSite, err := handler.ParseSameSite(os.Getenv("COOKIE_SAMESITE"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	secure := strings.HasPrefix(publicURL, "https://")
+	if value := os.Getenv("COOKIE_SECURE"); value != "" {
+		if secure, err = strconv.ParseBool(value); err != nil {
+			log.Fatal("COOKIE_SECURE: ", err)
+		}
+	}
+
+	if sameSite == http.SameSiteNoneMode && !secure {
+		log.Fatal("COOKIE_SAMESITE=none needs secure cookies")
+	}
+
+	return handler.CookieConfig{Lookup: lookup, SameSite: sameSite, Secure: secure}
+}
+
+// setupProxies reads TRUSTED_PROXIES, the comma separated addresses or CIDR
+// ranges of the reverse proxies in front of the server. Only their
+// X-Forwarded-For is believed, when it isn't set every client is known by
+// the address it connects from.
+func setupProxies() []*net.IPNet {
+	proxies, err := handler.ParseTrustedProxies(os.Getenv("TRUSTED_PROXIES"))
+	if err != nil {
+		log.Fatal("TRUSTED_PROXIES: ", err)
+	}
+
+	return proxies
+}
+
+// setupAuditRetention reads AUDIT_RETENTION_DAYS, 0 keeps the audit log forever.
+func setupAuditRetention() time.Duration {
+	days := defaultAuditRetentionDays
+	if value := os.Getenv("AUDIT_RETENTION_DAYS"); value != "" {
+		var err error
+		if days, err = strconv.Atoi(value); err != nil || days < 0 {
+			log.Fatal("AUDIT_RETENTION_DAYS must be a number of days")
+		}
+	}
+
+	return time.Duration(days) * 24 * time.Hour
+}
+
+// guardAudit makes the audit log refuse deletes of entries younger than the
+// retention, so only purgeAudit can remove any. It is made again on every
+// start since the retention comes from the environment.
+func guardAudit(db *sql.DB, retention time.Duration) {
+	when := ""
+	if retention > 0 {
+		when = fmt.Sprintf(`WHEN OLD.created_at >= CAST(strftime('%%s', 'now') AS INTEGER) - %d`, int64(retention/time.Second))
+	}
+
+	_, err := db.Exec(`DROP TRIGGER IF EXISTS "audit_log_retention";
+	CREATE TRIGGER "audit_log_retention" BEFORE DELETE ON "audit_log" ` + when + `
+	BEGIN
+		SELECT RAISE(ABORT, 'audit_log entries are only removed after the retention');
+	END;`)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func purgeAudit(repo *audit.Repo, retention time.Duration) {
+	if retention == 0 {
+		return
+	}
+
+	ticker := time.NewTicker(24 * time.Hour)
+	defer ticker.Stop()
+
+	for {
+		if purged, err := repo.Purge(time.Now().Add(-retention).Unix()); err == nil && purged > 0 {
+			log.Printf("Purged %d audit entries", purged)
+		}
+		<-ticker.C
+	}
+}
+
+// publishScheduled publishes scheduled articles as they come due. Schedules
+// live in the database, so the ones missed while stopped go out on start.
+func publishScheduled(repo *article.Repo) {
+	for {
+		if published, err := repo.PublishDue(time.Now().Unix()); err == nil && published > 0 {
+			log.Printf("Published %d scheduled articles", published)
+		}
+
+		// Articles scheduled meanwhile are picked up within a minute, they
+		// are listed as published once due anyway.
+		wait := time.Minute
+		if next := repo.NextScheduled(); next > 0 {
+			if untilNext := time.Until(time.Unix(next, 0)); untilNext < wait {
+				wait = untilNext
+			}
+		}
+		if wait < time.Second {
+			wait = time.Second
+		}
+		time.Sleep(wait)
+	}
+}
+
 func setupDB(filename string) *sql.DB {
 	db, err := sql.Open("sqlite3", filename)
 	if err != nil {
 		log.Fatal(err)
 	}
+
+	// audit.read, article.publish and tag.manage came after the seeds, Admin
+	// is only granted them once, when their feature first shows up.
+	newAuditLog := !hasTable(db, "audit_log")
+	newPublishing := !hasColumn(db, "articles", "status")
+	newRevisions := !hasTable(db, "article_revisions")
+	newTags := !hasTable(db, "tags")
+
 	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS "users" (
 		"id"	INTEGER NOT NULL UNIQUE,
 		"role_id"	INTEGER NOT NULL DEFAULT 1,
@@ -182,12 +549,17 @@ func setupDB(filename string) *sql.DB {
 		"email" TEXT NOT NULL,
 		"image"	TEXT NOT NULL DEFAULT "/static/profile-pics/user.png",
 		"created_at"	INTEGER NOT NULL,
+		"verified"	INTEGER NOT NULL DEFAULT 0,
 		PRIMARY KEY("id" AUTOINCREMENT)
 	);
 	CREATE TABLE IF NOT EXISTS "roles" (
 		"id"	INTEGER NOT NULL UNIQUE,
 		"name"	TEXT NOT NULL,
 		"code"	INTEGER NOT NULL DEFAULT 1,
+		"require_verified"	INTEGER NOT NULL DEFAULT 0,
+		"require_totp"	INTEGER NOT NULL DEFAULT 0,
+		"protected"	INTEGER NOT NULL DEFAULT 0,
+		"is_default"	INTEGER NOT NULL DEFAULT 0,
 		PRIMARY KEY("id" AUTOINCREMENT)
 	);
 	CREATE TABLE IF NOT EXISTS "articles" (
@@ -197,6 +569,12 @@ func setupDB(filename string) *sql.DB {
 		"body"	TEXT NOT NULL,
 		"created_at"	INTEGER NOT NULL,
 		"updated_at"	INTEGER NOT NULL,
+		"status"	TEXT NOT NULL DEFAULT 'published',
+		"publish_at"	INTEGER NOT NULL DEFAULT 0,
+		"format"	TEXT NOT NULL DEFAULT 'plain',
+		"body_html"	TEXT NOT NULL DEFAULT '',
+		"category_id"	INTEGER NOT NULL DEFAULT 0,
+		"slug"	TEXT NOT NULL DEFAULT '',
 		PRIMARY KEY("ID" AUTOINCREMENT)
 	);
 	CREATE TABLE IF NOT EXISTS "comments" (
@@ -206,6 +584,9 @@ func setupDB(filename string) *sql.DB {
 		"body"	TEXT,
 		"created_at"	INTEGER NOT NULL,
 		"updated_at"	INTEGER NOT NULL,
+		"shadowed"	INTEGER NOT NULL DEFAULT 0,
+		"parent_id"	INTEGER NOT NULL DEFAULT 0,
+		"deleted"	INTEGER NOT NULL DEFAULT 0,
 		PRIMARY KEY("id" AUTOINCREMENT)
 	);
 	CREATE TABLE IF NOT EXISTS "favorites" (
@@ -214,13 +595,365 @@ func setupDB(filename string) *sql.DB {
 		"article_id"	INTEGER,
 		PRIMARY KEY("id" AUTOINCREMENT)
 	);
-	REPLACE INTO roles (id, name) values (1, "Guest");
-	REPLACE INTO roles (id, name) values (2, "Author");
-	REPLACE INTO roles (id, name, code) values (3, "Admin", 127);`)
+	CREATE TABLE IF NOT EXISTS "sessions" (
+		"id"	INTEGER NOT NULL UNIQUE,
+		"user_id"	INTEGER NOT NULL,
+		"created_at"	INTEGER NOT NULL,
+		"expires_at"	INTEGER NOT NULL,
+		"revoked"	INTEGER NOT NULL DEFAULT 0,
+		"mfa"	INTEGER NOT NULL DEFAULT 0,
+		"user_agent"	TEXT NOT NULL DEFAULT '',
+		"ip"	TEXT NOT NULL DEFAULT '',
+		"last_seen_at"	INTEGER NOT NULL DEFAULT 0,
+		PRIMARY KEY("id" AUTOINCREMENT)
+	);
+	CREATE TABLE IF NOT EXISTS "refresh_tokens" (
+		"id"	INTEGER NOT NULL UNIQUE,
+		"session_id"	INTEGER NOT NULL,
+		"token_hash"	TEXT NOT NULL UNIQUE,
+		"used"	INTEGER NOT NULL DEFAULT 0,
+		"created_at"	INTEGER NOT NULL,
+		PRIMARY KEY("id" AUTOINCREMENT)
+	);
+	CREATE TABLE IF NOT EXISTS "user_tokens" (
+		"id"	INTEGER NOT NULL UNIQUE,
+		"user_id"	INTEGER NOT NULL,
+		"kind"	TEXT NOT NULL,
+		"token_hash"	TEXT NOT NULL UNIQUE,
+		"data"	TEXT NOT NULL DEFAULT "",
+		"expires_at"	INTEGER NOT NULL,
+		PRIMARY KEY("id" AUTOINCREMENT)
+	);
+	CREATE TABLE IF NOT EXISTS "user_totp" (
+		"user_id"	INTEGER NOT NULL UNIQUE,
+		"secret"	TEXT NOT NULL,
+		"enabled"	INTEGER NOT NULL DEFAULT 0,
+		"last_step"	INTEGER NOT NULL DEFAULT 0,
+		"created_at"	INTEGER NOT NULL,
+		PRIMARY KEY("user_id")
+	);
+	CREATE TABLE IF NOT EXISTS "recovery_codes" (
+		"id"	INTEGER NOT NULL UNIQUE,
+		"user_id"	INTEGER NOT NULL,
+		"code_hash"	TEXT NOT NULL,
+		PRIMARY KEY("id" AUTOINCREMENT)
+	);
+	CREATE TABLE IF NOT EXISTS "api_keys" (
+		"id"	INTEGER NOT NULL UNIQUE,
+		"user_id"	INTEGER NOT NULL,
+		"name"	TEXT NOT NULL,
+		"key_hash"	TEXT NOT NULL UNIQUE,
+		"key_prefix"	TEXT NOT NULL,
+		"scopes"	TEXT,
+		"expires_at"	INTEGER NOT NULL DEFAULT 0,
+		"last_used_at"	INTEGER NOT NULL DEFAULT 0,
+		"created_at"	INTEGER NOT NULL,
+		PRIMARY KEY("id" AUTOINCREMENT)
+	);
+	CREATE TABLE IF NOT EXISTS "login_attempts" (
+		"key"	TEXT NOT NULL UNIQUE,
+		"failures"	INTEGER NOT NULL DEFAULT 0,
+		"last_failure_at"	INTEGER NOT NULL,
+		PRIMARY KEY("key")
+	);
+	CREATE TABLE IF NOT EXISTS "role_permissions" (
+		"role_id"	INTEGER NOT NULL,
+		"permission"	TEXT NOT NULL,
+		PRIMARY KEY("role_id", "permission")
+	);
+	CREATE TABLE IF NOT EXISTS "role_assignments" (
+		"id"	INTEGER NOT NULL UNIQUE,
+		"user_id"	INTEGER NOT NULL,
+		"actor_id"	INTEGER NOT NULL,
+		"old_role_id"	INTEGER NOT NULL,
+		"new_role_id"	INTEGER NOT NULL,
+		"created_at"	INTEGER NOT NULL,
+		PRIMARY KEY("id" AUTOINCREMENT)
+	);
+	CREATE TABLE IF NOT EXISTS "oidc_states" (
+		"state_hash"	TEXT NOT NULL UNIQUE,
+		"provider"	TEXT NOT NULL,
+		"nonce"	TEXT NOT NULL,
+		"verifier"	TEXT NOT NULL,
+		"remember"	INTEGER NOT NULL DEFAULT 0,
+		"expires_at"	INTEGER NOT NULL,
+		PRIMARY KEY("state_hash")
+	);
+	CREATE TABLE IF NOT EXISTS "user_identities" (
+		"id"	INTEGER NOT NULL UNIQUE,
+		"user_id"	INTEGER NOT NULL,
+		"provider"	TEXT NOT NULL,
+		"subject"	TEXT NOT NULL,
+		"created_at"	INTEGER NOT NULL,
+		UNIQUE("provider", "subject"),
+		PRIMARY KEY("id" AUTOINCREMENT)
+	);
+	CREATE TABLE IF NOT EXISTS "audit_log" (
+		"id"	INTEGER NOT NULL UNIQUE,
+		"actor_id"	INTEGER NOT NULL,
+		"action"	TEXT NOT NULL,
+		"target_type"	TEXT NOT NULL,
+		"target_id"	INTEGER NOT NULL,
+		"before"	TEXT,
+		"after"	TEXT,
+		"request_id"	TEXT NOT NULL DEFAULT '',
+		"created_at"	INTEGER NOT NULL,
+		PRIMARY KEY("id" AUTOINCREMENT)
+	);
+	CREATE INDEX IF NOT EXISTS "audit_log_created_at" ON "audit_log" ("created_at");
+	CREATE TRIGGER IF NOT EXISTS "audit_log_append_only" BEFORE UPDATE ON "audit_log"
+	BEGIN
+		SELECT RAISE(ABORT, 'audit_log is append-only');
+	END;
+	CREATE TABLE IF NOT EXISTS "user_suspensions" (
+		"user_id"	INTEGER NOT NULL UNIQUE,
+		"actor_id"	INTEGER NOT NULL,
+		"mode"	TEXT NOT NULL,
+		"reason"	TEXT NOT NULL,
+		"expires_at"	INTEGER NOT NULL DEFAULT 0,
+		"created_at"	INTEGER NOT NULL,
+		PRIMARY KEY("user_id")
+	);
+	CREATE TABLE IF NOT EXISTS "article_collaborators" (
+		"article_id"	INTEGER NOT NULL,
+		"user_id"	INTEGER NOT NULL,
+		"role"	TEXT NOT NULL,
+		"created_at"	INTEGER NOT NULL,
+		PRIMARY KEY("article_id", "user_id")
+	);
+	CREATE TABLE IF NOT EXISTS "article_revisions" (
+		"id"	INTEGER NOT NULL UNIQUE,
+		"article_id"	INTEGER NOT NULL,
+		"user_id"	INTEGER NOT NULL,
+		"title"	TEXT NOT NULL,
+		"body"	TEXT NOT NULL,
+		"created_at"	INTEGER NOT NULL,
+		"format"	TEXT NOT NULL DEFAULT 'plain',
+		PRIMARY KEY("id" AUTOINCREMENT)
+	);
+	CREATE INDEX IF NOT EXISTS "article_revisions_article_id" ON "article_revisions" ("article_id");
+	CREATE TABLE IF NOT EXISTS "article_slugs" (
+		"slug"	TEXT NOT NULL,
+		"article_id"	INTEGER NOT NULL,
+		"created_at"	INTEGER NOT NULL,
+		PRIMARY KEY("slug")
+	);
+	CREATE TABLE IF NOT EXISTS "tags" (
+		"id"	INTEGER NOT NULL UNIQUE,
+		"name"	TEXT NOT NULL UNIQUE,
+		PRIMARY KEY("id" AUTOINCREMENT)
+	);
+	CREATE TABLE IF NOT EXISTS "article_tags" (
+		"article_id"	INTEGER NOT NULL,
+		"tag_id"	INTEGER NOT NULL,
+		PRIMARY KEY("article_id", "tag_id")
+	);
+	CREATE INDEX IF NOT EXISTS "article_tags_tag_id" ON "article_tags" ("tag_id");
+	CREATE TABLE IF NOT EXISTS "categories" (
+		"id"	INTEGER NOT NULL UNIQUE,
+		"name"	TEXT NOT NULL,
+		"parent_id"	INTEGER NOT NULL DEFAULT 0,
+		"created_at"	INTEGER NOT NULL,
+		PRIMARY KEY("id" AUTOINCREMENT)
+	);
+	`)
 
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	// Users registered before email verification existed are trusted.
+	if addColumn(db, "users", "verified", "INTEGER NOT NULL DEFAULT 0") {
+		_, err = db.Exec(`UPDATE users SET verified = 1`)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	addColumn(db, "roles", "require_verified", "INTEGER NOT NULL DEFAULT 0")
+	addColumn(db, "roles", "require_totp", "INTEGER NOT NULL DEFAULT 0")
+	addColumn(db, "sessions", "mfa", "INTEGER NOT NULL DEFAULT 0")
+	addColumn(db, "comments", "shadowed", "INTEGER NOT NULL DEFAULT 0")
+	addColumn(db, "comments", "parent_id", "INTEGER NOT NULL DEFAULT 0")
+	addColumn(db, "comments", "deleted", "INTEGER NOT NULL DEFAULT 0")
+	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS "comments_parent_id" ON "comments" ("parent_id")`)
+	if err != nil {
+		log.Fatal(err)
+	}
+	addColumn(db, "articles", "status", "TEXT NOT NULL DEFAULT 'published'") // what was there stays public.
+	if addColumn(db, "articles", "publish_at", "INTEGER NOT NULL DEFAULT 0") {
+		_, err = db.Exec(`UPDATE articles SET publish_at = created_at WHERE status IN ('published', 'archived')`)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	// Bodies written before formats were declared are shown as they are.
+	addColumn(db, "article_revisions", "format", "TEXT NOT NULL DEFAULT 'plain'")
+	addColumn(db, "articles", "format", "TEXT NOT NULL DEFAULT 'plain'")
+	if addColumn(db, "articles", "body_html", "TEXT NOT NULL DEFAULT ''") {
+		if err = article.NewRepo(db).Rerender(); err != nil {
+			log.Fatal(err)
+		}
+	}
+	addColumn(db, "articles", "category_id", "INTEGER NOT NULL DEFAULT 0")
+	if addColumn(db, "articles", "slug", "TEXT NOT NULL DEFAULT ''") {
+		if err = article.NewRepo(db).FillSlugs(); err != nil {
+			log.Fatal(err)
+		}
+	}
+	_, err = db.Exec(`CREATE UNIQUE INDEX IF NOT EXISTS "articles_slug" ON "articles" ("slug") WHERE "slug" != ''`)
+	if err != nil {
+		log.Fatal(err)
+	}
+	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS "articles_scheduled" ON "articles" ("status", "publish_at")`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Searches go through FTS5 indexes of the articles and comments that the
+	// triggers keep in sync with them, whichever code changes them.
+	newSearchIndex := !hasTable(db, "articles_fts")
+	_, err = db.Exec(`
+	CREATE VIRTUAL TABLE IF NOT EXISTS "articles_fts" USING fts5(title, body, content = 'articles', content_rowid = 'id',
+		tokenize = 'unicode61 remove_diacritics 2', prefix = '2 3');
+	CREATE TRIGGER IF NOT EXISTS "articles_fts_insert" AFTER INSERT ON "articles" BEGIN
+		INSERT INTO articles_fts (rowid, title, body) VALUES (new.id, new.title, new.body);
+	END;
+	CREATE TRIGGER IF NOT EXISTS "articles_fts_delete" AFTER DELETE ON "articles" BEGIN
+		INSERT INTO articles_fts (articles_fts, rowid, title, body) VALUES ('delete', old.id, old.title, old.body);
+	END;
+	CREATE TRIGGER IF NOT EXISTS "articles_fts_update" AFTER UPDATE OF title, body ON "articles" BEGIN
+		INSERT INTO articles_fts (articles_fts, rowid, title, body) VALUES ('delete', old.id, old.title, old.body);
+		INSERT INTO articles_fts (rowid, title, body) VALUES (new.id, new.title, new.body);
+	END;
+	CREATE VIRTUAL TABLE IF NOT EXISTS "comments_fts" USING fts5(body, content = 'comments', content_rowid = 'id',
+		tokenize = 'unicode61 remove_diacritics 2', prefix = '2 3');
+	CREATE TRIGGER IF NOT EXISTS "comments_fts_insert" AFTER INSERT ON "comments" BEGIN
+		INSERT INTO comments_fts (rowid, body) VALUES (new.id, new.body);
+	END;
+	CREATE TRIGGER IF NOT EXISTS "comments_fts_delete" AFTER DELETE ON "comments" BEGIN
+		INSERT INTO comments_fts (comments_fts, rowid, body) VALUES ('delete', old.id, old.body);
+	END;
+	CREATE TRIGGER IF NOT EXISTS "comments_fts_update" AFTER UPDATE OF body ON "comments" BEGIN
+		INSERT INTO comments_fts (comments_fts, rowid, body) VALUES ('delete', old.id, old.body);
+		INSERT INTO comments_fts (rowid, body) VALUES (new.id, new.body);
+	END;`)
+	if err != nil {
+		log.Fatal("Full-text search needs a build with -tags sqlite_fts5: ", err)
+	}
+	// What was written before searches were indexed gets indexed once.
+	if newSearchIndex {
+		_, err = db.Exec(`
+		INSERT INTO articles_fts (articles_fts) VALUES ('rebuild');
+		INSERT INTO comments_fts (comments_fts) VALUES ('rebuild');`)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	addColumn(db, "sessions", "user_agent", "TEXT NOT NULL DEFAULT ''")
+	addColumn(db, "sessions", "ip", "TEXT NOT NULL DEFAULT ''")
+	if addColumn(db, "sessions", "last_seen_at", "INTEGER NOT NULL DEFAULT 0") {
+		_, err = db.Exec(`UPDATE sessions SET last_seen_at = created_at`)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// The built-in roles used to be re-seeded on every start.
+	if addColumn(db, "roles", "protected", "INTEGER NOT NULL DEFAULT 0") {
+		_, err = db.Exec(`UPDATE roles SET protected = 1 WHERE id IN (1, 2, 3)`)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	if addColumn(db, "roles", "is_default", "INTEGER NOT NULL DEFAULT 0") {
+		_, err = db.Exec(`UPDATE roles SET is_default = 1 WHERE id = 1`)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	_, err = db.Exec(`
+	INSERT OR IGNORE INTO roles (id, name, protected, is_default) values (1, "Guest", 1, 1);
+	INSERT OR IGNORE INTO roles (id, name, protected) values (2, "Author", 1);
+	INSERT OR IGNORE INTO roles (id, name, code, protected) values (3, "Admin", 127, 1);`)
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Permissions used to be bits of roles.code and api_keys.permissions,
+	// the seeds above still use codes.
+	if err = role.NewRepo(db).MigrateCodes(); err != nil {
+		log.Fatal(err)
+	}
+	if addColumn(db, "api_keys", "scopes", "TEXT") {
+		if err = apikey.NewRepo(db).MigrateCodes(); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if newAuditLog {
+		grantAdmin(db, role.CanReadAudit)
+	}
+	if newPublishing {
+		grantAdmin(db, role.CanPublishArticle)
+	}
+	if newTags {
+		grantAdmin(db, role.CanManageTags)
+	}
+
+	// Articles written before revisions were kept start with what they are now.
+	if newRevisions {
+		_, err = db.Exec(`INSERT INTO article_revisions (article_id, user_id, title, body, created_at, format) 
+		SELECT id, user_id, title, body, updated_at, format FROM articles`)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
 	return db
 }
+
+// grantAdmin gives the built-in Admin role a permission.
+func grantAdmin(db *sql.DB, permission string) {
+	_, err := db.Exec(`INSERT OR IGNORE INTO role_permissions (role_id, permission) SELECT id, ? FROM roles WHERE id = 3`, permission)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// hasTable reports whether the table was created by an earlier start.
+func hasTable(db *sql.DB, table string) bool {
+	var count int
+	err := db.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?`, table).Scan(&count)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	return count > 0
+}
+
+// hasColumn reports whether the table exists and has the column.
+func hasColumn(db *sql.DB, table string, column string) bool {
+	var count int
+	err := db.QueryRow(`SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = ?`, table, column).Scan(&count)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	return count > 0
+}
+
+// addColumn adds a column missing from a table created by an older version,
+// reporting whether it had to be added.
+func addColumn(db *sql.DB, table string, column string, definition string) bool {
+	if hasColumn(db, table, column) {
+		return false
+	}
+
+	if _, err := db.Exec(`ALTER TABLE "` + table + `" ADD COLUMN "` + column + `" ` + definition); err != nil {
+		log.Fatal(err)
+	}
+
+	return true
+}
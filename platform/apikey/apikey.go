@@ -0,0 +1,112 @@
+package apikey
+
+import (
+	"database/sql"
+	"errors"
+	"go-blog/platform/role"
+	"go-blog/platform/token"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-chi/render"
+)
+
+// Prefix tells API keys apart from JWTs in the Authorization header.
+const Prefix = "gb_"
+
+var ErrInvalidKey = errors.New("Invalid API key.")
+
+type Key struct {
+	ID           int64    `json:"id"`
+	User_ID      int64    `json:"-"`
+	Role_ID      int64    `json:"-"`
+	Name         string   `json:"name"`
+	Key_Prefix   string   `json:"prefix"`
+	Permissions  []string `json:"permissions"` // nil means everything the role allows.
+	Expires_At   int64    `json:"expires_at"`
+	Last_Used_At int64    `json:"last_used_at"`
+	Created_At   int64    `json:"created_at"`
+}
+
+// NewKey returns a random key and the hash stored in the db.
+func NewKey() (string, string, error) {
+	random, err := token.Random()
+	if err != nil {
+		return "", "", err
+	}
+	key := Prefix + random
+	return key, token.Hash(key), nil
+}
+
+// joinScopes and splitScopes store permissions in the scopes column,
+// where NULL means the key isn't narrowed.
+func joinScopes(permissions []string) sql.NullString {
+	if permissions == nil {
+		return sql.NullString{}
+	}
+	return sql.NullString{String: strings.Join(permissions, ","), Valid: true}
+}
+
+func splitScopes(scopes sql.NullString) []string {
+	if !scopes.Valid {
+		return nil
+	}
+	if scopes.String == "" {
+		return []string{}
+	}
+	return strings.Split(scopes.String, ",")
+}
+
+func IsKey(value string) bool {
+	return strings.HasPrefix(value, Prefix)
+}
+
+type KeyPayload struct {
+	*Key
+	Plain string `json:"key,omitempty"`
+}
+
+func NewKeyPayload(key *Key) *KeyPayload {
+	return &KeyPayload{Key: key}
+}
+
+func NewKeyListPayload(keys []*Key) []render.Renderer {
+	list := []render.Renderer{}
+	for _, key := range keys {
+		list = append(list, NewKeyPayload(key))
+	}
+	return list
+}
+
+func (k *KeyPayload) Bind(r *http.Request) error {
+	//do stuff on payload after 'receive and decode' but before binding data
+	if k.Key == nil {
+		return errors.New("missing required Key fields.")
+	}
+	if k.Name == "" {
+		return errors.New("Missing name field")
+	}
+	if k.Permissions != nil {
+		names, err := role.CleanPermissions(k.Permissions)
+		if err != nil {
+			return err
+		}
+		k.Permissions = names
+	}
+
+	now := time.Now().Unix()
+	if k.Expires_At != 0 && k.Expires_At <= now {
+		return errors.New("Expiry must be in the future.")
+	}
+
+	k.Plain = ""
+	k.Last_Used_At = 0
+	k.Created_At = now
+	return nil
+}
+
+func (k *KeyPayload) Render(w http.ResponseWriter, r *http.Request) error {
+	//do stuff on payload before send
+	return nil
+}
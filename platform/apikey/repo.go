@@ -0,0 +1,174 @@
+package apikey
+
+import (
+	"database/sql"
+	"go-blog/platform/role"
+	"go-blog/platform/token"
+	"log"
+	"time"
+)
+
+type Repo struct {
+	DB *sql.DB
+}
+
+func NewRepo(db *sql.DB) *Repo {
+	return &Repo{
+		DB: db,
+	}
+}
+
+// Add stores a new key for the user and returns its plain value,
+// which is never stored and can't be shown again.
+func (repo *Repo) Add(key *Key) (int64, string, error) {
+	plain, hash, err := NewKey()
+	if err != nil {
+		log.Println(err)
+		return 0, "", err
+	}
+
+	stmt, err := repo.DB.Prepare(`
+	INSERT INTO 
+	api_keys (user_id, name, key_hash, key_prefix, scopes, expires_at, created_at) 
+	values (?, ?, ?, ?, ?, ?, ?)`)
+
+	if err != nil {
+		log.Println(err)
+		return 0, "", err
+	}
+
+	defer stmt.Close()
+
+	key.Key_Prefix = plain[:len(Prefix)+6]
+
+	result, err := stmt.Exec(key.User_ID, key.Name, hash, key.Key_Prefix, joinScopes(key.Permissions), key.Expires_At, key.Created_At)
+	if err != nil {
+		log.Println(err)
+		return 0, "", err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		log.Println(err)
+	}
+
+	return id, plain, err
+}
+
+func (repo *Repo) Delete(id int64, userID int64) error {
+	stmt, err := repo.DB.Prepare("DELETE FROM api_keys WHERE id = ? AND user_id = ?")
+
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+
+	defer stmt.Close()
+
+	result, err := stmt.Exec(id, userID)
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+
+	if affected, err := result.RowsAffected(); err != nil {
+		log.Println(err)
+		return err
+	} else if affected == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
+
+// Authenticate resolves a plain key to its record and marks it as used.
+func (repo *Repo) Authenticate(plain string) (*Key, error) {
+	key := &Key{}
+	var scopes sql.NullString
+
+	err := repo.DB.QueryRow(`
+	SELECT api_keys.id, api_keys.user_id, users.role_id, api_keys.name, api_keys.key_prefix,
+	api_keys.scopes, api_keys.expires_at, api_keys.last_used_at, api_keys.created_at 
+	FROM api_keys INNER JOIN users ON users.id = api_keys.user_id 
+	WHERE api_keys.key_hash = ?`, token.Hash(plain)).Scan(
+		&key.ID, &key.User_ID, &key.Role_ID, &key.Name, &key.Key_Prefix,
+		&scopes, &key.Expires_At, &key.Last_Used_At, &key.Created_At)
+
+	if err == sql.ErrNoRows {
+		return nil, ErrInvalidKey
+	} else if err != nil {
+		log.Println(err)
+		return nil, err
+	}
+
+	now := time.Now().Unix()
+	if key.Expires_At != 0 && key.Expires_At <= now {
+		return nil, ErrInvalidKey
+	}
+	key.Permissions = splitScopes(scopes)
+
+	if _, err = repo.DB.Exec("UPDATE api_keys SET last_used_at = ? WHERE id = ?", now, key.ID); err != nil {
+		log.Println(err)
+		return nil, err
+	}
+	key.Last_Used_At = now
+
+	return key, nil
+}
+
+func (repo *Repo) GetByUserID(userID int64) []*Key {
+	keys := []*Key{}
+
+	rows, err := repo.DB.Query(`
+	SELECT id, user_id, name, key_prefix, scopes, expires_at, last_used_at, created_at 
+	FROM api_keys WHERE user_id = ? ORDER BY created_at DESC`, userID)
+
+	if err != nil {
+		log.Println(err)
+		return keys
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var key Key
+		var scopes sql.NullString
+		rows.Scan(&key.ID, &key.User_ID, &key.Name, &key.Key_Prefix,
+			&scopes, &key.Expires_At, &key.Last_Used_At, &key.Created_At)
+		key.Permissions = splitScopes(scopes)
+		keys = append(keys, &key)
+	}
+
+	return keys
+}
+
+// MigrateCodes fills the scopes of keys created when permissions were a bitmask.
+func (repo *Repo) MigrateCodes() error {
+	rows, err := repo.DB.Query("SELECT id, permissions FROM api_keys WHERE permissions IS NOT NULL AND scopes IS NULL")
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+
+	codes := map[int64]int64{}
+	for rows.Next() {
+		var id, code int64
+		if err = rows.Scan(&id, &code); err != nil {
+			log.Println(err)
+			rows.Close()
+			return err
+		}
+		codes[id] = code
+	}
+	rows.Close()
+
+	for id, code := range codes {
+		_, err = repo.DB.Exec("UPDATE api_keys SET scopes = ? WHERE id = ?", joinScopes(role.FromCode(code)), id)
+		if err != nil {
+			log.Println(err)
+			return err
+		}
+	}
+
+	return nil
+}
@@ -2,30 +2,229 @@ package article
 
 import (
 	"errors"
+	"go-blog/platform/diff"
+	"go-blog/platform/markup"
 	"go-blog/platform/role"
+	"go-blog/platform/tag"
 	"go-blog/platform/user"
 	"net/http"
+	"regexp"
+	"strings"
 	"time"
 
 	"github.com/go-chi/render"
+	"github.com/mozillazg/go-unidecode"
 )
 
 type Article struct {
-	ID            int64  `json:"id"`
-	User_ID       int64  `json:"-"`
-	Title         string `json:"title"`
-	Body          string `json:"body,omitempty"`
-	Created_At    int64  `json:"created_at"`
-	Updated_At    int64  `json:"updated_at"`
-	Comment_Count int64  `json:"comment_count"`
-	Favorites     int64  `json:"favorites"`
+	ID            int64    `json:"id"`
+	User_ID       int64    `json:"-"`
+	Title         string   `json:"title"`
+	Body          string   `json:"body,omitempty"`
+	Created_At    int64    `json:"created_at"`
+	Updated_At    int64    `json:"updated_at"`
+	Comment_Count int64    `json:"comment_count"`
+	Favorites     int64    `json:"favorites"`
+	Status        string   `json:"status"`
+	Publish_At    int64    `json:"publish_at"` // when it went or goes live, 0 if it never did.
+	Format        string   `json:"format"`
+	Body_HTML     string   `json:"body_html,omitempty"` // Body rendered as Format, cached on save.
+	Category_ID   int64    `json:"category_id"`         // 0 when it has none.
+	Slug          string   `json:"slug"`
+	Tags          []string `json:"tags"`
+	Snippet       string   `json:"snippet,omitempty"` // HTML of where the body matches a search, matches in <mark>.
+}
+
+const maxSlugLength = 80
+
+var (
+	ErrSlugTaken = errors.New("Another article already has this slug.")
+	slugRegex    = regexp.MustCompile(`[^a-z0-9]+`)
+	numberRegex  = regexp.MustCompile(`^[0-9]+$`)
+)
+
+// Slugify makes the url friendly form of a title, transliterated to ascii
+// like "Crème brûlée" to "creme-brulee". Slugs are never only digits, those
+// are article ids.
+func Slugify(title string) string {
+	slug := strings.Trim(slugRegex.ReplaceAllString(strings.ToLower(unidecode.Unidecode(title)), "-"), "-")
+
+	if len(slug) > maxSlugLength {
+		slug = slug[:maxSlugLength]
+		if cut := strings.LastIndex(slug, "-"); cut > maxSlugLength/2 {
+			slug = slug[:cut]
+		}
+		slug = strings.Trim(slug, "-")
+	}
+
+	if slug == "" || numberRegex.MatchString(slug) {
+		slug = strings.Trim("article-"+slug, "-")
+	}
+
+	return slug
+}
+
+// IsNumericID reports whether an article is looked up by id rather than slug.
+func IsNumericID(idOrSlug string) bool {
+	return numberRegex.MatchString(idOrSlug)
+}
+
+// sluggedFrom reports whether the slug was made from the title, possibly
+// with a suffix for collisions, rather than picked by hand.
+func sluggedFrom(slug string, title string) bool {
+	base := Slugify(title)
+	if slug == base {
+		return true
+	}
+	suffix := strings.TrimPrefix(slug, base+"-")
+	return suffix != slug && numberRegex.MatchString(suffix)
+}
+
+const (
+	Draft     = "draft"     // only the author and collaborators work on it.
+	InReview  = "in_review" // waiting for someone who can publish it.
+	Scheduled = "scheduled" // published by the scheduler at Publish_At.
+	Published = "published" // visible to everyone.
+	Archived  = "archived"  // taken down, kept for the author.
+)
+
+func IsStatus(status string) bool {
+	return status == Draft || status == InReview || status == Scheduled || status == Published || status == Archived
+}
+
+// Due reports whether a scheduled article should be live by now. It counts
+// as published from then on, whether or not the scheduler got to it yet.
+func (a *Article) Due(now int64) bool {
+	return a.Status == Scheduled && a.Publish_At <= now
+}
+
+// transitions lists the statuses an article can move to from each status.
+var transitions = map[string][]string{
+	Draft:     {InReview, Scheduled, Published},
+	InReview:  {Draft, Scheduled, Published},
+	Scheduled: {Draft, Scheduled, Published},
+	Published: {Draft, Archived},
+	Archived:  {Draft, Published},
+}
+
+func CanTransition(from string, to string) bool {
+	for _, status := range transitions[from] {
+		if status == to {
+			return true
+		}
+	}
+	return false
+}
+
+const (
+	Editor   = "editor"    // may update the article.
+	CoAuthor = "co-author" // may update it and is credited next to the author.
+)
+
+// Collaborator is a user the author let work on the article.
+type Collaborator struct {
+	Article_ID int64             `json:"-"`
+	User_ID    int64             `json:"user_id"`
+	Role       string            `json:"role"`
+	Created_At int64             `json:"created_at"`
+	User       *user.UserPayload `json:"user,omitempty"`
+}
+
+type CollaboratorPayload struct {
+	*Collaborator
+}
+
+func NewCollaboratorListPayload(collaborators []*Collaborator, userRepo *user.Repo, roleRepo *role.Repo) []render.Renderer {
+	list := []render.Renderer{}
+	for _, collaborator := range collaborators {
+		if userTemp, err := userRepo.GetByID(collaborator.User_ID); err == nil {
+			collaborator.User = user.NewUserPayload(userTemp, roleRepo)
+		}
+		list = append(list, &CollaboratorPayload{Collaborator: collaborator})
+	}
+	return list
+}
+
+func (c *CollaboratorPayload) Render(w http.ResponseWriter, r *http.Request) error {
+	//do stuff on payload before send
+	if c.User != nil {
+		return c.User.Render(w, r)
+	}
+	return nil
+}
+
+// Revision is the title and body of an article as a save left them.
+type Revision struct {
+	ID         int64             `json:"id"`
+	Article_ID int64             `json:"article_id"`
+	User_ID    int64             `json:"user_id"` // who saved it.
+	Title      string            `json:"title"`
+	Body       string            `json:"body,omitempty"`
+	Format     string            `json:"format"`
+	Created_At int64             `json:"created_at"`
+	User       *user.UserPayload `json:"user,omitempty"`
+}
+
+type RevisionPayload struct {
+	*Revision
+}
+
+func NewRevisionPayload(revision *Revision, userRepo *user.Repo, roleRepo *role.Repo) *RevisionPayload {
+	if userRepo != nil {
+		if userTemp, err := userRepo.GetByID(revision.User_ID); err == nil {
+			revision.User = user.NewUserPayload(userTemp, roleRepo)
+		}
+	}
+	return &RevisionPayload{Revision: revision}
+}
+
+func NewRevisionListPayload(revisions []*Revision, userRepo *user.Repo, roleRepo *role.Repo) []render.Renderer {
+	list := []render.Renderer{}
+	for _, revision := range revisions {
+		list = append(list, NewRevisionPayload(revision, userRepo, roleRepo))
+	}
+	return list
+}
+
+func (rev *RevisionPayload) Render(w http.ResponseWriter, r *http.Request) error {
+	//do stuff on payload before send
+	if rev.User != nil {
+		return rev.User.Render(w, r)
+	}
+	return nil
+}
+
+// RevisionDiff is what changed from one revision to another, line by line.
+type RevisionDiff struct {
+	From  int64       `json:"from"` // 0 when diffing the first revision.
+	To    int64       `json:"to"`
+	Title []diff.Line `json:"title"`
+	Body  []diff.Line `json:"body"`
+}
+
+func NewRevisionDiff(from *Revision, to *Revision) *RevisionDiff {
+	if from == nil {
+		from = &Revision{}
+	}
+	return &RevisionDiff{
+		From:  from.ID,
+		To:    to.ID,
+		Title: diff.Lines(from.Title, to.Title),
+		Body:  diff.Lines(from.Body, to.Body),
+	}
+}
+
+func (d *RevisionDiff) Render(w http.ResponseWriter, r *http.Request) error {
+	//do stuff on payload before send
+	return nil
 }
 
 type ArticlePayload struct {
 	*Article
-	FavStatus     bool              `json:"fav_status"`
-	CommentStatus bool              `json:"comment_status"`
-	User          *user.UserPayload `json:"user,omitempty"`
+	FavStatus     bool                `json:"fav_status"`
+	CommentStatus bool                `json:"comment_status"`
+	User          *user.UserPayload   `json:"user,omitempty"`
+	CoAuthors     []*user.UserPayload `json:"co_authors,omitempty"`
 }
 
 func NewArticlePayload(article *Article, claims user.Claims, userRepo *user.Repo, roleRepo *role.Repo) *ArticlePayload {
@@ -35,6 +234,9 @@ func NewArticlePayload(article *Article, claims user.Claims, userRepo *user.Repo
 			if userTemp, err := userRepo.GetByID(article.User_ID); err == nil {
 				payload.User = user.NewUserPayload(userTemp, roleRepo)
 			}
+			for _, coAuthor := range userRepo.GetCoAuthorsOf(article.ID) {
+				payload.CoAuthors = append(payload.CoAuthors, user.NewUserPayload(coAuthor, roleRepo))
+			}
 		}
 
 		if claims.Authenticated {
@@ -59,7 +261,37 @@ func (a *ArticlePayload) Bind(r *http.Request) error {
 		return errors.New("missing required Article fields.")
 	}
 
+	if a.Status == "" {
+		a.Status = Draft
+	} else if !IsStatus(a.Status) {
+		return errors.New("Status must be one of draft, in_review, scheduled, published or archived.")
+	}
+
+	if a.Format == "" {
+		a.Format = markup.Markdown
+	} else if !markup.IsFormat(a.Format) {
+		return markup.ErrFormat
+	}
+
+	if a.Slug != "" {
+		a.Slug = Slugify(a.Slug)
+	}
+
+	tags, err := tag.Clean(a.Tags)
+	if err != nil {
+		return err
+	}
+	a.Tags = tags
+
+	if a.Category_ID < 0 {
+		return errors.New("Invalid category id.")
+	}
+
 	now := time.Now().Unix()
+	if a.Status == Scheduled && a.Publish_At <= now {
+		return errors.New("Scheduled articles need a publish_at in the future.")
+	}
+
 	a.Updated_At = now
 	a.Created_At = now
 
@@ -68,5 +300,10 @@ func (a *ArticlePayload) Bind(r *http.Request) error {
 
 func (a *ArticlePayload) Render(w http.ResponseWriter, r *http.Request) error {
 	//do stuff on payload before send
+	for _, coAuthor := range a.CoAuthors {
+		if err := coAuthor.Render(w, r); err != nil {
+			return err
+		}
+	}
 	return nil
 }
@@ -3,29 +3,65 @@ package article
 import (
 	"context"
 	"database/sql"
+	"go-blog/platform/fulltext"
+	"go-blog/platform/markup"
+	"go-blog/platform/tag"
 	"log"
+	"strconv"
+	"strings"
+	"time"
 )
 
 const ARTICLE_IN_PAGE = 10
 
+// PublishedCondition matches the articles everyone can read. Scheduled ones
+// that are due count as published whether or not the scheduler got to them
+// yet, see Article.Due. Its parameter is the current unix time.
+const PublishedCondition = `(articles.status = 'published' OR (articles.status = 'scheduled' AND articles.publish_at <= ?))`
+
+// tagsColumn lists the tags of an article as "a,b,c", tags can't have commas.
+const tagsColumn = `(SELECT GROUP_CONCAT(name) FROM (SELECT name FROM tags JOIN article_tags ON tags.id = article_tags.tag_id
+		WHERE article_tags.article_id = articles.id ORDER BY name)) tags`
+
+func splitTags(tags sql.NullString) []string {
+	if tags.String == "" {
+		return []string{}
+	}
+	return strings.Split(tags.String, ",")
+}
+
+// searchColumns are listed for each article found, searches by keyword
+// add their snippet.
+const searchColumns = `SELECT id, user_id,
+		articles.title, created_at, updated_at, status, publish_at, format, category_id, slug,
+		(SELECT COUNT(id) FROM favorites WHERE article_id = articles.id) fav_count,
+		(SELECT COUNT(id) FROM comments WHERE article_id = articles.id AND shadowed = 0 AND deleted = 0) comment_count,
+		` + tagsColumn
+
 type Search struct {
-	query         string
+	query         string // the conditions and order, sql puts the columns and tables in front.
 	params        []interface{}
 	isConditioned bool
+	match         string // the full-text terms searched, the index is joined to rank and snip the matches.
 }
 
 func NewSearch() *Search {
 	return &Search{
-		query: `SELECT id, user_id,
-		title, created_at, updated_at,
-		(SELECT COUNT(id) FROM favorites WHERE article_id = articles.id) fav_count,
-		(SELECT COUNT(id) FROM comments WHERE article_id = articles.id) comment_count 
-		FROM articles `,
 		params:        []interface{}{},
 		isConditioned: false,
 	}
 }
 
+// sql is the whole query of the search. Searching by keyword joins the
+// full-text index once, for the match, its rank and the snippet.
+func (s *Search) sql() string {
+	if s.match == "" {
+		return searchColumns + `, '' snippet FROM articles ` + s.query
+	}
+	return searchColumns + `, snippet(articles_fts, 1, '` + fulltext.MarkOpen + `', '` + fulltext.MarkClose + `', '…', 24) snippet
+		FROM articles JOIN articles_fts ON articles_fts.rowid = articles.id ` + s.query
+}
+
 func (s *Search) ApplyCondition() {
 	if s.isConditioned {
 		s.query += `AND `
@@ -43,12 +79,20 @@ func (s *Search) QueryDate(from int64, to int64) {
 	}
 }
 
+// QueryKeyword keeps the articles whose title or body match the search, see
+// fulltext.Parse for its syntax.
 func (s *Search) QueryKeyword(keyword string) {
-	if keyword != "" {
+	query := fulltext.Parse(keyword)
+	if query.Match != "" {
 		s.ApplyCondition()
-		keyword = "%" + keyword + "%"
-		s.query += `(title LIKE ? OR body LIKE ?) `
-		s.params = append(s.params, keyword, keyword)
+		s.query += `articles_fts MATCH ? `
+		s.params = append(s.params, query.Match)
+		s.match = query.Match
+	}
+	if query.Exclude != "" {
+		s.ApplyCondition()
+		s.query += `id NOT IN (SELECT rowid FROM articles_fts WHERE articles_fts MATCH ?) `
+		s.params = append(s.params, query.Exclude)
 	}
 }
 
@@ -68,6 +112,46 @@ func (s *Search) QueryUserID(userID string) {
 	}
 }
 
+// QueryStatus keeps the articles with the status. Scheduled articles that
+// are due count as published already.
+func (s *Search) QueryStatus(status string) {
+	s.ApplyCondition()
+	switch status {
+	case Published:
+		s.query += PublishedCondition + ` `
+		s.params = append(s.params, time.Now().Unix())
+	case Scheduled:
+		s.query += `status = 'scheduled' AND publish_at > ? `
+		s.params = append(s.params, time.Now().Unix())
+	default:
+		s.query += `status = ? `
+		s.params = append(s.params, status)
+	}
+}
+
+// QueryTag keeps the articles with the tag.
+func (s *Search) QueryTag(name string) {
+	s.ApplyCondition()
+	s.query += `id IN (SELECT article_id FROM article_tags JOIN tags ON tags.id = article_tags.tag_id WHERE tags.name = ?) `
+	s.params = append(s.params, tag.Normalize(name))
+}
+
+// QueryCategory keeps the articles in the category or any of its subcategories.
+func (s *Search) QueryCategory(categoryID int64) {
+	s.ApplyCondition()
+	s.query += `category_id IN (WITH RECURSIVE sub(id) AS 
+		(SELECT ? UNION SELECT categories.id FROM categories JOIN sub ON categories.parent_id = sub.id) 
+		SELECT id FROM sub) `
+	s.params = append(s.params, categoryID)
+}
+
+// QueryWorkedOnBy keeps the articles the user wrote or collaborates on.
+func (s *Search) QueryWorkedOnBy(userID int64) {
+	s.ApplyCondition()
+	s.query += `(user_id = ? OR id IN (SELECT article_id FROM article_collaborators WHERE user_id = ?)) `
+	s.params = append(s.params, userID, userID)
+}
+
 func (s *Search) Limit(page int, sort string) {
 	from := (page - 1) * ARTICLE_IN_PAGE
 
@@ -76,8 +160,15 @@ func (s *Search) Limit(page int, sort string) {
 		s.query += `ORDER BY fav_count DESC, comment_count DESC `
 	case "comment":
 		s.query += `ORDER BY comment_count DESC, fav_count DESC `
+	case "relevance":
+		if s.match != "" {
+			// bm25 is lower for better matches, a match in the title counts more.
+			s.query += `ORDER BY bm25(articles_fts, 10.0, 1.0), MAX(publish_at, created_at) DESC `
+			break
+		}
+		fallthrough
 	default:
-		s.query += `ORDER BY created_at DESC `
+		s.query += `ORDER BY MAX(publish_at, created_at) DESC `
 	}
 
 	s.query += `LIMIT ?, ?`
@@ -177,6 +268,32 @@ func (repo *Repo) Delete(id int64) error {
 		return err
 	}
 
+	_, err = tx.ExecContext(ctx, "DELETE FROM article_collaborators WHERE article_id = ?", id)
+	if err != nil {
+		log.Println(err)
+		tx.Rollback()
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, "DELETE FROM article_revisions WHERE article_id = ?", id)
+	if err != nil {
+		log.Println(err)
+		tx.Rollback()
+		return err
+	}
+
+	if err = setTags(ctx, tx, id, nil); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, "DELETE FROM article_slugs WHERE article_id = ?", id)
+	if err != nil {
+		log.Println(err)
+		tx.Rollback()
+		return err
+	}
+
 	err = tx.Commit()
 	if err != nil {
 		log.Println(err)
@@ -186,8 +303,175 @@ func (repo *Repo) Delete(id int64) error {
 	return nil
 }
 
-func (repo *Repo) Update(article *Article) error {
-	stmt, err := repo.DB.Prepare("UPDATE articles SET title = ?, body = ?, updated_at = ? WHERE id = ?")
+// Update saves the title and body of the article as a new revision by the editor.
+func (repo *Repo) Update(article *Article, editorID int64) error {
+	ctx := context.Background()
+
+	tx, err := repo.DB.BeginTx(ctx, nil)
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+
+	if article.Body_HTML, err = markup.Render(article.Format, article.Body); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if err = updateSlug(ctx, tx, article); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `UPDATE articles SET title = ?, body = ?, updated_at = ?, format = ?, body_html = ?, 
+	category_id = ?, slug = ? WHERE id = ?`,
+		article.Title, article.Body, article.Updated_At, article.Format, article.Body_HTML, article.Category_ID,
+		article.Slug, article.ID)
+	if err != nil {
+		log.Println(err)
+		tx.Rollback()
+		return err
+	}
+
+	if err = setTags(ctx, tx, article.ID, article.Tags); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if err = addRevision(ctx, tx, article, editorID, article.Updated_At); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+
+	return nil
+}
+
+// slugTaken reports whether another article has or had the slug. Old slugs
+// stay taken so their links keep leading to the article.
+func slugTaken(ctx context.Context, tx *sql.Tx, slug string, id int64) (bool, error) {
+	var taken bool
+	err := tx.QueryRowContext(ctx, `
+	SELECT 1 FROM articles WHERE slug = ? AND id != ? 
+	UNION SELECT 1 FROM article_slugs WHERE slug = ? AND article_id != ?`, slug, id, slug, id).Scan(&taken)
+	if err == sql.ErrNoRows {
+		return false, nil
+	} else if err != nil {
+		log.Println(err)
+		return false, err
+	}
+	return true, nil
+}
+
+// uniqueSlug suffixes the slug with -2, -3... until no other article has it.
+func uniqueSlug(ctx context.Context, tx *sql.Tx, slug string, id int64) (string, error) {
+	candidate := slug
+	for n := 2; ; n++ {
+		taken, err := slugTaken(ctx, tx, candidate, id)
+		if err != nil || !taken {
+			return candidate, err
+		}
+		candidate = slug + "-" + strconv.Itoa(n)
+	}
+}
+
+// updateSlug settles the slug of an article being updated. A slug different
+// from the current one was asked for and must be free. Otherwise a slug made
+// from the old title follows the new one, a slug picked by hand stays. The
+// old slug is kept so its links redirect.
+func updateSlug(ctx context.Context, tx *sql.Tx, article *Article) error {
+	var title, current string
+	err := tx.QueryRowContext(ctx, "SELECT title, slug FROM articles WHERE id = ?", article.ID).Scan(&title, &current)
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+
+	if article.Slug != "" && article.Slug != current {
+		if taken, err := slugTaken(ctx, tx, article.Slug, article.ID); err != nil {
+			return err
+		} else if taken {
+			return ErrSlugTaken
+		}
+	} else if current == "" || (article.Title != title && sluggedFrom(current, title)) {
+		if article.Slug, err = uniqueSlug(ctx, tx, Slugify(article.Title), article.ID); err != nil {
+			return err
+		}
+	} else {
+		article.Slug = current
+	}
+
+	if article.Slug == current {
+		return nil
+	}
+
+	_, err = tx.ExecContext(ctx, "DELETE FROM article_slugs WHERE slug = ?", article.Slug)
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+
+	if current != "" {
+		_, err = tx.ExecContext(ctx, "INSERT OR REPLACE INTO article_slugs (slug, article_id, created_at) VALUES (?, ?, ?)",
+			current, article.ID, time.Now().Unix())
+		if err != nil {
+			log.Println(err)
+			return err
+		}
+	}
+
+	return nil
+}
+
+// setTags replaces the tags of an article, creating the new ones and
+// dropping the ones no article has anymore.
+func setTags(ctx context.Context, tx *sql.Tx, id int64, tags []string) error {
+	_, err := tx.ExecContext(ctx, "DELETE FROM article_tags WHERE article_id = ?", id)
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+
+	for _, name := range tags {
+		if _, err = tx.ExecContext(ctx, "INSERT OR IGNORE INTO tags (name) VALUES (?)", name); err != nil {
+			log.Println(err)
+			return err
+		}
+
+		_, err = tx.ExecContext(ctx, "INSERT INTO article_tags (article_id, tag_id) SELECT ?, id FROM tags WHERE name = ?", id, name)
+		if err != nil {
+			log.Println(err)
+			return err
+		}
+	}
+
+	_, err = tx.ExecContext(ctx, "DELETE FROM tags WHERE id NOT IN (SELECT tag_id FROM article_tags)")
+	if err != nil {
+		log.Println(err)
+	}
+
+	return err
+}
+
+func addRevision(ctx context.Context, tx *sql.Tx, article *Article, editorID int64, createdAt int64) error {
+	_, err := tx.ExecContext(ctx, `
+	INSERT INTO 
+	article_revisions (article_id, user_id, title, body, created_at, format) 
+	values (?, ?, ?, ?, ?, ?)`, article.ID, editorID, article.Title, article.Body, createdAt, article.Format)
+	if err != nil {
+		log.Println(err)
+	}
+
+	return err
+}
+
+func (repo *Repo) SetStatus(id int64, status string, publishAt int64) error {
+	stmt, err := repo.DB.Prepare("UPDATE articles SET status = ?, publish_at = ? WHERE id = ?")
 
 	if err != nil {
 		log.Println(err)
@@ -196,41 +480,187 @@ func (repo *Repo) Update(article *Article) error {
 
 	defer stmt.Close()
 
-	_, err = stmt.Exec(article.Title, article.Body, article.Updated_At, article.ID)
+	if _, err = stmt.Exec(status, publishAt, id); err != nil {
+		log.Println(err)
+		return err
+	}
 
+	return nil
+}
+
+// Rerender renders the bodies of all articles again, for when the cached
+// HTML can't be trusted, like after an upgrade.
+func (repo *Repo) Rerender() error {
+	rows, err := repo.DB.Query("SELECT id, format, body FROM articles")
 	if err != nil {
 		log.Println(err)
 		return err
 	}
 
+	articles := []*Article{}
+	for rows.Next() {
+		var article Article
+		rows.Scan(&article.ID, &article.Format, &article.Body)
+		articles = append(articles, &article)
+	}
+	rows.Close()
+
+	for _, article := range articles {
+		if article.Body_HTML, err = markup.Render(article.Format, article.Body); err != nil {
+			return err
+		}
+		if _, err = repo.DB.Exec("UPDATE articles SET body_html = ? WHERE id = ?", article.Body_HTML, article.ID); err != nil {
+			log.Println(err)
+			return err
+		}
+	}
+
 	return nil
 }
 
+// PublishDue publishes the scheduled articles that are due.
+func (repo *Repo) PublishDue(now int64) (int64, error) {
+	result, err := repo.DB.Exec("UPDATE articles SET status = ? WHERE status = ? AND publish_at <= ?", Published, Scheduled, now)
+	if err != nil {
+		log.Println(err)
+		return 0, err
+	}
+
+	published, err := result.RowsAffected()
+	if err != nil {
+		log.Println(err)
+	}
+
+	return published, err
+}
+
+// NextScheduled returns when the next scheduled article is due, 0 if none is.
+func (repo *Repo) NextScheduled() int64 {
+	var next sql.NullInt64
+	err := repo.DB.QueryRow("SELECT MIN(publish_at) FROM articles WHERE status = ?", Scheduled).Scan(&next)
+	if err != nil {
+		log.Println(err)
+	}
+
+	return next.Int64
+}
+
+// Add saves a new article along with its first revision.
 func (repo *Repo) Add(article *Article) (int64, error) {
-	stmt, err := repo.DB.Prepare(`
-	INSERT INTO 
-	articles (user_id, title, body, created_at, updated_at) 
-	values (?, ?, ?, ?, ?)`)
+	var err error
+	if article.Body_HTML, err = markup.Render(article.Format, article.Body); err != nil {
+		return 0, err
+	}
+
+	ctx := context.Background()
 
+	tx, err := repo.DB.BeginTx(ctx, nil)
 	if err != nil {
 		log.Println(err)
 		return 0, err
 	}
 
-	defer stmt.Close()
+	if article.Slug == "" {
+		article.Slug, err = uniqueSlug(ctx, tx, Slugify(article.Title), 0)
+	} else if taken, takenErr := slugTaken(ctx, tx, article.Slug, 0); takenErr != nil {
+		err = takenErr
+	} else if taken {
+		err = ErrSlugTaken
+	}
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
 
-	result, err := stmt.Exec(article.User_ID, article.Title, article.Body, article.Created_At, article.Updated_At)
+	result, err := tx.ExecContext(ctx, `
+	INSERT INTO 
+	articles (user_id, title, body, created_at, updated_at, status, publish_at, format, body_html, category_id, slug) 
+	values (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		article.User_ID, article.Title, article.Body, article.Created_At, article.Updated_At, article.Status, article.Publish_At,
+		article.Format, article.Body_HTML, article.Category_ID, article.Slug)
 	if err != nil {
 		log.Println(err)
+		tx.Rollback()
 		return 0, err
 	}
 
 	id, err := result.LastInsertId()
 	if err != nil {
 		log.Println(err)
+		tx.Rollback()
+		return 0, err
+	}
+
+	article.ID = id
+	if err = addRevision(ctx, tx, article, article.User_ID, article.Created_At); err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+
+	if err = setTags(ctx, tx, id, article.Tags); err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		log.Println(err)
+		return 0, err
+	}
+
+	return id, nil
+}
+
+// GetRevisions lists the revisions of an article, newest first, without their bodies.
+func (repo *Repo) GetRevisions(id int64) []*Revision {
+	revisions := []*Revision{}
+
+	rows, err := repo.DB.Query(`
+	SELECT id, article_id, user_id, title, format, created_at 
+	FROM article_revisions WHERE article_id = ? ORDER BY id DESC`, id)
+
+	if err != nil {
+		log.Println(err)
+		return revisions
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var revision Revision
+		rows.Scan(&revision.ID, &revision.Article_ID, &revision.User_ID, &revision.Title, &revision.Format, &revision.Created_At)
+		revisions = append(revisions, &revision)
+	}
+
+	return revisions
+}
+
+func (repo *Repo) GetRevision(id int64, revisionID int64) (*Revision, error) {
+	return repo.getRevision(`
+	SELECT id, article_id, user_id, title, body, format, created_at 
+	FROM article_revisions WHERE article_id = ? AND id = ?`, id, revisionID)
+}
+
+// GetPreviousRevision returns the revision saved before the given one.
+func (repo *Repo) GetPreviousRevision(id int64, revisionID int64) (*Revision, error) {
+	return repo.getRevision(`
+	SELECT id, article_id, user_id, title, body, format, created_at 
+	FROM article_revisions WHERE article_id = ? AND id < ? ORDER BY id DESC LIMIT 1`, id, revisionID)
+}
+
+func (repo *Repo) getRevision(query string, args ...interface{}) (*Revision, error) {
+	revision := &Revision{}
+
+	err := repo.DB.QueryRow(query, args...).Scan(&revision.ID, &revision.Article_ID, &revision.User_ID,
+		&revision.Title, &revision.Body, &revision.Format, &revision.Created_At)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Println(err)
+		}
+		return nil, err
 	}
 
-	return id, err
+	return revision, nil
 }
 
 func (repo *Repo) GetByID(id string) (*Article, error) {
@@ -238,7 +668,8 @@ func (repo *Repo) GetByID(id string) (*Article, error) {
 
 	stmt, err := repo.DB.Prepare(`SELECT *,
 	(SELECT COUNT(id) FROM favorites WHERE article_id = articles.id) fav_count,
-	(SELECT COUNT(id) FROM comments WHERE article_id = articles.id) comment_count 
+	(SELECT COUNT(id) FROM comments WHERE article_id = articles.id AND shadowed = 0 AND deleted = 0) comment_count,
+	` + tagsColumn + `
 	FROM articles WHERE id = ?`)
 
 	if err != nil {
@@ -248,32 +679,200 @@ func (repo *Repo) GetByID(id string) (*Article, error) {
 
 	defer stmt.Close()
 
+	var tags sql.NullString
 	err = stmt.QueryRow(id).Scan(&article.ID, &article.User_ID,
-		&article.Title, &article.Body, &article.Created_At, &article.Updated_At,
-		&article.Favorites, &article.Comment_Count)
+		&article.Title, &article.Body, &article.Created_At, &article.Updated_At, &article.Status, &article.Publish_At,
+		&article.Format, &article.Body_HTML, &article.Category_ID, &article.Slug, &article.Favorites, &article.Comment_Count, &tags)
 
 	if err != nil {
 		log.Println(err)
 		return nil, err
 	}
+	article.Tags = splitTags(tags)
+
+	if article.Due(time.Now().Unix()) {
+		article.Status = Published
+	}
 
 	return article, err
 }
 
-func (repo *Repo) GetMultiple(search *Search) []*Article {
-	rows, err := repo.DB.Query(search.query, search.params...)
+// GetBySlug finds an article by its slug, or by one it had before, in which
+// case moved is true.
+func (repo *Repo) GetBySlug(slug string) (article *Article, moved bool, err error) {
+	var id string
+	err = repo.DB.QueryRow("SELECT id FROM articles WHERE slug = ?", slug).Scan(&id)
+	if err == sql.ErrNoRows {
+		moved = true
+		err = repo.DB.QueryRow("SELECT article_id FROM article_slugs WHERE slug = ?", slug).Scan(&id)
+	}
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Println(err)
+		}
+		return nil, false, err
+	}
+
+	article, err = repo.GetByID(id)
+	return article, moved, err
+}
+
+// FillSlugs gives a slug to the articles that have none, like the ones from
+// before slugs.
+func (repo *Repo) FillSlugs() error {
+	rows, err := repo.DB.Query("SELECT id, title FROM articles WHERE slug = '' ORDER BY id")
 	if err != nil {
 		log.Println(err)
+		return err
 	}
 
 	articles := []*Article{}
 	for rows.Next() {
 		var article Article
+		rows.Scan(&article.ID, &article.Title)
+		articles = append(articles, &article)
+	}
+	rows.Close()
+
+	ctx := context.Background()
+	for _, article := range articles {
+		tx, err := repo.DB.BeginTx(ctx, nil)
+		if err != nil {
+			log.Println(err)
+			return err
+		}
+
+		if article.Slug, err = uniqueSlug(ctx, tx, Slugify(article.Title), article.ID); err != nil {
+			tx.Rollback()
+			return err
+		}
+
+		if _, err = tx.ExecContext(ctx, "UPDATE articles SET slug = ? WHERE id = ?", article.Slug, article.ID); err != nil {
+			log.Println(err)
+			tx.Rollback()
+			return err
+		}
+
+		if err = tx.Commit(); err != nil {
+			log.Println(err)
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (repo *Repo) GetMultiple(search *Search) []*Article {
+	articles := []*Article{}
+
+	rows, err := repo.DB.Query(search.sql(), search.params...)
+	if err != nil {
+		log.Println(err)
+		return articles
+	}
+
+	now := time.Now().Unix()
+	for rows.Next() {
+		var article Article
+		var tags sql.NullString
+		var snippet string
 		rows.Scan(&article.ID, &article.User_ID,
-			&article.Title, &article.Created_At, &article.Updated_At,
-			&article.Favorites, &article.Comment_Count)
+			&article.Title, &article.Created_At, &article.Updated_At, &article.Status, &article.Publish_At,
+			&article.Format, &article.Category_ID, &article.Slug, &article.Favorites, &article.Comment_Count, &tags, &snippet)
+		article.Tags = splitTags(tags)
+		article.Snippet = fulltext.Highlight(snippet)
+		if article.Due(now) {
+			article.Status = Published
+		}
 		articles = append(articles, &article)
 	}
+	rows.Close()
 
 	return articles
 }
+
+// SetCollaborator adds the user to the article or changes their role on it.
+func (repo *Repo) SetCollaborator(collaborator *Collaborator) error {
+	stmt, err := repo.DB.Prepare(`
+	INSERT INTO 
+	article_collaborators (article_id, user_id, role, created_at) 
+	values (?, ?, ?, ?) 
+	ON CONFLICT (article_id, user_id) DO UPDATE SET role = excluded.role`)
+
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+
+	defer stmt.Close()
+
+	_, err = stmt.Exec(collaborator.Article_ID, collaborator.User_ID, collaborator.Role, collaborator.Created_At)
+	if err != nil {
+		log.Println(err)
+	}
+
+	return err
+}
+
+func (repo *Repo) RemoveCollaborator(id int64, userID int64) error {
+	stmt, err := repo.DB.Prepare("DELETE FROM article_collaborators WHERE article_id = ? AND user_id = ?")
+
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+
+	defer stmt.Close()
+
+	result, err := stmt.Exec(id, userID)
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+
+	if affected, err := result.RowsAffected(); err != nil {
+		log.Println(err)
+		return err
+	} else if affected == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
+
+func (repo *Repo) GetCollaborators(id int64) []*Collaborator {
+	collaborators := []*Collaborator{}
+
+	rows, err := repo.DB.Query(`
+	SELECT article_id, user_id, role, created_at 
+	FROM article_collaborators WHERE article_id = ? ORDER BY created_at`, id)
+
+	if err != nil {
+		log.Println(err)
+		return collaborators
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var collaborator Collaborator
+		rows.Scan(&collaborator.Article_ID, &collaborator.User_ID, &collaborator.Role, &collaborator.Created_At)
+		collaborators = append(collaborators, &collaborator)
+	}
+
+	return collaborators
+}
+
+func (repo *Repo) IsCollaborator(id int64, userID int64) bool {
+	stmt, err := repo.DB.Prepare("SELECT 1 FROM article_collaborators WHERE article_id = ? AND user_id = ?")
+	if err != nil {
+		log.Println(err)
+		return false
+	}
+	defer stmt.Close()
+
+	var isCollaborator bool
+	err = stmt.QueryRow(id, userID).Scan(&isCollaborator)
+
+	return err == nil
+}
@@ -0,0 +1,91 @@
+package audit
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/go-chi/render"
+)
+
+// Actions recorded in the audit log.
+const (
+	UserDelete        = "user.delete"
+	UserUpdateName    = "user.update_name"
+	UserUpdateImage   = "user.update_image"
+	UserDisableTOTP   = "user.disable_totp"
+	UserUnlock        = "user.unlock"
+	UserSuspend       = "user.suspend"
+	UserUnsuspend     = "user.unsuspend"
+	RoleCreate        = "role.create"
+	RoleUpdate        = "role.update"
+	RoleDelete        = "role.delete"
+	RoleSetDefault    = "role.set_default"
+	RoleAssign        = "role.assign"
+	ArticleUpdate     = "article.update"
+	ArticleDelete     = "article.delete"
+	ArticleSetStatus  = "article.set_status"
+	ArticleRestore    = "article.restore_revision"
+	CollaboratorSet   = "article.set_collaborator"
+	CollaboratorUnset = "article.remove_collaborator"
+	CommentUpdate     = "comment.update"
+	CommentDelete     = "comment.delete"
+	TagRename         = "tag.rename"
+	TagMerge          = "tag.merge"
+	TagDelete         = "tag.delete"
+	CategoryCreate    = "category.create"
+	CategoryUpdate    = "category.update"
+	CategoryDelete    = "category.delete"
+)
+
+// Target types of the audit log.
+const (
+	TargetUser     = "user"
+	TargetRole     = "role"
+	TargetArticle  = "article"
+	TargetComment  = "comment"
+	TargetTag      = "tag"
+	TargetCategory = "category"
+)
+
+// Entry is a privileged action. Before and After are JSON snapshots of the
+// target, null when it didn't exist or there is nothing worth keeping.
+type Entry struct {
+	ID          int64           `json:"id"`
+	Actor_ID    int64           `json:"actor_id"`
+	Action      string          `json:"action"`
+	Target_Type string          `json:"target_type"`
+	Target_ID   int64           `json:"target_id"`
+	Before      json.RawMessage `json:"before"`
+	After       json.RawMessage `json:"after"`
+	Request_ID  string          `json:"request_id"`
+	Created_At  int64           `json:"created_at"`
+}
+
+// Snapshot encodes a target for Before or After, nil stays null.
+func Snapshot(target interface{}) json.RawMessage {
+	if target == nil {
+		return nil
+	}
+	data, err := json.Marshal(target)
+	if err != nil || string(data) == "null" {
+		return nil
+	}
+	return data
+}
+
+type EntryPayload struct {
+	*Entry
+}
+
+func NewEntryListPayload(entries []*Entry) []render.Renderer {
+	list := []render.Renderer{}
+	for _, entry := range entries {
+		list = append(list, &EntryPayload{Entry: entry})
+	}
+	return list
+}
+
+func (e *EntryPayload) Render(w http.ResponseWriter, r *http.Request) error {
+	//do stuff on payload before send
+	return nil
+}
@@ -0,0 +1,189 @@
+package audit
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+)
+
+const ENTRIES_IN_PAGE = 20
+
+type Search struct {
+	query         string
+	params        []interface{}
+	isConditioned bool
+}
+
+func NewSearch() *Search {
+	return &Search{
+		query: `SELECT id, actor_id, action, target_type, target_id,
+		before, after, request_id, created_at
+		FROM audit_log `,
+		params:        []interface{}{},
+		isConditioned: false,
+	}
+}
+
+func (s *Search) ApplyCondition() {
+	if s.isConditioned {
+		s.query += `AND `
+	} else {
+		s.query += `WHERE `
+		s.isConditioned = true
+	}
+}
+
+func (s *Search) QueryDate(from int64, to int64) {
+	if to > 0 {
+		s.ApplyCondition()
+		s.query += `created_at >= ? AND created_at <= ? `
+		s.params = append(s.params, from, to)
+	}
+}
+
+func (s *Search) QueryActorID(actorID string) {
+	if actorID != "" {
+		s.ApplyCondition()
+		s.query += `actor_id = ? `
+		s.params = append(s.params, actorID)
+	}
+}
+
+// QueryAction matches an action, or every action of a kind when it ends with a dot like "role.".
+func (s *Search) QueryAction(action string) {
+	if action != "" {
+		s.ApplyCondition()
+		if action[len(action)-1] == '.' {
+			s.query += `action LIKE ? `
+			action += "%"
+		} else {
+			s.query += `action = ? `
+		}
+		s.params = append(s.params, action)
+	}
+}
+
+func (s *Search) QueryTarget(targetType string, targetID string) {
+	if targetType != "" {
+		s.ApplyCondition()
+		s.query += `target_type = ? `
+		s.params = append(s.params, targetType)
+	}
+	if targetID != "" {
+		s.ApplyCondition()
+		s.query += `target_id = ? `
+		s.params = append(s.params, targetID)
+	}
+}
+
+func (s *Search) QueryRequestID(requestID string) {
+	if requestID != "" {
+		s.ApplyCondition()
+		s.query += `request_id = ? `
+		s.params = append(s.params, requestID)
+	}
+}
+
+func (s *Search) Limit(page int) {
+	from := (page - 1) * ENTRIES_IN_PAGE
+	s.query += `ORDER BY id DESC LIMIT ?, ?`
+	s.params = append(s.params, from, ENTRIES_IN_PAGE)
+}
+
+type Repo struct {
+	DB *sql.DB
+}
+
+func NewRepo(db *sql.DB) *Repo {
+	return &Repo{
+		DB: db,
+	}
+}
+
+// rawOrNull keeps empty snapshots NULL in the table.
+func rawOrNull(raw json.RawMessage) interface{} {
+	if raw == nil {
+		return nil
+	}
+	return string(raw)
+}
+
+// Add appends an entry, there is no way to change one afterwards.
+func (repo *Repo) Add(entry *Entry) (int64, error) {
+	stmt, err := repo.DB.Prepare(`
+	INSERT INTO
+	audit_log (actor_id, action, target_type, target_id, before, after, request_id, created_at)
+	values (?, ?, ?, ?, ?, ?, ?, ?)`)
+
+	if err != nil {
+		log.Println(err)
+		return 0, err
+	}
+
+	defer stmt.Close()
+
+	result, err := stmt.Exec(entry.Actor_ID, entry.Action, entry.Target_Type, entry.Target_ID,
+		rawOrNull(entry.Before), rawOrNull(entry.After), entry.Request_ID, entry.Created_At)
+	if err != nil {
+		log.Println(err)
+		return 0, err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		log.Println(err)
+		return 0, err
+	}
+
+	return id, nil
+}
+
+func (repo *Repo) GetMultiple(search *Search) []*Entry {
+	entries := []*Entry{}
+
+	rows, err := repo.DB.Query(search.query, search.params...)
+	if err != nil {
+		log.Println(err)
+		return entries
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		entry := &Entry{}
+		var before, after sql.NullString
+		err = rows.Scan(&entry.ID, &entry.Actor_ID, &entry.Action, &entry.Target_Type, &entry.Target_ID,
+			&before, &after, &entry.Request_ID, &entry.Created_At)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		if before.Valid {
+			entry.Before = json.RawMessage(before.String)
+		}
+		if after.Valid {
+			entry.After = json.RawMessage(after.String)
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries
+}
+
+// Purge deletes the entries older than the given unix time, the only
+// deletion the log allows. A trigger refuses the ones within the retention.
+func (repo *Repo) Purge(before int64) (int64, error) {
+	result, err := repo.DB.Exec("DELETE FROM audit_log WHERE created_at < ?", before)
+	if err != nil {
+		log.Println(err)
+		return 0, err
+	}
+
+	purged, err := result.RowsAffected()
+	if err != nil {
+		log.Println(err)
+		return 0, err
+	}
+
+	return purged, nil
+}
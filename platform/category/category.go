@@ -0,0 +1,66 @@
+package category
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/go-chi/render"
+)
+
+var (
+	ErrExists = errors.New("A category with this name already exists there.")
+	ErrCycle  = errors.New("A category can't be moved under itself.")
+)
+
+// Category groups articles. Categories nest, a Parent_ID of 0 is a top level one.
+type Category struct {
+	ID            int64  `json:"id"`
+	Name          string `json:"name"`
+	Parent_ID     int64  `json:"parent_id"`
+	Created_At    int64  `json:"created_at"`
+	Article_Count int64  `json:"article_count"` // published ones right in it, not in its subcategories.
+}
+
+type CategoryPayload struct {
+	*Category
+}
+
+func NewCategoryPayload(category *Category) *CategoryPayload {
+	return &CategoryPayload{Category: category}
+}
+
+func NewCategoryListPayload(categories []*Category) []render.Renderer {
+	list := []render.Renderer{}
+	for _, category := range categories {
+		list = append(list, NewCategoryPayload(category))
+	}
+	return list
+}
+
+func (c *CategoryPayload) Bind(r *http.Request) error {
+	//do stuff on payload after 'receive and decode' but before binding data
+	if c.Category == nil {
+		return errors.New("missing required Category fields.")
+	}
+
+	c.Name = strings.TrimSpace(c.Name)
+	if length := utf8.RuneCountInString(c.Name); length < 1 || length > 64 {
+		return errors.New("Name must be between 1 and 64 characters.")
+	}
+
+	if c.Parent_ID < 0 {
+		return errors.New("Invalid parent id.")
+	}
+
+	c.Created_At = time.Now().Unix()
+
+	return nil
+}
+
+func (c *CategoryPayload) Render(w http.ResponseWriter, r *http.Request) error {
+	//do stuff on payload before send
+	return nil
+}
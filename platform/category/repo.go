@@ -0,0 +1,214 @@
+package category
+
+import (
+	"context"
+	"database/sql"
+	"go-blog/platform/article"
+	"log"
+	"time"
+)
+
+// selectCategories counts the published articles of each category.
+const selectCategories = `SELECT id, name, parent_id, created_at,
+	(SELECT COUNT(*) FROM articles WHERE category_id = categories.id
+		AND ` + article.PublishedCondition + `) article_count
+	FROM categories `
+
+type Repo struct {
+	DB *sql.DB
+}
+
+func NewRepo(db *sql.DB) *Repo {
+	return &Repo{
+		DB: db,
+	}
+}
+
+// GetAll lists every category by name, clients nest them with Parent_ID.
+func (repo *Repo) GetAll() []*Category {
+	categories := []*Category{}
+
+	rows, err := repo.DB.Query(selectCategories+`ORDER BY name`, time.Now().Unix())
+	if err != nil {
+		log.Println(err)
+		return categories
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var category Category
+		rows.Scan(&category.ID, &category.Name, &category.Parent_ID, &category.Created_At, &category.Article_Count)
+		categories = append(categories, &category)
+	}
+
+	return categories
+}
+
+func (repo *Repo) GetByID(id int64) (*Category, error) {
+	category := &Category{}
+
+	err := repo.DB.QueryRow(selectCategories+`WHERE id = ?`, time.Now().Unix(), id).Scan(&category.ID,
+		&category.Name, &category.Parent_ID, &category.Created_At, &category.Article_Count)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Println(err)
+		}
+		return nil, err
+	}
+
+	return category, nil
+}
+
+// check makes sure, after the category was written in tx, that the parent
+// exists, the name is free under it and that the parent isn't the category or
+// one of its own. Writing first takes the database's write lock, so two moves
+// can't each pass the check and make a cycle together.
+func check(ctx context.Context, tx *sql.Tx, category *Category) error {
+	var exists bool
+	if category.Parent_ID != 0 {
+		err := tx.QueryRowContext(ctx, "SELECT 1 FROM categories WHERE id = ?", category.Parent_ID).Scan(&exists)
+		if err != nil {
+			if err != sql.ErrNoRows {
+				log.Println(err)
+			}
+			return err
+		}
+
+		var within bool
+		err = tx.QueryRowContext(ctx, `
+		WITH RECURSIVE sub(id) AS (SELECT ? UNION SELECT categories.id FROM categories JOIN sub ON categories.parent_id = sub.id)
+		SELECT 1 FROM sub WHERE id = ?`, category.ID, category.Parent_ID).Scan(&within)
+		if err == nil {
+			return ErrCycle
+		} else if err != sql.ErrNoRows {
+			log.Println(err)
+			return err
+		}
+	}
+
+	err := tx.QueryRowContext(ctx, "SELECT 1 FROM categories WHERE parent_id = ? AND name = ? AND id != ?",
+		category.Parent_ID, category.Name, category.ID).Scan(&exists)
+	if err == nil {
+		return ErrExists
+	} else if err != sql.ErrNoRows {
+		log.Println(err)
+		return err
+	}
+
+	return nil
+}
+
+func (repo *Repo) Add(category *Category) (int64, error) {
+	ctx := context.Background()
+
+	tx, err := repo.DB.BeginTx(ctx, nil)
+	if err != nil {
+		log.Println(err)
+		return 0, err
+	}
+
+	result, err := tx.ExecContext(ctx, `
+	INSERT INTO
+	categories (name, parent_id, created_at)
+	values (?, ?, ?)`, category.Name, category.Parent_ID, category.Created_At)
+	if err != nil {
+		log.Println(err)
+		tx.Rollback()
+		return 0, err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		log.Println(err)
+		tx.Rollback()
+		return 0, err
+	}
+
+	added := *category
+	added.ID = id
+	if err = check(ctx, tx, &added); err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		log.Println(err)
+		return 0, err
+	}
+
+	return id, nil
+}
+
+// Update renames the category or moves it under another parent.
+func (repo *Repo) Update(category *Category) error {
+	ctx := context.Background()
+
+	tx, err := repo.DB.BeginTx(ctx, nil)
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, "UPDATE categories SET name = ?, parent_id = ? WHERE id = ?",
+		category.Name, category.Parent_ID, category.ID)
+	if err != nil {
+		log.Println(err)
+		tx.Rollback()
+		return err
+	}
+
+	if err = check(ctx, tx, category); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+
+	return nil
+}
+
+// Delete removes the category, its articles and subcategories move up to its parent.
+func (repo *Repo) Delete(category *Category) error {
+	ctx := context.Background()
+
+	tx, err := repo.DB.BeginTx(ctx, nil)
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, "UPDATE articles SET category_id = ? WHERE category_id = ?", category.Parent_ID, category.ID)
+	if err != nil {
+		log.Println(err)
+		tx.Rollback()
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, "UPDATE categories SET parent_id = ? WHERE parent_id = ?", category.Parent_ID, category.ID)
+	if err != nil {
+		log.Println(err)
+		tx.Rollback()
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, "DELETE FROM categories WHERE id = ?", category.ID)
+	if err != nil {
+		log.Println(err)
+		tx.Rollback()
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+
+	return nil
+}
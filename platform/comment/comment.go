@@ -10,22 +10,35 @@ import (
 	"github.com/go-chi/render"
 )
 
+// DeletedBody stands for the body of a deleted comment that has replies.
+const DeletedBody = "deleted comment"
+
 type Comment struct {
-	ID         int64  `json:"id"`
-	User_ID    int64  `json:"-"`
-	Article_ID int64  `json:"article_id,omitempty"`
-	Body       string `json:"body"`
-	Created_At int64  `json:"created_at"`
-	Updated_At int64  `json:"updated_at"`
+	ID          int64  `json:"id"`
+	User_ID     int64  `json:"-"`
+	Article_ID  int64  `json:"article_id,omitempty"`
+	Body        string `json:"body"`
+	Created_At  int64  `json:"created_at"`
+	Updated_At  int64  `json:"updated_at"`
+	Shadowed    bool   `json:"-"`                 // posted while the user was shadow banned.
+	Parent_ID   int64  `json:"parent_id"`         // the comment it replies to, 0 if it replies to the article.
+	Deleted     bool   `json:"deleted"`           // kept as a tombstone for its replies.
+	Reply_Count int64  `json:"reply_count"`       // direct replies, the ones the caller can get.
+	Snippet     string `json:"snippet,omitempty"` // HTML of where the body matches a search, matches in <mark>.
 }
 
 type CommentPayload struct {
 	*Comment
-	User *user.UserPayload `json:"user,omitempty"`
+	User    *user.UserPayload `json:"user,omitempty"`
+	Replies []*CommentPayload `json:"replies,omitempty"`
 }
 
 func NewCommentPayload(comment *Comment, userRepo *user.Repo, roleRepo *role.Repo) *CommentPayload {
 	payload := &CommentPayload{Comment: comment}
+	if comment.Deleted {
+		comment.Body = DeletedBody
+		return payload
+	}
 	if payload.User == nil && userRepo != nil {
 		if userTemp, err := userRepo.GetByID(comment.User_ID); err == nil {
 			payload.User = user.NewUserPayload(userTemp, roleRepo)
@@ -45,6 +58,30 @@ func NewCommentListPayload(comments []*Comment, includeArticleID bool, userRepo
 	return list
 }
 
+// NewCommentTreePayload nests the replies under the comments they reply to,
+// in the order they are given. Replies whose parent isn't there are left out.
+func NewCommentTreePayload(comments []*Comment, replies []*Comment, userRepo *user.Repo, roleRepo *role.Repo) []render.Renderer {
+	list := []render.Renderer{}
+	payloads := map[int64]*CommentPayload{}
+	for _, comment := range comments {
+		comment.Article_ID = 0
+		payloads[comment.ID] = NewCommentPayload(comment, userRepo, roleRepo)
+		list = append(list, payloads[comment.ID])
+	}
+
+	for _, reply := range replies {
+		reply.Article_ID = 0
+		payloads[reply.ID] = NewCommentPayload(reply, userRepo, roleRepo)
+	}
+	for _, reply := range replies {
+		if parent, ok := payloads[reply.Parent_ID]; ok {
+			parent.Replies = append(parent.Replies, payloads[reply.ID])
+		}
+	}
+
+	return list
+}
+
 func (c *CommentPayload) Bind(r *http.Request) error {
 	//do stuff on payload after 'receive and decode' but before binding data
 	if c.Comment == nil {
@@ -1,26 +1,108 @@
 package comment
 
 import (
+	"context"
 	"database/sql"
+	"go-blog/platform/article"
+	"go-blog/platform/fulltext"
 	"log"
+	"strings"
+	"time"
 )
 
 const COMMENTS_IN_PAGE = 10
 
+// REPLY_DEPTH is how many levels of replies are nested under the comments
+// listed when no depth is asked, MAX_REPLY_DEPTH the most that can be.
+const (
+	REPLY_DEPTH     = 3
+	MAX_REPLY_DEPTH = 10
+)
+
+// REPLIES_IN_THREAD bounds how many replies are nested under each comment listed.
+const REPLIES_IN_THREAD = 200
+
+// commentColumns are listed for each comment, the count of its direct replies
+// follows them.
+const commentColumns = `SELECT id, user_id, article_id, comments.body, created_at, updated_at, shadowed, parent_id, deleted`
+
+// visibleTo is the condition for a comment of 'table' to be seen by the user
+// in the parameter. Tombstones have no author anymore, shadowed ones are left
+// to those who see all comments.
+func visibleTo(table string) string {
+	return `(` + table + `.shadowed = 0 OR (` + table + `.user_id = ? AND ` + table + `.deleted = 0))`
+}
+
 type Search struct {
-	query         string
+	query         string // the conditions and order, sql puts the columns and tables around them.
 	params        []interface{}
 	isConditioned bool
+	match         string // the full-text terms searched, the index is joined to rank and snip the matches.
+	hidden        bool   // QueryVisibleTo hides the shadowed comments of others, from reply counts too.
+	visibleTo     int64
+	threads       []int64 // the comments QueryRepliesTo follows the replies of, depth levels down.
+	depth         int
+	perThread     bool // LimitReplies bounds the replies of each thread.
 }
 
 func NewSearch() *Search {
 	return &Search{
-		query:         `SELECT * FROM comments `,
 		params:        []interface{}{},
 		isConditioned: false,
 	}
 }
 
+// sql is the whole query of the search with its parameters. Searching by
+// keyword joins the full-text index once, for the match, its rank and the
+// snippet. Following replies joins them to the thread they are in, to
+// number them in it for LimitReplies.
+func (s *Search) sql() (string, []interface{}) {
+	query, params := "", []interface{}{}
+	if s.threads != nil {
+		query += `WITH RECURSIVE thread(reply_id, root, depth) AS (
+		SELECT id, parent_id, 1 FROM comments WHERE parent_id IN (` + strings.TrimSuffix(strings.Repeat("?, ", len(s.threads)), ", ") + `)
+		UNION ALL SELECT comments.id, thread.root, thread.depth + 1 FROM comments JOIN thread ON comments.parent_id = thread.reply_id
+		WHERE thread.depth < ?) `
+		for _, id := range s.threads {
+			params = append(params, id)
+		}
+		params = append(params, s.depth)
+	}
+
+	// the replies counted are the ones the caller would get asking for them.
+	columns := commentColumns + `,
+	(SELECT COUNT(*) FROM comments replies WHERE replies.parent_id = comments.id`
+	if s.hidden {
+		columns += ` AND ` + visibleTo("replies")
+		params = append(params, s.visibleTo)
+	}
+	columns += `) reply_count, `
+
+	if s.match == "" {
+		columns += `'' snippet`
+	} else {
+		columns += `snippet(comments_fts, 0, '` + fulltext.MarkOpen + `', '` + fulltext.MarkClose + `', '…', 24) snippet`
+	}
+
+	from := ` FROM comments `
+	if s.match != "" {
+		from += `JOIN comments_fts ON comments_fts.rowid = comments.id `
+	}
+	if s.threads != nil {
+		from += `JOIN thread ON thread.reply_id = comments.id `
+	}
+
+	if !s.perThread {
+		return query + columns + from + s.query, append(params, s.params...)
+	}
+
+	// window functions come after the conditions, so only what the caller
+	// sees takes a place in the thread.
+	return query + `SELECT id, user_id, article_id, body, created_at, updated_at, shadowed, parent_id, deleted, reply_count, snippet 
+	FROM (` + columns + `, ROW_NUMBER() OVER (PARTITION BY thread.root ORDER BY created_at, id) place` + from + s.query + `) 
+	WHERE place <= ? ORDER BY created_at, id`, append(params, s.params...)
+}
+
 func (s *Search) ApplyCondition() {
 	if s.isConditioned {
 		s.query += `AND `
@@ -38,12 +120,20 @@ func (s *Search) QueryDate(from int64, to int64) {
 	}
 }
 
+// QueryKeyword keeps the comments matching the search, see fulltext.Parse
+// for its syntax.
 func (s *Search) QueryKeyword(keyword string) {
-	if keyword != "" {
+	query := fulltext.Parse(keyword)
+	if query.Match != "" {
+		s.ApplyCondition()
+		s.query += `comments_fts MATCH ? `
+		s.params = append(s.params, query.Match)
+		s.match = query.Match
+	}
+	if query.Exclude != "" {
 		s.ApplyCondition()
-		keyword = "%" + keyword + "%"
-		s.query += `body LIKE ? `
-		s.params = append(s.params, keyword)
+		s.query += `id NOT IN (SELECT rowid FROM comments_fts WHERE comments_fts MATCH ?) `
+		s.params = append(s.params, query.Exclude)
 	}
 }
 
@@ -55,18 +145,70 @@ func (s *Search) QueryUserID(userID string) {
 	}
 }
 
+// QueryVisibleTo hides shadowed comments from everyone but their author.
+func (s *Search) QueryVisibleTo(userID int64) {
+	s.ApplyCondition()
+	s.query += visibleTo("comments") + ` `
+	s.params = append(s.params, userID)
+	s.hidden = true
+	s.visibleTo = userID
+}
+
+// QueryPublished leaves out the comments of articles that aren't published.
+func (s *Search) QueryPublished() {
+	s.ApplyCondition()
+	s.query += `article_id IN (SELECT id FROM articles WHERE ` + article.PublishedCondition + `) `
+	s.params = append(s.params, time.Now().Unix())
+}
+
+// QueryParentID keeps the replies to the comment, or with 0 the comments
+// that reply to the article itself.
+func (s *Search) QueryParentID(parentID int64) {
+	s.ApplyCondition()
+	s.query += `parent_id = ? `
+	s.params = append(s.params, parentID)
+}
+
+// QueryRepliesTo keeps the replies to the comments, the replies to those
+// and so on, depth levels down. Each comment starts a thread.
+func (s *Search) QueryRepliesTo(ids []int64, depth int) {
+	s.threads = append([]int64{}, ids...)
+	s.depth = depth
+}
+
+func (s *Search) QueryID(id int64) {
+	s.ApplyCondition()
+	s.query += `id = ? `
+	s.params = append(s.params, id)
+}
+
 func (s *Search) QueryArticleID(articleID int64) {
 	s.ApplyCondition()
 	s.query += `article_id = ? `
 	s.params = append(s.params, articleID)
 }
 
-func (s *Search) Limit(page int) {
+// Limit sorts the newest first, or the best matches of the search first
+// when sort is "relevance".
+func (s *Search) Limit(page int, sort string) {
 	from := (page - 1) * COMMENTS_IN_PAGE
-	s.query += `ORDER BY created_at DESC LIMIT ?, ?`
+	if sort == "relevance" && s.match != "" {
+		s.query += `ORDER BY bm25(comments_fts), created_at DESC `
+	} else {
+		s.query += `ORDER BY created_at DESC `
+	}
+	s.query += `LIMIT ?, ?`
 	s.params = append(s.params, from, COMMENTS_IN_PAGE)
 }
 
+// LimitReplies keeps the first REPLIES_IN_THREAD replies of each thread
+// QueryRepliesTo follows, oldest first as they are read. A reply is never
+// older than what it replies to, so the ones kept have their parents.
+func (s *Search) LimitReplies() {
+	s.perThread = true
+	s.params = append(s.params, REPLIES_IN_THREAD)
+}
+
 type Repo struct {
 	DB *sql.DB
 }
@@ -77,17 +219,46 @@ func NewRepo(db *sql.DB) *Repo {
 	}
 }
 
-func (repo *Repo) Delete(id int64) error {
-	stmt, err := repo.DB.Prepare("DELETE FROM comments WHERE id = ?")
+// Delete removes the comment. One that has replies stays as a tombstone
+// without its body and author, so the replies keep their place, until the
+// last of them is deleted too.
+func (repo *Repo) Delete(comment *Comment) error {
+	ctx := context.Background()
 
+	tx, err := repo.DB.BeginTx(ctx, nil)
 	if err != nil {
 		log.Println(err)
 		return err
 	}
 
-	defer stmt.Close()
+	_, err = tx.ExecContext(ctx, "UPDATE comments SET body = '', user_id = 0, deleted = 1 WHERE id = ?", comment.ID)
+	if err != nil {
+		log.Println(err)
+		tx.Rollback()
+		return err
+	}
+
+	// Removing a tombstone can leave its parent tombstone without replies.
+	for {
+		result, err := tx.ExecContext(ctx, `DELETE FROM comments WHERE article_id = ? AND deleted = 1 
+		AND NOT EXISTS (SELECT 1 FROM comments replies WHERE replies.parent_id = comments.id)`, comment.Article_ID)
+		if err != nil {
+			log.Println(err)
+			tx.Rollback()
+			return err
+		}
+
+		if removed, err := result.RowsAffected(); err != nil {
+			log.Println(err)
+			tx.Rollback()
+			return err
+		} else if removed == 0 {
+			break
+		}
+	}
 
-	if _, err = stmt.Exec(id); err != nil {
+	err = tx.Commit()
+	if err != nil {
 		log.Println(err)
 		return err
 	}
@@ -118,8 +289,8 @@ func (repo *Repo) Update(comment *Comment) error {
 func (repo *Repo) Add(comment *Comment) (int64, error) {
 	stmt, err := repo.DB.Prepare(`
 	INSERT INTO 
-	comments (user_id,  article_id, body, created_at, updated_at) 
-	values (?, ?, ?, ?, ?)`)
+	comments (user_id,  article_id, body, created_at, updated_at, shadowed, parent_id) 
+	values (?, ?, ?, ?, ?, ?, ?)`)
 
 	if err != nil {
 		log.Println(err)
@@ -128,7 +299,8 @@ func (repo *Repo) Add(comment *Comment) (int64, error) {
 
 	defer stmt.Close()
 
-	result, err := stmt.Exec(comment.User_ID, comment.Article_ID, comment.Body, comment.Created_At, comment.Updated_At)
+	result, err := stmt.Exec(comment.User_ID, comment.Article_ID, comment.Body, comment.Created_At, comment.Updated_At, comment.Shadowed,
+		comment.Parent_ID)
 	if err != nil {
 		log.Println(err)
 		return 0, err
@@ -142,44 +314,50 @@ func (repo *Repo) Add(comment *Comment) (int64, error) {
 	return id, err
 }
 
+// GetByID loads the comment with all its replies counted, a Search with
+// QueryVisibleTo counts the ones a caller can get.
 func (repo *Repo) GetByID(id int64) (*Comment, error) {
 	comment := &Comment{}
 
-	stmt, err := repo.DB.Prepare("SELECT * FROM comments WHERE ID = ?")
-
-	if err != nil {
-		log.Println(err)
-		return nil, err
-	}
-
-	defer stmt.Close()
+	search := NewSearch()
+	search.QueryID(id)
+	query, params := search.sql()
 
-	err = stmt.QueryRow(id).Scan(&comment.ID, &comment.User_ID,
-		&comment.Article_ID, &comment.Body, &comment.Created_At, &comment.Updated_At)
+	var snippet string
+	err := repo.DB.QueryRow(query, params...).Scan(&comment.ID, &comment.User_ID,
+		&comment.Article_ID, &comment.Body, &comment.Created_At, &comment.Updated_At, &comment.Shadowed,
+		&comment.Parent_ID, &comment.Deleted, &comment.Reply_Count, &snippet)
 
 	if err != nil {
-		log.Println(err)
+		if err != sql.ErrNoRows {
+			log.Println(err)
+		}
 		return nil, err
 	}
 
-	return comment, err
+	return comment, nil
 }
 
 func (repo *Repo) GetMultiple(search *Search) []*Comment {
 	comments := []*Comment{}
 
-	rows, err := repo.DB.Query(search.query, search.params...)
-
+	query, params := search.sql()
+	rows, err := repo.DB.Query(query, params...)
 	if err != nil {
 		log.Println(err)
+		return comments
 	}
 
 	for rows.Next() {
 		var comment Comment
+		var snippet string
 		rows.Scan(&comment.ID, &comment.User_ID,
-			&comment.Article_ID, &comment.Body, &comment.Created_At, &comment.Updated_At)
+			&comment.Article_ID, &comment.Body, &comment.Created_At, &comment.Updated_At, &comment.Shadowed,
+			&comment.Parent_ID, &comment.Deleted, &comment.Reply_Count, &snippet)
+		comment.Snippet = fulltext.Highlight(snippet)
 		comments = append(comments, &comment)
 	}
+	rows.Close()
 
 	return comments
 }
@@ -0,0 +1,108 @@
+package diff
+
+import "strings"
+
+const (
+	Equal  = "="
+	Delete = "-"
+	Insert = "+"
+)
+
+// Line is a line of a diff, Op tells whether both texts have it, only the
+// old one or only the new one.
+type Line struct {
+	Op   string `json:"op"`
+	Text string `json:"text"`
+}
+
+// maxCells bounds the table used to match lines, texts that differ more than
+// that are shown as replaced as a whole.
+const maxCells = 4 << 20
+
+// Lines diffs two texts line by line, keeping as many lines as possible.
+func Lines(old string, new string) []Line {
+	a, b := split(old), split(new)
+	lines := []Line{}
+
+	// What both start and end with doesn't need matching.
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+
+	for _, text := range a[:prefix] {
+		lines = append(lines, Line{Equal, text})
+	}
+	lines = append(lines, match(a[prefix:len(a)-suffix], b[prefix:len(b)-suffix])...)
+	for _, text := range a[len(a)-suffix:] {
+		lines = append(lines, Line{Equal, text})
+	}
+
+	return lines
+}
+
+// match diffs with the longest common subsequence of the lines.
+func match(a []string, b []string) []Line {
+	lines := []Line{}
+	n, m := len(a), len(b)
+
+	if (n+1)*(m+1) > maxCells {
+		for _, text := range a {
+			lines = append(lines, Line{Delete, text})
+		}
+		for _, text := range b {
+			lines = append(lines, Line{Insert, text})
+		}
+		return lines
+	}
+
+	// common[i*(m+1)+j] is the length of the longest common subsequence of a[i:] and b[j:].
+	common := make([]int32, (n+1)*(m+1))
+	for i := n - 1; i >= 0; i-- {
+		for j := m - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				common[i*(m+1)+j] = common[(i+1)*(m+1)+j+1] + 1
+			} else if down, right := common[(i+1)*(m+1)+j], common[i*(m+1)+j+1]; down >= right {
+				common[i*(m+1)+j] = down
+			} else {
+				common[i*(m+1)+j] = right
+			}
+		}
+	}
+
+	i, j := 0, 0
+	for i < n && j < m {
+		switch {
+		case a[i] == b[j]:
+			lines = append(lines, Line{Equal, a[i]})
+			i++
+			j++
+		case common[(i+1)*(m+1)+j] >= common[i*(m+1)+j+1]:
+			lines = append(lines, Line{Delete, a[i]})
+			i++
+		default:
+			lines = append(lines, Line{Insert, b[j]})
+			j++
+		}
+	}
+	for ; i < n; i++ {
+		lines = append(lines, Line{Delete, a[i]})
+	}
+	for ; j < m; j++ {
+		lines = append(lines, Line{Insert, b[j]})
+	}
+
+	return lines
+}
+
+func split(text string) []string {
+	text = strings.TrimSuffix(strings.Replace(text, "\r\n", "\n", -1), "\n")
+	if text == "" {
+		return nil
+	}
+	return strings.Split(text, "\n")
+}
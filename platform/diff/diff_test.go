@@ -0,0 +1,138 @@
+package diff
+
+import (
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+// format writes a diff as "=a -b +c" to compare it at a glance.
+func format(lines []Line) string {
+	parts := make([]string, len(lines))
+	for i, line := range lines {
+		parts[i] = line.Op + line.Text
+	}
+	return strings.Join(parts, " ")
+}
+
+func TestLines(t *testing.T) {
+	tests := []struct {
+		name string
+		old  string
+		new  string
+		want string
+	}{
+		{"both empty", "", "", ""},
+		{"same", "a\nb\nc", "a\nb\nc", "=a =b =c"},
+		{"from nothing", "", "a\nb", "+a +b"},
+		{"to nothing", "a\nb", "", "-a -b"},
+		{"line added at the end", "a\nb", "a\nb\nc", "=a =b +c"},
+		{"line added at the start", "b\nc", "a\nb\nc", "+a =b =c"},
+		{"line removed in the middle", "a\nb\nc", "a\nc", "=a -b =c"},
+		{"line changed", "a\nb\nc", "a\nx\nc", "=a -b +x =c"},
+		{"everything changed", "a\nb", "x\ny", "-a -b +x +y"},
+		{"lines moved", "a\nb\nc\nd", "c\nd\na\nb", "-a -b =c =d +a +b"},
+		{"repeated lines", "a\na\nb", "a\nb\nb", "=a -a +b =b"},
+		{"empty lines kept", "a\n\nb", "a\nb", "=a - =b"},
+		{"trailing newline ignored", "a\nb\n", "a\nb", "=a =b"},
+		{"crlf same as lf", "a\r\nb\r\n", "a\nb", "=a =b"},
+		{"spaces count", "a \nb", "a\nb", "-a  +a =b"},
+	}
+
+	for _, test := range tests {
+		if got := format(Lines(test.old, test.new)); got != test.want {
+			t.Errorf("%s: Lines = %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+// TestLinesRebuild checks on random texts that the diff gives back both
+// texts and keeps as many lines as the longest common subsequence.
+func TestLinesRebuild(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+	text := func() []string {
+		lines := make([]string, random.Intn(12))
+		for i := range lines {
+			lines[i] = string(rune('a' + random.Intn(4)))
+		}
+		return lines
+	}
+
+	for round := 0; round < 500; round++ {
+		a, b := text(), text()
+		lines := Lines(strings.Join(a, "\n"), strings.Join(b, "\n"))
+
+		var old, new []string
+		kept := 0
+		for _, line := range lines {
+			switch line.Op {
+			case Equal:
+				old, new = append(old, line.Text), append(new, line.Text)
+				kept++
+			case Delete:
+				old = append(old, line.Text)
+			case Insert:
+				new = append(new, line.Text)
+			default:
+				t.Fatalf("unknown op %q", line.Op)
+			}
+		}
+
+		if strings.Join(old, "\n") != strings.Join(a, "\n") || strings.Join(new, "\n") != strings.Join(b, "\n") {
+			t.Fatalf("%q to %q: diff %q doesn't give back the texts", a, b, format(lines))
+		}
+		if want := lcs(a, b); kept != want {
+			t.Fatalf("%q to %q: diff %q keeps %d lines, want %d", a, b, format(lines), kept, want)
+		}
+	}
+}
+
+// lcs is the length of the longest common subsequence of the lines.
+func lcs(a []string, b []string) int {
+	prev := make([]int, len(b)+1)
+	for i := range a {
+		next := make([]int, len(b)+1)
+		for j := range b {
+			switch {
+			case a[i] == b[j]:
+				next[j+1] = prev[j] + 1
+			case prev[j+1] >= next[j]:
+				next[j+1] = prev[j+1]
+			default:
+				next[j+1] = next[j]
+			}
+		}
+		prev = next
+	}
+	return prev[len(b)]
+}
+
+func TestLinesTooDifferent(t *testing.T) {
+	// over maxCells the middle is replaced as a whole, what the texts share
+	// at the start and the end is still matched.
+	n := 2100
+	a, b := []string{"start"}, []string{"start"}
+	for i := 0; i < n; i++ {
+		a = append(a, "old")
+		b = append(b, "new", "new")
+	}
+	a, b = append(a, "end"), append(b, "end")
+
+	lines := Lines(strings.Join(a, "\n"), strings.Join(b, "\n"))
+	if len(lines) != 1+n+2*n+1 {
+		t.Fatalf("got %d lines, want %d", len(lines), 1+n+2*n+1)
+	}
+	if lines[0] != (Line{Equal, "start"}) || lines[len(lines)-1] != (Line{Equal, "end"}) {
+		t.Errorf("start and end not kept: %v, %v", lines[0], lines[len(lines)-1])
+	}
+	for _, line := range lines[1 : 1+n] {
+		if line.Op != Delete {
+			t.Fatalf("old middle not deleted as a whole: %v", line)
+		}
+	}
+	for _, line := range lines[1+n : len(lines)-1] {
+		if line.Op != Insert {
+			t.Fatalf("new middle not inserted as a whole: %v", line)
+		}
+	}
+}
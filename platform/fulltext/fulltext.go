@@ -0,0 +1,109 @@
+package fulltext
+
+import (
+	"html"
+	"strings"
+	"unicode"
+)
+
+// Marks wrap the matches in snippets asked from FTS5, Highlight turns them
+// into <mark> tags once the text around them is escaped.
+const (
+	MarkOpen  = "\uE000"
+	MarkClose = "\uE001"
+)
+
+// maxTerms bounds how many terms a search can have.
+const maxTerms = 16
+
+// Query is a search turned into FTS5 MATCH expressions. Match has every term
+// the results must have and Exclude any of the terms they must not have,
+// either is empty when the search has no such terms.
+type Query struct {
+	Match   string
+	Exclude string
+}
+
+// Parse reads a search made of words, "quoted phrases", prefixes ending
+// with * and any of those starting with - to exclude them. Everything else
+// is taken as text so a search can't break the MATCH syntax.
+func Parse(search string) Query {
+	var match, exclude []string
+
+	runes := []rune(search)
+	for i := 0; i < len(runes) && len(match)+len(exclude) < maxTerms; {
+		if unicode.IsSpace(runes[i]) {
+			i++
+			continue
+		}
+
+		excluded := false
+		if runes[i] == '-' {
+			excluded = true
+			i++
+		}
+
+		var text string
+		if i < len(runes) && runes[i] == '"' {
+			end := i + 1
+			for end < len(runes) && runes[end] != '"' {
+				end++
+			}
+			text = string(runes[i+1 : end])
+			i = end + 1
+		} else {
+			end := i
+			for end < len(runes) && !unicode.IsSpace(runes[end]) && runes[end] != '"' {
+				end++
+			}
+			text = string(runes[i:end])
+			i = end
+		}
+
+		prefix := false
+		if strings.HasSuffix(text, "*") {
+			text = strings.TrimRight(text, "*")
+			prefix = true
+		} else if i < len(runes) && runes[i] == '*' {
+			prefix = true
+			i++
+		}
+
+		term := phrase(text, prefix)
+		if term == "" {
+			continue
+		}
+
+		if excluded {
+			exclude = append(exclude, term)
+		} else {
+			match = append(match, term)
+		}
+	}
+
+	return Query{
+		Match:   strings.Join(match, " "),
+		Exclude: strings.Join(exclude, " OR "),
+	}
+}
+
+// phrase quotes the text as an FTS5 string, or returns "" when it has no
+// letters or digits to search for.
+func phrase(text string, prefix bool) string {
+	if strings.IndexFunc(text, func(r rune) bool { return unicode.IsLetter(r) || unicode.IsDigit(r) }) < 0 {
+		return ""
+	}
+
+	term := `"` + strings.ReplaceAll(text, `"`, `""`) + `"`
+	if prefix {
+		term += "*"
+	}
+	return term
+}
+
+// Highlight escapes a snippet made with the marks and makes its matches <mark>.
+func Highlight(snippet string) string {
+	snippet = html.EscapeString(snippet)
+	snippet = strings.ReplaceAll(snippet, MarkOpen, "<mark>")
+	return strings.ReplaceAll(snippet, MarkClose, "</mark>")
+}
@@ -0,0 +1,76 @@
+package fulltext
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name   string
+		search string
+		want   Query
+	}{
+		{"empty", "", Query{}},
+		{"only spaces", " \t\n ", Query{}},
+		{"word", "garden", Query{`"garden"`, ""}},
+		{"words", "garden  tomatoes", Query{`"garden" "tomatoes"`, ""}},
+		{"phrase", `"green tomatoes"`, Query{`"green tomatoes"`, ""}},
+		{"prefix", "tomato*", Query{`"tomato"*`, ""}},
+		{"prefix phrase", `"green tom"*`, Query{`"green tom"*`, ""}},
+		{"more stars", "tomato**", Query{`"tomato"*`, ""}},
+		{"lone star", "tomato *", Query{`"tomato"`, ""}},
+		{"exclude", "-slugs", Query{"", `"slugs"`}},
+		{"excludes", "garden -slugs -snails", Query{`"garden"`, `"slugs" OR "snails"`}},
+		{"exclude phrase", `garden -"slug pellets"`, Query{`"garden"`, `"slug pellets"`}},
+		{"exclude prefix", "-slug*", Query{"", `"slug"*`}},
+		{"dash inside", "well-known", Query{`"well-known"`, ""}},
+		{"double dash", "--x", Query{"", `"-x"`}},
+		{"lone dash", "garden -", Query{`"garden"`, ""}},
+		{"unclosed quote", `say "hello there`, Query{`"say" "hello there"`, ""}},
+		{"quote in word", `a"b c"`, Query{`"a" "b c"`, ""}},
+		{"empty phrase", `"" garden`, Query{`"garden"`, ""}},
+		{"no letters", `*** ... "!?" -()`, Query{}},
+		{"fts5 syntax is text", "NEAR(a b) OR c:d ^e", Query{`"NEAR(a" "b)" "OR" "c:d" "^e"`, ""}},
+		{"apostrophe", "it's", Query{`"it's"`, ""}},
+		{"unicode", "café ünïcode 東京", Query{`"café" "ünïcode" "東京"`, ""}},
+	}
+
+	for _, test := range tests {
+		if got := Parse(test.search); got != test.want {
+			t.Errorf("%s: Parse(%q) = %q, want %q", test.name, test.search, got, test.want)
+		}
+	}
+}
+
+func TestParseMaxTerms(t *testing.T) {
+	search := strings.Repeat("a ", maxTerms) + "-b c"
+	got := Parse(search)
+	if want := strings.TrimSpace(strings.Repeat(`"a" `, maxTerms)); got.Match != want || got.Exclude != "" {
+		t.Errorf("Parse of %d terms = %q, want the first %d", maxTerms+2, got, maxTerms)
+	}
+
+	got = Parse(strings.Repeat("-a ", maxTerms+2))
+	if n := strings.Count(got.Exclude, " OR ") + 1; n != maxTerms {
+		t.Errorf("Parse kept %d excluded terms, want %d", n, maxTerms)
+	}
+}
+
+func TestHighlight(t *testing.T) {
+	tests := []struct {
+		snippet string
+		want    string
+	}{
+		{"", ""},
+		{"plain", "plain"},
+		{"a " + MarkOpen + "match" + MarkClose + " here", "a <mark>match</mark> here"},
+		{MarkOpen + "<b>" + MarkClose + ` & "x"`, "<mark>&lt;b&gt;</mark> &amp; &#34;x&#34;"},
+		{"<mark>not ours</mark>", "&lt;mark&gt;not ours&lt;/mark&gt;"},
+	}
+
+	for _, test := range tests {
+		if got := Highlight(test.snippet); got != test.want {
+			t.Errorf("Highlight(%q) = %q, want %q", test.snippet, got, test.want)
+		}
+	}
+}
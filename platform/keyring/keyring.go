@@ -0,0 +1,240 @@
+package keyring
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/lestrrat-go/jwx/jwa"
+	"github.com/lestrrat-go/jwx/jwk"
+	"github.com/lestrrat-go/jwx/jws"
+	"github.com/lestrrat-go/jwx/jwt"
+)
+
+var ErrUnknownKey = errors.New("token signed with an unknown key")
+
+// Key is one signing key. The file name it was loaded from is its kid.
+type Key struct {
+	ID        string
+	Algorithm jwa.SignatureAlgorithm
+	signer    jwk.Key     // nil for keys that can only verify.
+	public    interface{} // raw public key used to verify.
+}
+
+// Keyring signs tokens with one key and verifies tokens of every key it
+// holds, so keys can be rotated without invalidating tokens in flight.
+type Keyring struct {
+	keys    map[string]*Key
+	signing *Key
+}
+
+// Load reads every .pem file of dir. Private keys can sign, public keys only
+// verify. The signing key is signingID, or the last private key by name when
+// empty. A fresh Ed25519 key is written to dir if there is none to sign with.
+func Load(dir string, signingID string) (*Keyring, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	paths, err := filepath.Glob(filepath.Join(dir, "*.pem"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(paths)
+
+	ring := &Keyring{keys: map[string]*Key{}}
+	for _, path := range paths {
+		key, err := loadKey(path)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		ring.keys[key.ID] = key
+
+		if key.signer != nil && (signingID == "" || signingID == key.ID) {
+			ring.signing = key
+		}
+	}
+
+	if ring.signing == nil {
+		if signingID != "" {
+			return nil, fmt.Errorf("signing key %q not found in %s", signingID, dir)
+		}
+
+		key, err := generateKey(dir)
+		if err != nil {
+			return nil, err
+		}
+		log.Println("No signing key found, generated " + key.ID)
+		ring.keys[key.ID] = key
+		ring.signing = key
+	}
+
+	return ring, nil
+}
+
+func loadKey(path string) (*Key, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM block")
+	}
+
+	var raw interface{}
+	switch block.Type {
+	case "PRIVATE KEY":
+		raw, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		raw, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		raw, err = x509.ParseECPrivateKey(block.Bytes)
+	case "PUBLIC KEY":
+		raw, err = x509.ParsePKIXPublicKey(block.Bytes)
+	default:
+		err = fmt.Errorf("unsupported PEM block %q", block.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	id := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	return newKey(id, raw)
+}
+
+func newKey(id string, raw interface{}) (*Key, error) {
+	key := &Key{ID: id, public: raw}
+
+	if signer, ok := raw.(crypto.Signer); ok {
+		key.public = signer.Public()
+
+		jwkKey, err := jwk.New(raw)
+		if err != nil {
+			return nil, err
+		}
+		if err = jwkKey.Set(jwk.KeyIDKey, id); err != nil {
+			return nil, err
+		}
+		key.signer = jwkKey
+	}
+
+	switch public := key.public.(type) {
+	case *rsa.PublicKey:
+		key.Algorithm = jwa.RS256
+	case *ecdsa.PublicKey:
+		switch public.Curve {
+		case elliptic.P256():
+			key.Algorithm = jwa.ES256
+		case elliptic.P384():
+			key.Algorithm = jwa.ES384
+		case elliptic.P521():
+			key.Algorithm = jwa.ES512
+		default:
+			return nil, errors.New("unsupported curve")
+		}
+	case ed25519.PublicKey:
+		key.Algorithm = jwa.EdDSA
+	default:
+		return nil, fmt.Errorf("unsupported key type %T", key.public)
+	}
+
+	return key, nil
+}
+
+func generateKey(dir string) (*Key, error) {
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		return nil, err
+	}
+
+	id := time.Now().UTC().Format("20060102150405")
+	path := filepath.Join(dir, id+".pem")
+	if err = ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		return nil, err
+	}
+
+	return newKey(id, private)
+}
+
+// Encode signs the claims with the signing key, its kid set in the header.
+func (ring *Keyring) Encode(claims map[string]interface{}) (string, error) {
+	token := jwt.New()
+	for k, v := range claims {
+		if err := token.Set(k, v); err != nil {
+			return "", err
+		}
+	}
+
+	signed, err := jwt.Sign(token, ring.signing.Algorithm, ring.signing.signer)
+	if err != nil {
+		return "", err
+	}
+
+	return string(signed), nil
+}
+
+// Decode verifies the token with the key named by its kid. The algorithm
+// comes from the key, never from the token header.
+func (ring *Keyring) Decode(tokenString string) (jwt.Token, error) {
+	msg, err := jws.Parse([]byte(tokenString))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(msg.Signatures()) != 1 {
+		return nil, ErrUnknownKey
+	}
+
+	key, ok := ring.keys[msg.Signatures()[0].ProtectedHeaders().KeyID()]
+	if !ok {
+		return nil, ErrUnknownKey
+	}
+
+	return jwt.Parse([]byte(tokenString), jwt.WithVerify(key.Algorithm, key.public))
+}
+
+// PublicSet returns the public half of every key, served as JWKS.
+func (ring *Keyring) PublicSet() (jwk.Set, error) {
+	ids := []string{}
+	for id := range ring.keys {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	set := jwk.NewSet()
+	for _, id := range ids {
+		key := ring.keys[id]
+
+		public, err := jwk.New(key.public)
+		if err != nil {
+			return nil, err
+		}
+		public.Set(jwk.KeyIDKey, key.ID)
+		public.Set(jwk.AlgorithmKey, key.Algorithm.String())
+		public.Set(jwk.KeyUsageKey, "sig")
+		set.Add(public)
+	}
+
+	return set, nil
+}
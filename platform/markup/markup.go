@@ -0,0 +1,129 @@
+package markup
+
+import (
+	"bytes"
+	"errors"
+	"html"
+	"regexp"
+	"strings"
+
+	"github.com/microcosm-cc/bluemonday"
+	"github.com/yuin/goldmark"
+	highlighting "github.com/yuin/goldmark-highlighting/v2"
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/extension"
+	"github.com/yuin/goldmark/parser"
+	goldmarkhtml "github.com/yuin/goldmark/renderer/html"
+	"github.com/yuin/goldmark/text"
+	"github.com/yuin/goldmark/util"
+)
+
+// Formats an article body can be written in.
+const (
+	Markdown = "markdown"
+	Plain    = "plain"
+	HTML     = "html"
+)
+
+var ErrFormat = errors.New("Format must be one of markdown, plain or html.")
+
+func IsFormat(format string) bool {
+	return format == Markdown || format == Plain || format == HTML
+}
+
+// Render turns a body into HTML that is safe to serve as it is.
+func Render(format string, source string) (string, error) {
+	switch format {
+	case Markdown:
+		var buf bytes.Buffer
+		if err := markdown.Convert([]byte(source), &buf); err != nil {
+			return "", err
+		}
+		return policy.Sanitize(buf.String()), nil
+	case Plain:
+		return plain(source), nil
+	case HTML:
+		return policy.Sanitize(source), nil
+	}
+	return "", ErrFormat
+}
+
+var blankLines = regexp.MustCompile(`\n\s*\n`)
+
+// plain escapes the text, blank lines separate paragraphs.
+func plain(source string) string {
+	var buf strings.Builder
+	source = strings.Replace(source, "\r\n", "\n", -1)
+	for _, paragraph := range blankLines.Split(source, -1) {
+		if paragraph = strings.TrimSpace(paragraph); paragraph != "" {
+			buf.WriteString("<p>" + strings.Replace(html.EscapeString(paragraph), "\n", "<br>\n", -1) + "</p>\n")
+		}
+	}
+	return buf.String()
+}
+
+// markdown is GitHub flavored, with highlighted code blocks and headings
+// that can be linked to. Raw HTML is let through for the policy to clean.
+var markdown = goldmark.New(
+	goldmark.WithExtensions(
+		extension.GFM,
+		highlighting.NewHighlighting(highlighting.WithStyle("github")),
+	),
+	goldmark.WithParserOptions(
+		parser.WithASTTransformers(util.Prioritized(headingAnchors{}, 100)),
+	),
+	goldmark.WithRendererOptions(goldmarkhtml.WithUnsafe()),
+)
+
+// headingAnchors gives every heading an id made from its text and ends it
+// with a link to itself. The parser's own ids are made from the source line,
+// raw HTML tags included.
+type headingAnchors struct{}
+
+func (headingAnchors) Transform(doc *ast.Document, reader text.Reader, pc parser.Context) {
+	source := reader.Source()
+	ast.Walk(doc, func(node ast.Node, entering bool) (ast.WalkStatus, error) {
+		heading, ok := node.(*ast.Heading)
+		if !ok || !entering {
+			return ast.WalkContinue, nil
+		}
+
+		id := pc.IDs().Generate(textContent(heading, source), ast.KindHeading)
+		heading.SetAttributeString("id", id)
+
+		anchor := ast.NewLink()
+		anchor.Destination = append([]byte("#"), id...)
+		anchor.SetAttributeString("class", []byte("anchor"))
+		anchor.AppendChild(anchor, ast.NewString([]byte("#")))
+		heading.AppendChild(heading, anchor)
+		return ast.WalkSkipChildren, nil
+	})
+}
+
+// textContent is the text a reader sees of the node, without raw HTML tags.
+func textContent(node ast.Node, source []byte) []byte {
+	var content []byte
+	for child := node.FirstChild(); child != nil; child = child.NextSibling() {
+		switch child := child.(type) {
+		case *ast.Text:
+			content = append(content, child.Segment.Value(source)...)
+		case *ast.String:
+			content = append(content, child.Value...)
+		case *ast.AutoLink:
+			content = append(content, child.Label(source)...)
+		case *ast.RawHTML:
+		default:
+			content = append(content, textContent(child, source)...)
+		}
+	}
+	return content
+}
+
+// policy is what rendered bodies may keep: the usual user content plus the
+// inline colors of highlighted code and the classes set above.
+var policy = func() *bluemonday.Policy {
+	p := bluemonday.UGCPolicy()
+	p.AllowAttrs("class").Matching(regexp.MustCompile(`^(anchor|language-[\w+#.-]+)$`)).OnElements("a", "code")
+	p.AllowStyles("color", "background-color", "font-weight", "font-style", "text-decoration").OnElements("pre", "span")
+	return p
+}()
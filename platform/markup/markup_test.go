@@ -0,0 +1,157 @@
+package markup
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// xssCorpus is markup that tries to run script, load other documents or
+// restyle the page. None of it may survive rendering as html or markdown.
+var xssCorpus = []string{
+	`<script>alert(1)</script>`,
+	`<SCRIPT SRC=https://evil.example/xss.js></SCRIPT>`,
+	`<scr<script>ipt>alert(1)</scr</script>ipt>`,
+	`<img src=x onerror=alert(1)>`,
+	`<img src="x" ONERROR="alert(1)">`,
+	`<img src=x onerror="&#97;lert(1)">`,
+	`<img src="javascript:alert(1)">`,
+	`<img """><script>alert(1)</script>">`,
+	`<svg onload=alert(1)>`,
+	`<svg><script>alert(1)</script></svg>`,
+	`<body onload=alert(1)>`,
+	`<iframe src="javascript:alert(1)"></iframe>`,
+	`<iframe srcdoc="<script>alert(1)</script>"></iframe>`,
+	`<object data="javascript:alert(1)"></object>`,
+	`<embed src="javascript:alert(1)">`,
+	`<a href="javascript:alert(1)">x</a>`,
+	`<a href="JaVaScRiPt:alert(1)">x</a>`,
+	`<a href="jav&#x09;ascript:alert(1)">x</a>`,
+	`<a href="&#106;&#97;&#118;&#97;&#115;&#99;&#114;&#105;&#112;&#116;&#58;alert(1)">x</a>`,
+	`<a href=" javascript:alert(1)">x</a>`,
+	`<a href="vbscript:msgbox(1)">x</a>`,
+	`<a href="data:text/html;base64,PHNjcmlwdD5hbGVydCgxKTwvc2NyaXB0Pg==">x</a>`,
+	`<a href="x" onclick="alert(1)">x</a>`,
+	`<a href="x" onmouseover=alert(1)>x</a>`,
+	`<form action="javascript:alert(1)"><input type=submit></form>`,
+	`<button formaction="javascript:alert(1)">x</button>`,
+	`<details open ontoggle=alert(1)>`,
+	`<video><source onerror="alert(1)"></video>`,
+	`<math><mtext><table><mglyph><style><img src=x onerror=alert(1)>`,
+	`<style>body{background:url("javascript:alert(1)")}</style>`,
+	`<div style="background:url(javascript:alert(1))">x</div>`,
+	`<span style="width:expression(alert(1))">x</span>`,
+	`<p style="position:fixed;top:0;left:0;width:100%;height:100%">x</p>`,
+	`<link rel=stylesheet href="https://evil.example/x.css">`,
+	`<meta http-equiv="refresh" content="0;url=javascript:alert(1)">`,
+	`<base href="https://evil.example/">`,
+	`<!--<script>alert(1)//--><script>alert(1)</script>`,
+	`<noscript><p title="</noscript><img src=x onerror=alert(1)>">`,
+	`<a href="#" class="x onclick=alert(1)">x</a>`,
+	`<code class="language-go onload">x</code>`,
+	"[x](javascript:alert(1))",
+	"[x](JAVASCRIPT:alert(1))",
+	"[x](<javascript:alert(1)>)",
+	"![x](javascript:alert(1))",
+	"[x]: javascript:alert(1)\n\n[y][x]",
+	"<javascript:alert(1)>",
+	"# <img src=x onerror=alert(1)>",
+	"```\n</code></pre><script>alert(1)</script>\n```",
+}
+
+// dangerous finds what shouldn't be in rendered bodies, wherever in a tag it is.
+var dangerous = regexp.MustCompile(`(?i)<\s*(script|iframe|object|embed|form|button|svg|math|style|link|meta|base|body|input|video|source|noscript)\b` +
+	`|\son\w+\s*=` +
+	`|(href|src|action|data)\s*=\s*"?\s*(javascript|vbscript|data):` +
+	`|srcdoc|expression\(|position\s*:|url\(`)
+
+func TestRenderXSSCorpus(t *testing.T) {
+	for _, source := range xssCorpus {
+		for _, format := range []string{HTML, Markdown} {
+			out, err := Render(format, source)
+			if err != nil {
+				t.Errorf("%s %q: %v", format, source, err)
+				continue
+			}
+			if match := dangerous.FindString(out); match != "" {
+				t.Errorf("%s %q: rendered %q keeps %q", format, source, out, match)
+			}
+		}
+	}
+}
+
+func TestRenderKeepsClasses(t *testing.T) {
+	out, err := Render(HTML, `<a href="#x" class="anchor">#</a><code class="language-go">x</code><p class="evil">x</p>`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{`class="anchor"`, `class="language-go"`} {
+		if !strings.Contains(out, want) {
+			t.Errorf("%q lost %s", out, want)
+		}
+	}
+	if strings.Contains(out, "evil") {
+		t.Errorf("%q kept a class it shouldn't", out)
+	}
+}
+
+func TestRenderPlain(t *testing.T) {
+	tests := []struct {
+		source string
+		want   string
+	}{
+		{"", ""},
+		{"one line", "<p>one line</p>\n"},
+		{"first\nsecond", "<p>first<br>\nsecond</p>\n"},
+		{"first\r\n\r\nsecond", "<p>first</p>\n<p>second</p>\n"},
+		{"a\n \t \nb", "<p>a</p>\n<p>b</p>\n"},
+		{`<script>alert("1")</script> & co`, "<p>&lt;script&gt;alert(&#34;1&#34;)&lt;/script&gt; &amp; co</p>\n"},
+	}
+
+	for _, test := range tests {
+		if got, _ := Render(Plain, test.source); got != test.want {
+			t.Errorf("Render(plain, %q) = %q, want %q", test.source, got, test.want)
+		}
+	}
+}
+
+func TestHeadingIDs(t *testing.T) {
+	tests := []struct {
+		source string
+		ids    []string
+	}{
+		{"# Hello world", []string{"hello-world"}},
+		{"# Hello <b>world</b>", []string{"hello-world"}},
+		{`# <span class="x">Tagged</span> heading`, []string{"tagged-heading"}},
+		{"## `code` and *emphasis*", []string{"code-and-emphasis"}},
+		{"# Same\n\n# Same", []string{"same", "same-1"}},
+		{"Setext\n======", []string{"setext"}},
+	}
+
+	ids := regexp.MustCompile(`<h\d id="([^"]*)">`)
+	for _, test := range tests {
+		out, err := Render(Markdown, test.source)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var got []string
+		for _, match := range ids.FindAllStringSubmatch(out, -1) {
+			got = append(got, match[1])
+		}
+		if strings.Join(got, " ") != strings.Join(test.ids, " ") {
+			t.Errorf("%q: heading ids %q, want %q in %q", test.source, got, test.ids, out)
+		}
+		for _, id := range test.ids {
+			if !strings.Contains(out, `<a href="#`+id+`" class="anchor"`) {
+				t.Errorf("%q: no anchor to #%s in %q", test.source, id, out)
+			}
+		}
+	}
+}
+
+func TestRenderUnknownFormat(t *testing.T) {
+	if _, err := Render("rtf", "x"); err != ErrFormat {
+		t.Errorf("err = %v, want ErrFormat", err)
+	}
+}
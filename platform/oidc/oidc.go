@@ -0,0 +1,331 @@
+package oidc
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lestrrat-go/jwx/jwa"
+	"github.com/lestrrat-go/jwx/jwk"
+	"github.com/lestrrat-go/jwx/jws"
+	"github.com/lestrrat-go/jwx/jwt"
+)
+
+var ErrInvalidState = errors.New("Invalid or expired login state.")
+var ErrInvalidIDToken = errors.New("Invalid id token.")
+
+var NameRegex = regexp.MustCompile(`^[a-z0-9-]{1,32}$`)
+
+var client = &http.Client{Timeout: 10 * time.Second}
+
+// Provider is an OpenID Connect issuer users can log in with.
+// Its endpoints are discovered from the issuer on first use.
+type Provider struct {
+	Name         string   `json:"name"`
+	Issuer       string   `json:"issuer"`
+	ClientID     string   `json:"client_id"`
+	ClientSecret string   `json:"client_secret"`
+	Scopes       []string `json:"scopes"`
+
+	mu       sync.Mutex
+	metadata *metadata
+	keys     jwk.Set
+}
+
+type metadata struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// Identity is what the provider tells us about the user in its id token.
+type Identity struct {
+	Subject       string
+	Email         string
+	EmailVerified bool
+	Name          string
+}
+
+// State ties a callback to the login that started it.
+type State struct {
+	Provider   string
+	Nonce      string
+	Verifier   string
+	Remember   bool
+	Expires_At int64
+}
+
+// LoadProviders reads the provider list from a json file.
+// A missing file means no providers are configured.
+func LoadProviders(path string) (map[string]*Provider, error) {
+	providers := make(map[string]*Provider)
+
+	raw, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return providers, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var list []*Provider
+	if err = json.Unmarshal(raw, &list); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	for _, p := range list {
+		if !NameRegex.MatchString(p.Name) {
+			return nil, fmt.Errorf("%s: invalid provider name %q", path, p.Name)
+		}
+		if p.Issuer == "" || p.ClientID == "" {
+			return nil, fmt.Errorf("%s: provider %s needs an issuer and a client_id", path, p.Name)
+		}
+		if _, ok := providers[p.Name]; ok {
+			return nil, fmt.Errorf("%s: duplicate provider %s", path, p.Name)
+		}
+		if len(p.Scopes) == 0 {
+			p.Scopes = []string{"openid", "email", "profile"}
+		}
+		p.Issuer = strings.TrimSuffix(p.Issuer, "/")
+		providers[p.Name] = p
+	}
+
+	return providers, nil
+}
+
+// Challenge is the S256 PKCE challenge for a verifier.
+func Challenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+func (p *Provider) discover(ctx context.Context) (*metadata, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.metadata != nil {
+		return p.metadata, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.Issuer+"/.well-known/openid-configuration", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("oidc discovery for %s: %s", p.Name, res.Status)
+	}
+
+	md := &metadata{}
+	if err = json.NewDecoder(res.Body).Decode(md); err != nil {
+		return nil, err
+	}
+
+	if strings.TrimSuffix(md.Issuer, "/") != p.Issuer {
+		return nil, fmt.Errorf("oidc discovery for %s: issuer mismatch %q", p.Name, md.Issuer)
+	}
+	if md.AuthorizationEndpoint == "" || md.TokenEndpoint == "" || md.JWKSURI == "" {
+		return nil, fmt.Errorf("oidc discovery for %s: incomplete metadata", p.Name)
+	}
+
+	p.metadata = md
+	return md, nil
+}
+
+// AuthURL is where the user is sent to log in at the provider.
+func (p *Provider) AuthURL(ctx context.Context, redirectURL string, state string, nonce string, verifier string) (string, error) {
+	md, err := p.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	params := url.Values{}
+	params.Set("response_type", "code")
+	params.Set("client_id", p.ClientID)
+	params.Set("redirect_uri", redirectURL)
+	params.Set("scope", strings.Join(p.Scopes, " "))
+	params.Set("state", state)
+	params.Set("nonce", nonce)
+	params.Set("code_challenge", Challenge(verifier))
+	params.Set("code_challenge_method", "S256")
+
+	sep := "?"
+	if strings.Contains(md.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+
+	return md.AuthorizationEndpoint + sep + params.Encode(), nil
+}
+
+// Exchange trades the authorization code for tokens and returns the
+// identity from the verified id token.
+func (p *Provider) Exchange(ctx context.Context, redirectURL string, code string, state *State) (*Identity, error) {
+	md, err := p.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", redirectURL)
+	form.Set("client_id", p.ClientID)
+	form.Set("code_verifier", state.Verifier)
+	if p.ClientSecret != "" {
+		form.Set("client_secret", p.ClientSecret)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, md.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(res.Body)
+		return nil, fmt.Errorf("oidc token exchange for %s: %s %s", p.Name, res.Status, body)
+	}
+
+	var tokens struct {
+		IDToken string `json:"id_token"`
+	}
+	if err = json.NewDecoder(res.Body).Decode(&tokens); err != nil {
+		return nil, err
+	}
+	if tokens.IDToken == "" {
+		return nil, ErrInvalidIDToken
+	}
+
+	return p.verify(ctx, md, tokens.IDToken, state.Nonce)
+}
+
+func (p *Provider) verify(ctx context.Context, md *metadata, idToken string, nonce string) (*Identity, error) {
+	keys, err := p.keySet(ctx, md, false)
+	if err != nil {
+		return nil, err
+	}
+
+	alg, key, err := lookupKey(idToken, keys)
+	if err != nil {
+		// the provider may have rotated its keys since we fetched them.
+		if keys, err = p.keySet(ctx, md, true); err != nil {
+			return nil, err
+		}
+		if alg, key, err = lookupKey(idToken, keys); err != nil {
+			return nil, err
+		}
+	}
+
+	token, err := jwt.Parse([]byte(idToken), jwt.WithVerify(alg, key))
+	if err != nil {
+		return nil, ErrInvalidIDToken
+	}
+
+	err = jwt.Validate(token,
+		jwt.WithIssuer(md.Issuer),
+		jwt.WithAudience(p.ClientID),
+		jwt.WithAcceptableSkew(time.Minute))
+	if err != nil {
+		return nil, ErrInvalidIDToken
+	}
+
+	if claim, _ := token.Get("nonce"); claim != nonce {
+		return nil, ErrInvalidIDToken
+	}
+	if token.Subject() == "" {
+		return nil, ErrInvalidIDToken
+	}
+
+	identity := &Identity{Subject: token.Subject()}
+	if v, ok := token.Get("email"); ok {
+		identity.Email, _ = v.(string)
+	}
+	if v, ok := token.Get("email_verified"); ok {
+		identity.EmailVerified, _ = v.(bool)
+	}
+	if v, ok := token.Get("name"); ok {
+		identity.Name, _ = v.(string)
+	}
+
+	return identity, nil
+}
+
+// lookupKey finds the provider key that signed the id token. Only asymmetric
+// algorithms are accepted, and the key's own alg wins over the token header.
+func lookupKey(idToken string, keys jwk.Set) (jwa.SignatureAlgorithm, interface{}, error) {
+	msg, err := jws.ParseString(idToken)
+	if err != nil || len(msg.Signatures()) != 1 {
+		return "", nil, ErrInvalidIDToken
+	}
+	headers := msg.Signatures()[0].ProtectedHeaders()
+
+	var key jwk.Key
+	var ok bool
+	if kid := headers.KeyID(); kid != "" {
+		key, ok = keys.LookupKeyID(kid)
+	} else if keys.Len() == 1 {
+		key, ok = keys.Get(0)
+	}
+	if !ok {
+		return "", nil, ErrInvalidIDToken
+	}
+
+	alg := headers.Algorithm()
+	if key.Algorithm() != "" && key.Algorithm() != alg.String() {
+		return "", nil, ErrInvalidIDToken
+	}
+	switch alg {
+	case jwa.RS256, jwa.RS384, jwa.RS512, jwa.PS256, jwa.PS384, jwa.PS512,
+		jwa.ES256, jwa.ES384, jwa.ES512, jwa.EdDSA:
+	default:
+		return "", nil, ErrInvalidIDToken
+	}
+
+	var raw interface{}
+	if err = key.Raw(&raw); err != nil {
+		return "", nil, err
+	}
+
+	return alg, raw, nil
+}
+
+func (p *Provider) keySet(ctx context.Context, md *metadata, refresh bool) (jwk.Set, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.keys != nil && !refresh {
+		return p.keys, nil
+	}
+
+	keys, err := jwk.Fetch(ctx, md.JWKSURI, jwk.WithHTTPClient(client))
+	if err != nil {
+		return nil, err
+	}
+
+	p.keys = keys
+	return keys, nil
+}
@@ -0,0 +1,290 @@
+package oidc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/lestrrat-go/jwx/jwa"
+	"github.com/lestrrat-go/jwx/jwk"
+	"github.com/lestrrat-go/jwx/jwt"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+const (
+	testClientID = "blog"
+	testNonce    = "nonce-value"
+	testVerifier = "verifier-value-long-enough-for-pkce-000000000"
+	testRedirect = "https://blog.example/login/oidc/stub/callback"
+)
+
+// stubIssuer serves discovery, the key set and a token endpoint that hands
+// out an id token with the claims it returns, once the code verifier fits the
+// challenge the login was started with.
+type stubIssuer struct {
+	*httptest.Server
+	key       *rsa.PrivateKey // published in the key set.
+	signer    *rsa.PrivateKey // signs the id tokens, key unless replaced.
+	challenge string
+	claims    func(issuer string) map[string]interface{}
+}
+
+func newStubIssuer(t *testing.T) *stubIssuer {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stub := &stubIssuer{key: key, signer: key, challenge: Challenge(testVerifier)}
+	stub.claims = func(issuer string) map[string]interface{} {
+		return validClaims(issuer)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 stub.URL,
+			"authorization_endpoint": stub.URL + "/authorize",
+			"token_endpoint":         stub.URL + "/token",
+			"jwks_uri":               stub.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		public, err := jwk.New(&stub.key.PublicKey)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		set := jwk.NewSet()
+		set.Add(public)
+		json.NewEncoder(w).Encode(set)
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("code") != "code" || r.FormValue("client_id") != testClientID ||
+			Challenge(r.FormValue("code_verifier")) != stub.challenge {
+			http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"id_token": stub.sign(t, stub.claims(stub.URL))})
+	})
+
+	stub.Server = httptest.NewServer(mux)
+	t.Cleanup(stub.Close)
+	return stub
+}
+
+func (stub *stubIssuer) sign(t *testing.T, claims map[string]interface{}) string {
+	token := jwt.New()
+	for k, v := range claims {
+		if err := token.Set(k, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	signed, err := jwt.Sign(token, jwa.RS256, stub.signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(signed)
+}
+
+func validClaims(issuer string) map[string]interface{} {
+	now := time.Now()
+	return map[string]interface{}{
+		jwt.IssuerKey:     issuer,
+		jwt.AudienceKey:   []string{testClientID},
+		jwt.SubjectKey:    "subject-1",
+		jwt.IssuedAtKey:   now,
+		jwt.ExpirationKey: now.Add(5 * time.Minute),
+		"nonce":           testNonce,
+		"email":           "reader@example.com",
+		"email_verified":  true,
+		"name":            "Reader",
+	}
+}
+
+func TestExchange(t *testing.T) {
+	tests := []struct {
+		name     string
+		claims   func(claims map[string]interface{})
+		nonce    string
+		verifier string
+		otherKey bool
+		ok       bool
+	}{
+		{name: "valid", ok: true},
+		{name: "nonce mismatch", nonce: "other-nonce"},
+		{name: "missing nonce", claims: func(c map[string]interface{}) { delete(c, "nonce") }},
+		{name: "other audience", claims: func(c map[string]interface{}) { c[jwt.AudienceKey] = []string{"someone-else"} }},
+		{name: "other issuer", claims: func(c map[string]interface{}) { c[jwt.IssuerKey] = "https://evil.example" }},
+		{name: "expired", claims: func(c map[string]interface{}) { c[jwt.ExpirationKey] = time.Now().Add(-time.Hour) }},
+		{name: "issued in the future", claims: func(c map[string]interface{}) { c[jwt.IssuedAtKey] = time.Now().Add(time.Hour) }},
+		{name: "no subject", claims: func(c map[string]interface{}) { delete(c, jwt.SubjectKey) }},
+		{name: "wrong PKCE verifier", verifier: "some-other-verifier-that-does-not-fit-000000"},
+		{name: "unpublished key", otherKey: true},
+	}
+
+	for _, test := range tests {
+		stub := newStubIssuer(t)
+		stub.claims = func(issuer string) map[string]interface{} {
+			claims := validClaims(issuer)
+			if test.claims != nil {
+				test.claims(claims)
+			}
+			return claims
+		}
+		if test.otherKey {
+			other, err := rsa.GenerateKey(rand.Reader, 2048)
+			if err != nil {
+				t.Fatal(err)
+			}
+			stub.signer = other
+		}
+
+		provider := &Provider{Name: "stub", Issuer: stub.URL, ClientID: testClientID}
+		state := &State{Provider: "stub", Nonce: testNonce, Verifier: testVerifier}
+		if test.nonce != "" {
+			state.Nonce = test.nonce
+		}
+		if test.verifier != "" {
+			state.Verifier = test.verifier
+		}
+
+		identity, err := provider.Exchange(context.Background(), testRedirect, "code", state)
+		if !test.ok {
+			if err == nil {
+				t.Errorf("%s: Exchange accepted the login as %+v", test.name, identity)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: Exchange: %v", test.name, err)
+			continue
+		}
+		want := Identity{Subject: "subject-1", Email: "reader@example.com", EmailVerified: true, Name: "Reader"}
+		if *identity != want {
+			t.Errorf("%s: identity = %+v, want %+v", test.name, *identity, want)
+		}
+	}
+}
+
+func TestAuthURL(t *testing.T) {
+	stub := newStubIssuer(t)
+	provider := &Provider{Name: "stub", Issuer: stub.URL, ClientID: testClientID, Scopes: []string{"openid"}}
+
+	authURL, err := provider.AuthURL(context.Background(), testRedirect, "state", testNonce, testVerifier)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, authURL, nil)
+	query := req.URL.Query()
+	want := map[string]string{
+		"client_id":             testClientID,
+		"redirect_uri":          testRedirect,
+		"state":                 "state",
+		"nonce":                 testNonce,
+		"code_challenge":        Challenge(testVerifier),
+		"code_challenge_method": "S256",
+	}
+	for k, v := range want {
+		if got := query.Get(k); got != v {
+			t.Errorf("%s = %q, want %q", k, got, v)
+		}
+	}
+}
+
+func TestDiscoverIssuerMismatch(t *testing.T) {
+	stub := newStubIssuer(t)
+	provider := &Provider{Name: "stub", Issuer: stub.URL + "/other", ClientID: testClientID}
+
+	if _, err := provider.AuthURL(context.Background(), testRedirect, "state", testNonce, testVerifier); err == nil {
+		t.Error("discovery accepted metadata for another issuer")
+	}
+}
+
+func newTestRepo(t *testing.T) *Repo {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// every connection would get its own in-memory database.
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() { db.Close() })
+
+	_, err = db.Exec(`CREATE TABLE "oidc_states" (
+		"state_hash"	TEXT NOT NULL UNIQUE,
+		"provider"	TEXT NOT NULL,
+		"nonce"	TEXT NOT NULL,
+		"verifier"	TEXT NOT NULL,
+		"remember"	INTEGER NOT NULL DEFAULT 0,
+		"expires_at"	INTEGER NOT NULL,
+		PRIMARY KEY("state_hash")
+	)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return NewRepo(db)
+}
+
+func TestConsumeState(t *testing.T) {
+	repo := newTestRepo(t)
+	expires := time.Now().Add(time.Minute).Unix()
+
+	states := map[string]*State{
+		"live":    {Provider: "stub", Nonce: testNonce, Verifier: testVerifier, Remember: true, Expires_At: expires},
+		"expired": {Provider: "stub", Nonce: testNonce, Verifier: testVerifier, Expires_At: time.Now().Add(-time.Second).Unix()},
+		"other":   {Provider: "other", Nonce: testNonce, Verifier: testVerifier, Expires_At: expires},
+	}
+	for state, data := range states {
+		if err := repo.SaveState(state, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got, err := repo.ConsumeState("live", "stub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *got != *states["live"] {
+		t.Errorf("ConsumeState = %+v, want %+v", *got, *states["live"])
+	}
+
+	tests := []struct {
+		name  string
+		state string
+	}{
+		{"replayed state", "live"},
+		{"unknown state", "never-issued"},
+		{"expired state", "expired"},
+		{"state of another provider", "other"},
+	}
+	for _, test := range tests {
+		if _, err := repo.ConsumeState(test.state, "stub"); err != ErrInvalidState {
+			t.Errorf("%s: err = %v, want ErrInvalidState", test.name, err)
+		}
+	}
+}
+
+func TestDeleteState(t *testing.T) {
+	repo := newTestRepo(t)
+	data := &State{Provider: "stub", Nonce: testNonce, Verifier: testVerifier, Expires_At: time.Now().Add(time.Minute).Unix()}
+	if err := repo.SaveState("replaced", data); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := repo.DeleteState("replaced"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repo.ConsumeState("replaced", "stub"); err != ErrInvalidState {
+		t.Errorf("err = %v, want ErrInvalidState", err)
+	}
+}
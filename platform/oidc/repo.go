@@ -0,0 +1,145 @@
+package oidc
+
+import (
+	"context"
+	"database/sql"
+	"go-blog/platform/token"
+	"log"
+	"time"
+)
+
+type Repo struct {
+	DB *sql.DB
+}
+
+func NewRepo(db *sql.DB) *Repo {
+	return &Repo{
+		DB: db,
+	}
+}
+
+// SaveState stores a started login under its state value, dropping the
+// ones nobody came back for.
+func (repo *Repo) SaveState(state string, data *State) error {
+	if _, err := repo.DB.Exec("DELETE FROM oidc_states WHERE expires_at <= ?", time.Now().Unix()); err != nil {
+		log.Println(err)
+		return err
+	}
+
+	stmt, err := repo.DB.Prepare(`
+	INSERT INTO
+	oidc_states (state_hash, provider, nonce, verifier, remember, expires_at)
+	values (?, ?, ?, ?, ?, ?)`)
+
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+
+	defer stmt.Close()
+
+	_, err = stmt.Exec(token.Hash(state), data.Provider, data.Nonce, data.Verifier, data.Remember, data.Expires_At)
+	if err != nil {
+		log.Println(err)
+	}
+
+	return err
+}
+
+// ConsumeState returns the login started with the state and removes it,
+// so a callback can only be used once.
+func (repo *Repo) ConsumeState(state string, provider string) (*State, error) {
+	ctx := context.Background()
+
+	tx, err := repo.DB.BeginTx(ctx, nil)
+	if err != nil {
+		log.Println(err)
+		return nil, err
+	}
+
+	hash := token.Hash(state)
+	result := &State{}
+	err = tx.QueryRowContext(ctx, `
+	SELECT provider, nonce, verifier, remember, expires_at
+	FROM oidc_states WHERE state_hash = ?`, hash).Scan(
+		&result.Provider, &result.Nonce, &result.Verifier, &result.Remember, &result.Expires_At)
+
+	if err == sql.ErrNoRows {
+		tx.Rollback()
+		return nil, ErrInvalidState
+	} else if err != nil {
+		log.Println(err)
+		tx.Rollback()
+		return nil, err
+	}
+
+	if _, err = tx.ExecContext(ctx, "DELETE FROM oidc_states WHERE state_hash = ?", hash); err != nil {
+		log.Println(err)
+		tx.Rollback()
+		return nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		log.Println(err)
+		return nil, err
+	}
+
+	if result.Provider != provider || result.Expires_At <= time.Now().Unix() {
+		return nil, ErrInvalidState
+	}
+
+	return result, nil
+}
+
+// DeleteState drops a started login that was replaced by a new one.
+func (repo *Repo) DeleteState(state string) error {
+	stmt, err := repo.DB.Prepare("DELETE FROM oidc_states WHERE state_hash = ?")
+
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+
+	defer stmt.Close()
+
+	if _, err = stmt.Exec(token.Hash(state)); err != nil {
+		log.Println(err)
+		return err
+	}
+
+	return nil
+}
+
+// GetUserID returns the user linked to the provider's subject, or sql.ErrNoRows.
+func (repo *Repo) GetUserID(provider string, subject string) (int64, error) {
+	var userID int64
+	err := repo.DB.QueryRow("SELECT user_id FROM user_identities WHERE provider = ? AND subject = ?",
+		provider, subject).Scan(&userID)
+	if err != nil && err != sql.ErrNoRows {
+		log.Println(err)
+	}
+
+	return userID, err
+}
+
+func (repo *Repo) Link(userID int64, provider string, subject string) error {
+	stmt, err := repo.DB.Prepare(`
+	INSERT INTO
+	user_identities (user_id, provider, subject, created_at)
+	values (?, ?, ?, ?)`)
+
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+
+	defer stmt.Close()
+
+	_, err = stmt.Exec(userID, provider, subject, time.Now().Unix())
+	if err != nil {
+		log.Println(err)
+	}
+
+	return err
+}
@@ -0,0 +1,197 @@
+package password
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var ErrInvalidHash = errors.New("Invalid password hash.")
+var ErrTooLong = fmt.Errorf("Bcrypt can't hash passwords over %d bytes.", BcryptMaxBytes)
+
+// BcryptMaxBytes is the longest password bcrypt tells apart, it would
+// ignore any bytes after it.
+const BcryptMaxBytes = 72
+
+// Hasher is a password hashing scheme.
+type Hasher interface {
+	// Identifies reports whether the hash was made with this scheme.
+	Identifies(hash string) bool
+	Hash(password string) (string, error)
+	Verify(hash string, password string) (bool, error)
+	// Outdated reports whether the hash was made with other parameters than the current ones.
+	Outdated(hash string) bool
+}
+
+// Argon2id hashes into the PHC string format, $argon2id$v=19$m=..,t=..,p=..$salt$key.
+type Argon2id struct {
+	Time    uint32
+	Memory  uint32 // in KiB.
+	Threads uint8
+	SaltLen uint32
+	KeyLen  uint32
+}
+
+// DefaultArgon2id follows the OWASP recommendation for argon2id.
+var DefaultArgon2id = &Argon2id{Time: 2, Memory: 19 * 1024, Threads: 1, SaltLen: 16, KeyLen: 32}
+
+func (a *Argon2id) Identifies(hash string) bool {
+	return strings.HasPrefix(hash, "$argon2id$")
+}
+
+func (a *Argon2id) Hash(password string) (string, error) {
+	salt := make([]byte, a.SaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+
+	key := argon2.IDKey([]byte(password), salt, a.Time, a.Memory, a.Threads, a.KeyLen)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, a.Memory, a.Time, a.Threads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// decode reads the parameters, salt and key of a hash.
+func (a *Argon2id) decode(hash string) (*Argon2id, []byte, []byte, error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return nil, nil, nil, ErrInvalidHash
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return nil, nil, nil, ErrInvalidHash
+	}
+
+	params := &Argon2id{}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Time, &params.Threads); err != nil {
+		return nil, nil, nil, ErrInvalidHash
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return nil, nil, nil, ErrInvalidHash
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(key) == 0 {
+		return nil, nil, nil, ErrInvalidHash
+	}
+
+	params.SaltLen, params.KeyLen = uint32(len(salt)), uint32(len(key))
+	return params, salt, key, nil
+}
+
+func (a *Argon2id) Verify(hash string, password string) (bool, error) {
+	params, salt, key, err := a.decode(hash)
+	if err != nil {
+		return false, err
+	}
+
+	other := argon2.IDKey([]byte(password), salt, params.Time, params.Memory, params.Threads, params.KeyLen)
+	return subtle.ConstantTimeCompare(key, other) == 1, nil
+}
+
+func (a *Argon2id) Outdated(hash string) bool {
+	params, _, _, err := a.decode(hash)
+	if err != nil {
+		return true
+	}
+	return *params != *a
+}
+
+// Bcrypt refuses to hash passwords over BcryptMaxBytes, rather than making a
+// hash that any password starting with the same bytes would match.
+type Bcrypt struct {
+	Cost int
+}
+
+var DefaultBcrypt = &Bcrypt{Cost: bcrypt.DefaultCost}
+
+func (b *Bcrypt) Identifies(hash string) bool {
+	return strings.HasPrefix(hash, "$2a$") || strings.HasPrefix(hash, "$2b$") || strings.HasPrefix(hash, "$2y$")
+}
+
+func (b *Bcrypt) Hash(password string) (string, error) {
+	if len(password) > BcryptMaxBytes {
+		return "", ErrTooLong
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), b.Cost)
+	return string(hash), err
+}
+
+func (b *Bcrypt) Verify(hash string, password string) (bool, error) {
+	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+	if err == bcrypt.ErrMismatchedHashAndPassword {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (b *Bcrypt) Outdated(hash string) bool {
+	cost, err := bcrypt.Cost([]byte(hash))
+	return err != nil || cost != b.Cost
+}
+
+// Hashers hashes new passwords with Current and still verifies the hashes
+// of the Others, so users can be moved over as they log in.
+type Hashers struct {
+	Current Hasher
+	Others  []Hasher
+
+	dummyOnce sync.Once
+	dummy     string
+}
+
+// Default is what passwords are hashed and verified with, set up from the config at start.
+var Default = &Hashers{Current: DefaultArgon2id, Others: []Hasher{DefaultBcrypt}}
+
+// MaxBytes is the longest password the current hasher takes, 0 if any length goes.
+func (h *Hashers) MaxBytes() int {
+	if _, ok := h.Current.(*Bcrypt); ok {
+		return BcryptMaxBytes
+	}
+	return 0
+}
+
+func (h *Hashers) Hash(password string) (string, error) {
+	return h.Current.Hash(password)
+}
+
+// Verify reports whether the password matches the hash and, if so, whether
+// the hash should be replaced with one from Hash. Users without a password,
+// like the ones registered through a login provider, never match.
+func (h *Hashers) Verify(hash string, password string) (ok bool, rehash bool) {
+	if hash == "" {
+		return false, false
+	}
+
+	if h.Current.Identifies(hash) {
+		ok, _ = h.Current.Verify(hash, password)
+		return ok, ok && h.Current.Outdated(hash)
+	}
+
+	for _, hasher := range h.Others {
+		if hasher.Identifies(hash) {
+			ok, _ = hasher.Verify(hash, password)
+			return ok, ok
+		}
+	}
+
+	return false, false
+}
+
+// Waste hashes the password like Verify would without matching anything, so
+// a login for an unknown user takes as long as one with a wrong password.
+func (h *Hashers) Waste(password string) {
+	h.dummyOnce.Do(func() {
+		h.dummy, _ = h.Current.Hash("dummy password")
+	})
+	h.Current.Verify(h.dummy, password)
+}
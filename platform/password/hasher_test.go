@@ -0,0 +1,170 @@
+package password
+
+import (
+	"strings"
+	"testing"
+)
+
+// testArgon2id keeps the tests fast, real hashes use DefaultArgon2id.
+var testArgon2id = &Argon2id{Time: 1, Memory: 64, Threads: 1, SaltLen: 16, KeyLen: 32}
+
+var testBcrypt = &Bcrypt{Cost: 4}
+
+func TestArgon2idDecode(t *testing.T) {
+	salt := "c2FsdHNhbHRzYWx0c2FsdA" // "saltsaltsaltsalt"
+	key := "a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2U"
+
+	tests := []struct {
+		name string
+		hash string
+		want *Argon2id
+	}{
+		{"valid", "$argon2id$v=19$m=65536,t=3,p=4$" + salt + "$" + key,
+			&Argon2id{Time: 3, Memory: 65536, Threads: 4, SaltLen: 16, KeyLen: 29}},
+		{"argon2i", "$argon2i$v=19$m=65536,t=3,p=4$" + salt + "$" + key, nil},
+		{"other version", "$argon2id$v=16$m=65536,t=3,p=4$" + salt + "$" + key, nil},
+		{"no version", "$argon2id$m=65536,t=3,p=4$" + salt + "$" + key, nil},
+		{"params out of order", "$argon2id$v=19$t=3,m=65536,p=4$" + salt + "$" + key, nil},
+		{"missing param", "$argon2id$v=19$m=65536,t=3$" + salt + "$" + key, nil},
+		{"threads overflow", "$argon2id$v=19$m=65536,t=3,p=256$" + salt + "$" + key, nil},
+		{"padded salt", "$argon2id$v=19$m=65536,t=3,p=4$" + salt + "==$" + key, nil},
+		{"bad key", "$argon2id$v=19$m=65536,t=3,p=4$" + salt + "$not*base64", nil},
+		{"empty key", "$argon2id$v=19$m=65536,t=3,p=4$" + salt + "$", nil},
+		{"extra part", "$argon2id$v=19$m=65536,t=3,p=4$" + salt + "$" + key + "$", nil},
+		{"bcrypt hash", "$2a$10$N9qo8uLOickgx2ZMRZoMyeIjZAgcfl7p92ldGxad68LJZdL17lhWy", nil},
+		{"empty", "", nil},
+	}
+
+	for _, test := range tests {
+		params, _, _, err := testArgon2id.decode(test.hash)
+		if test.want == nil {
+			if err != ErrInvalidHash {
+				t.Errorf("%s: decode err = %v, want ErrInvalidHash", test.name, err)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: decode: %v", test.name, err)
+		} else if *params != *test.want {
+			t.Errorf("%s: decode = %+v, want %+v", test.name, *params, *test.want)
+		}
+	}
+}
+
+func TestArgon2idHashVerify(t *testing.T) {
+	hash, err := testArgon2id.Hash("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !testArgon2id.Identifies(hash) {
+		t.Errorf("Identifies(%q) = false", hash)
+	}
+
+	if ok, err := testArgon2id.Verify(hash, "correct horse"); !ok || err != nil {
+		t.Errorf("Verify with the password = %v, %v", ok, err)
+	}
+	if ok, err := testArgon2id.Verify(hash, "correct horsf"); ok || err != nil {
+		t.Errorf("Verify with another password = %v, %v", ok, err)
+	}
+
+	again, _ := testArgon2id.Hash("correct horse")
+	if again == hash {
+		t.Error("two hashes of the same password share a salt")
+	}
+}
+
+func TestArgon2idOutdated(t *testing.T) {
+	hash, err := testArgon2id.Hash("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		current Argon2id
+		want    bool
+	}{
+		{"same parameters", *testArgon2id, false},
+		{"more time", Argon2id{Time: 2, Memory: 64, Threads: 1, SaltLen: 16, KeyLen: 32}, true},
+		{"more memory", Argon2id{Time: 1, Memory: 128, Threads: 1, SaltLen: 16, KeyLen: 32}, true},
+		{"more threads", Argon2id{Time: 1, Memory: 64, Threads: 2, SaltLen: 16, KeyLen: 32}, true},
+		{"longer salt", Argon2id{Time: 1, Memory: 64, Threads: 1, SaltLen: 32, KeyLen: 32}, true},
+		{"longer key", Argon2id{Time: 1, Memory: 64, Threads: 1, SaltLen: 16, KeyLen: 64}, true},
+	}
+
+	for _, test := range tests {
+		if got := test.current.Outdated(hash); got != test.want {
+			t.Errorf("%s: Outdated = %v, want %v", test.name, got, test.want)
+		}
+	}
+
+	if !testArgon2id.Outdated("$argon2id$garbage") {
+		t.Error("Outdated(garbage) = false, want true")
+	}
+}
+
+func TestBcryptMaxBytes(t *testing.T) {
+	long := strings.Repeat("a", BcryptMaxBytes)
+
+	hash, err := testBcrypt.Hash(long)
+	if err != nil {
+		t.Fatalf("Hash of %d bytes: %v", BcryptMaxBytes, err)
+	}
+	if ok, _ := testBcrypt.Verify(hash, long); !ok {
+		t.Error("Verify of the hashed password failed")
+	}
+
+	if _, err = testBcrypt.Hash(long + "b"); err != ErrTooLong {
+		t.Errorf("Hash of %d bytes: err = %v, want ErrTooLong", BcryptMaxBytes+1, err)
+	}
+}
+
+func TestHashersVerify(t *testing.T) {
+	hashers := &Hashers{Current: testArgon2id, Others: []Hasher{testBcrypt}}
+
+	current, _ := testArgon2id.Hash("correct horse")
+	outdated, _ := (&Argon2id{Time: 2, Memory: 64, Threads: 1, SaltLen: 16, KeyLen: 32}).Hash("correct horse")
+	other, _ := testBcrypt.Hash("correct horse")
+
+	tests := []struct {
+		name     string
+		hash     string
+		password string
+		ok       bool
+		rehash   bool
+	}{
+		{"current hash", current, "correct horse", true, false},
+		{"current hash, wrong password", current, "wrong horse", false, false},
+		{"outdated parameters", outdated, "correct horse", true, true},
+		{"outdated parameters, wrong password", outdated, "wrong horse", false, false},
+		{"other scheme", other, "correct horse", true, true},
+		{"other scheme, wrong password", other, "wrong horse", false, false},
+		{"no password", "", "", false, false},
+		{"unknown scheme", "$md5$abc", "correct horse", false, false},
+	}
+
+	for _, test := range tests {
+		ok, rehash := hashers.Verify(test.hash, test.password)
+		if ok != test.ok || rehash != test.rehash {
+			t.Errorf("%s: Verify = %v, %v, want %v, %v", test.name, ok, rehash, test.ok, test.rehash)
+		}
+	}
+}
+
+func TestHashersMaxBytes(t *testing.T) {
+	if got := (&Hashers{Current: testArgon2id}).MaxBytes(); got != 0 {
+		t.Errorf("argon2id MaxBytes = %d, want 0", got)
+	}
+	if got := (&Hashers{Current: testBcrypt}).MaxBytes(); got != BcryptMaxBytes {
+		t.Errorf("bcrypt MaxBytes = %d, want %d", got, BcryptMaxBytes)
+	}
+}
+
+func TestHashersWaste(t *testing.T) {
+	hashers := &Hashers{Current: testArgon2id}
+	hashers.Waste("correct horse")
+	if !testArgon2id.Identifies(hashers.dummy) {
+		t.Errorf("Waste made no argon2id hash: %q", hashers.dummy)
+	}
+}
@@ -0,0 +1,99 @@
+package password
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+var ErrCommon = errors.New("This password is too common, pick another one.")
+
+// Policy is what new passwords must satisfy. Length counts characters, not
+// bytes, and spaces are allowed so passphrases work.
+type Policy struct {
+	MinLength int
+	MaxLength int
+	MaxBytes  int             // the hasher's limit, 0 when it has none.
+	Common    map[string]bool // lowercased passwords that are refused.
+}
+
+// DefaultPolicy is checked on registration, password change and reset.
+var DefaultPolicy = &Policy{MinLength: 8, MaxLength: 128, Common: builtinCommon()}
+
+func (p *Policy) Check(password string) error {
+	length := utf8.RuneCountInString(password)
+	if length < p.MinLength || length > p.MaxLength {
+		return fmt.Errorf("Password must be between %d and %d characters.", p.MinLength, p.MaxLength)
+	}
+	if p.MaxBytes > 0 && len(password) > p.MaxBytes {
+		return fmt.Errorf("Password can't be longer than %d bytes.", p.MaxBytes)
+	}
+
+	if strings.TrimFunc(password, unicode.IsSpace) != password {
+		return errors.New("Password can't start or end with a space.")
+	}
+
+	if p.Common[strings.ToLower(password)] {
+		return ErrCommon
+	}
+
+	return nil
+}
+
+// Plausible reports whether a login attempt's password is worth hashing.
+// Old passwords may not satisfy the policy, so it only bounds the length.
+func (p *Policy) Plausible(password string) bool {
+	return password != "" && utf8.RuneCountInString(password) <= p.MaxLength
+}
+
+// LoadCommon adds the passwords of a file, one per line, to the refused ones.
+// A missing file leaves the built-in list alone.
+func (p *Policy) LoadCommon(path string) error {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			p.Common[strings.ToLower(line)] = true
+		}
+	}
+
+	return scanner.Err()
+}
+
+func builtinCommon() map[string]bool {
+	common := map[string]bool{}
+	for _, password := range commonPasswords {
+		common[password] = true
+	}
+	return common
+}
+
+// commonPasswords are the most common leaked passwords long enough to pass the length check.
+var commonPasswords = []string{
+	"password", "password1", "password12", "password123", "password1234", "passw0rd", "p@ssw0rd", "p@ssword",
+	"12345678", "123456789", "1234567890", "12345678910", "123123123", "11111111", "111111111", "00000000",
+	"87654321", "987654321", "0987654321", "11223344", "12341234", "123qweasd", "1q2w3e4r", "1q2w3e4r5t",
+	"1qaz2wsx", "zaq12wsx", "zaq1zaq1", "qwertyui", "qwertyuiop", "qwerty123", "qwerty12", "qwe123qwe",
+	"asdfghjkl", "asdfasdf", "zxcvbnm1", "zxcvbnmm", "abcd1234", "abc12345", "abcdefgh", "aa123456",
+	"iloveyou", "iloveyou1", "sunshine", "princess", "football", "baseball", "basketball", "welcome1",
+	"welcome123", "trustno1", "superman", "starwars", "whatever", "michelle", "jennifer", "computer",
+	"corvette", "mercedes", "charlie1", "jordan23", "liverpool", "chelsea1", "arsenal1", "master12",
+	"letmein1", "letmein123", "changeme", "changeme1", "admin123", "administrator", "qwerty1234", "monkey12",
+	"dragon12", "shadow12", "michael1", "mustang1", "batman12", "pokemon1", "minecraft", "spiderman",
+	"blink182", "babygirl", "lovely12", "loveyou1", "sweetheart", "chocolate", "butterfly", "elephant",
+	"hello123", "hellohello", "google123", "internet", "samsung1", "password!", "access14", "q1w2e3r4",
+	"q1w2e3r4t5", "1234qwer", "qazwsxedc", "1qazxsw2", "secret123", "freedom1", "fuckyou1", "anthony1",
+	"jessica1", "jonathan", "christopher", "benjamin", "victoria", "nicole12", "ashley12", "tinkerbell",
+	"football1", "baseball1", "trustme1", "iloveu123", "asdf1234", "asd12345", "1234abcd", "gfhjkmgfhjkm",
+}
@@ -0,0 +1,36 @@
+package password
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPolicyCheck(t *testing.T) {
+	policy := &Policy{MinLength: 8, MaxLength: 128, Common: map[string]bool{"password1": true}}
+	bcryptPolicy := &Policy{MinLength: 8, MaxLength: 128, MaxBytes: BcryptMaxBytes, Common: map[string]bool{}}
+
+	tests := []struct {
+		name     string
+		policy   *Policy
+		password string
+		ok       bool
+	}{
+		{"fine", policy, "correct horse", true},
+		{"too short", policy, "short", false},
+		{"max characters", policy, strings.Repeat("a", 128), true},
+		{"too many characters", policy, strings.Repeat("a", 129), false},
+		{"multi byte counts characters", policy, strings.Repeat("é", 100), true},
+		{"leading space", policy, " correct horse", false},
+		{"trailing space", policy, "correct horse ", false},
+		{"common", policy, "Password1", false},
+		{"bcrypt max bytes", bcryptPolicy, strings.Repeat("a", BcryptMaxBytes), true},
+		{"bcrypt too many bytes", bcryptPolicy, strings.Repeat("a", BcryptMaxBytes+1), false},
+		{"bcrypt multi byte", bcryptPolicy, strings.Repeat("é", 40), false},
+	}
+
+	for _, test := range tests {
+		if err := test.policy.Check(test.password); (err == nil) != test.ok {
+			t.Errorf("%s: Check = %v, want ok %v", test.name, err, test.ok)
+		}
+	}
+}
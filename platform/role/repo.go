@@ -1,8 +1,10 @@
 package role
 
 import (
+	"context"
 	"database/sql"
 	"log"
+	"time"
 )
 
 type Repo struct {
@@ -15,67 +17,217 @@ func NewRepo(db *sql.DB) *Repo {
 	}
 }
 
-func (repo *Repo) Delete(id int64) error {
-	stmt, err := repo.DB.Prepare("DELETE FROM roles WHERE id = ?")
+// Delete removes a role after moving its users to the replacement role in
+// the same transaction. Moved users get an audit entry and are signed out,
+// since their tokens carry the old role. A deleted default role hands the
+// default over to the replacement.
+func (repo *Repo) Delete(id int64, replacementID int64, actorID int64) (int64, error) {
+	ctx := context.Background()
 
+	tx, err := repo.DB.BeginTx(ctx, nil)
+	if err != nil {
+		log.Println(err)
+		return 0, err
+	}
+
+	var protected, isDefault bool
+	err = tx.QueryRowContext(ctx, "SELECT protected, is_default FROM roles WHERE id = ?", id).Scan(&protected, &isDefault)
+	if err != nil {
+		log.Println(err)
+		tx.Rollback()
+		return 0, err
+	}
+	if protected {
+		tx.Rollback()
+		return 0, ErrProtected
+	}
+
+	_, err = tx.ExecContext(ctx, `
+	INSERT INTO 
+	role_assignments (user_id, actor_id, old_role_id, new_role_id, created_at) 
+	SELECT id, ?, role_id, ?, ? FROM users WHERE role_id = ?`, actorID, replacementID, time.Now().Unix(), id)
+	if err != nil {
+		log.Println(err)
+		tx.Rollback()
+		return 0, err
+	}
+
+	_, err = tx.ExecContext(ctx, `
+	UPDATE sessions SET revoked = 1 
+	WHERE user_id IN (SELECT id FROM users WHERE role_id = ?)`, id)
+	if err != nil {
+		log.Println(err)
+		tx.Rollback()
+		return 0, err
+	}
+
+	result, err := tx.ExecContext(ctx, "UPDATE users SET role_id = ? WHERE role_id = ?", replacementID, id)
+	if err != nil {
+		log.Println(err)
+		tx.Rollback()
+		return 0, err
+	}
+
+	moved, err := result.RowsAffected()
+	if err != nil {
+		log.Println(err)
+		tx.Rollback()
+		return 0, err
+	}
+
+	if isDefault {
+		if _, err = tx.ExecContext(ctx, "UPDATE roles SET is_default = 1 WHERE id = ?", replacementID); err != nil {
+			log.Println(err)
+			tx.Rollback()
+			return 0, err
+		}
+	}
+
+	if _, err = tx.ExecContext(ctx, "DELETE FROM role_permissions WHERE role_id = ?", id); err != nil {
+		log.Println(err)
+		tx.Rollback()
+		return 0, err
+	}
+
+	if _, err = tx.ExecContext(ctx, "DELETE FROM roles WHERE id = ?", id); err != nil {
+		log.Println(err)
+		tx.Rollback()
+		return 0, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		log.Println(err)
+		return 0, err
+	}
+
+	return moved, nil
+}
+
+// GetDefault returns the role new users get.
+func (repo *Repo) GetDefault() (*Role, error) {
+	var id int64
+	err := repo.DB.QueryRow("SELECT id FROM roles WHERE is_default = 1 ORDER BY id LIMIT 1").Scan(&id)
+	if err != nil {
+		log.Println(err)
+		return nil, err
+	}
+
+	return repo.GetByID(id)
+}
+
+// SetDefault makes the role the only one given to new users.
+func (repo *Repo) SetDefault(id int64) error {
+	ctx := context.Background()
+
+	tx, err := repo.DB.BeginTx(ctx, nil)
 	if err != nil {
 		log.Println(err)
 		return err
 	}
 
-	defer stmt.Close()
+	if _, err = tx.ExecContext(ctx, "UPDATE roles SET is_default = 0 WHERE id != ?", id); err != nil {
+		log.Println(err)
+		tx.Rollback()
+		return err
+	}
 
-	if _, err = stmt.Exec(id); err != nil {
+	if _, err = tx.ExecContext(ctx, "UPDATE roles SET is_default = 1 WHERE id = ?", id); err != nil {
 		log.Println(err)
+		tx.Rollback()
 		return err
 	}
 
+	err = tx.Commit()
+	if err != nil {
+		log.Println(err)
+	}
+
+	return err
+}
+
+func setPermissions(ctx context.Context, tx *sql.Tx, id int64, names []string) error {
+	if _, err := tx.ExecContext(ctx, "DELETE FROM role_permissions WHERE role_id = ?", id); err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		_, err := tx.ExecContext(ctx, "INSERT OR IGNORE INTO role_permissions (role_id, permission) VALUES (?, ?)", id, name)
+		if err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
 func (repo *Repo) Update(role *Role) error {
-	stmt, err := repo.DB.Prepare(`
-	UPDATE roles 
-	SET name = ?, code = ? 
-	WHERE id = ?`)
+	ctx := context.Background()
 
+	tx, err := repo.DB.BeginTx(ctx, nil)
 	if err != nil {
 		log.Println(err)
 		return err
 	}
 
-	defer stmt.Close()
+	_, err = tx.ExecContext(ctx, `
+	UPDATE roles 
+	SET name = ?, require_verified = ?, require_totp = ? 
+	WHERE id = ?`, role.Name, role.Require_Verified, role.Require_TOTP, role.ID)
+	if err != nil {
+		log.Println(err)
+		tx.Rollback()
+		return err
+	}
 
-	_, err = stmt.Exec(role.Name, role.Code, role.ID)
+	if err = setPermissions(ctx, tx, role.ID, role.Permissions); err != nil {
+		log.Println(err)
+		tx.Rollback()
+		return err
+	}
 
+	err = tx.Commit()
 	if err != nil {
 		log.Println(err)
-		return err
 	}
 
-	return nil
+	return err
 }
 
 func (repo *Repo) Add(role *Role) (int64, error) {
-	stmt, err := repo.DB.Prepare(`
-	INSERT INTO 
-	roles (name,  code)
-	values (?, ?)`)
+	ctx := context.Background()
 
+	tx, err := repo.DB.BeginTx(ctx, nil)
 	if err != nil {
 		log.Println(err)
 		return 0, err
 	}
 
-	defer stmt.Close()
-
-	result, err := stmt.Exec(role.Name, role.Code)
+	// code is what permissions were before role_permissions, 0 keeps MigrateCodes off the role.
+	result, err := tx.ExecContext(ctx, `
+	INSERT INTO 
+	roles (name,  code, require_verified, require_totp)
+	values (?, 0, ?, ?)`, role.Name, role.Require_Verified, role.Require_TOTP)
 	if err != nil {
 		log.Println(err)
+		tx.Rollback()
 		return 0, err
 	}
 
 	id, err := result.LastInsertId()
+	if err != nil {
+		log.Println(err)
+		tx.Rollback()
+		return 0, err
+	}
+
+	if err = setPermissions(ctx, tx, id, role.Permissions); err != nil {
+		log.Println(err)
+		tx.Rollback()
+		return 0, err
+	}
+
+	err = tx.Commit()
 	if err != nil {
 		log.Println(err)
 	}
@@ -86,7 +238,9 @@ func (repo *Repo) Add(role *Role) (int64, error) {
 func (repo *Repo) GetByID(id int64) (*Role, error) {
 	role := &Role{}
 
-	stmt, err := repo.DB.Prepare("SELECT * FROM roles WHERE id = ?")
+	stmt, err := repo.DB.Prepare(`
+	SELECT id, name, require_verified, require_totp, protected, is_default 
+	FROM roles WHERE id = ?`)
 
 	if err != nil {
 		log.Println(err)
@@ -95,30 +249,197 @@ func (repo *Repo) GetByID(id int64) (*Role, error) {
 
 	defer stmt.Close()
 
-	err = stmt.QueryRow(id).Scan(&role.ID, &role.Name, &role.Code)
+	err = stmt.QueryRow(id).Scan(&role.ID, &role.Name, &role.Require_Verified, &role.Require_TOTP, &role.Protected, &role.Default)
 
 	if err != nil {
 		log.Println(err)
 		return nil, err
 	}
 
-	return role, err
+	role.Permissions = []string{}
+	rows, err := repo.DB.Query("SELECT permission FROM role_permissions WHERE role_id = ? ORDER BY permission", id)
+	if err != nil {
+		log.Println(err)
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var name string
+		if err = rows.Scan(&name); err != nil {
+			log.Println(err)
+			return nil, err
+		}
+		role.Permissions = append(role.Permissions, name)
+	}
+
+	return role, nil
 }
 
 func (repo *Repo) GetAll() []*Role {
 	roles := []*Role{}
 
-	rows, err := repo.DB.Query(`SELECT * FROM roles`)
+	rows, err := repo.DB.Query(`
+	SELECT id, name, require_verified, require_totp, protected, is_default 
+	FROM roles`)
 
 	if err != nil {
 		log.Println(err)
+		return roles
 	}
 
+	byID := map[int64]*Role{}
 	for rows.Next() {
 		var role Role
-		rows.Scan(&role.ID, &role.Name, &role.Code)
+		rows.Scan(&role.ID, &role.Name, &role.Require_Verified, &role.Require_TOTP, &role.Protected, &role.Default)
+		role.Permissions = []string{}
 		roles = append(roles, &role)
+		byID[role.ID] = &role
+	}
+	rows.Close()
+
+	rows, err = repo.DB.Query("SELECT role_id, permission FROM role_permissions ORDER BY permission")
+	if err != nil {
+		log.Println(err)
+		return roles
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var id int64
+		var name string
+		rows.Scan(&id, &name)
+		if role, ok := byID[id]; ok {
+			role.Permissions = append(role.Permissions, name)
+		}
 	}
 
 	return roles
 }
+
+// MigrateCodes turns the bitmask codes roles had before role_permissions
+// into permission rows. Converted codes are zeroed so it only runs once per role.
+func (repo *Repo) MigrateCodes() error {
+	ctx := context.Background()
+
+	tx, err := repo.DB.BeginTx(ctx, nil)
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+
+	rows, err := tx.QueryContext(ctx, "SELECT id, code FROM roles WHERE code != 0")
+	if err != nil {
+		log.Println(err)
+		tx.Rollback()
+		return err
+	}
+
+	codes := map[int64]int64{}
+	for rows.Next() {
+		var id, code int64
+		if err = rows.Scan(&id, &code); err != nil {
+			log.Println(err)
+			rows.Close()
+			tx.Rollback()
+			return err
+		}
+		codes[id] = code
+	}
+	rows.Close()
+
+	for id, code := range codes {
+		for _, name := range FromCode(code) {
+			_, err = tx.ExecContext(ctx, "INSERT OR IGNORE INTO role_permissions (role_id, permission) VALUES (?, ?)", id, name)
+			if err != nil {
+				log.Println(err)
+				tx.Rollback()
+				return err
+			}
+		}
+	}
+
+	if _, err = tx.ExecContext(ctx, "UPDATE roles SET code = 0"); err != nil {
+		log.Println(err)
+		tx.Rollback()
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		log.Println(err)
+	}
+
+	return err
+}
+
+// Assign changes the role of a user and records who did it in the same transaction.
+func (repo *Repo) Assign(assignment *Assignment) error {
+	ctx := context.Background()
+
+	tx, err := repo.DB.BeginTx(ctx, nil)
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, "UPDATE users SET role_id = ? WHERE id = ?", assignment.New_Role_ID, assignment.User_ID)
+	if err != nil {
+		log.Println(err)
+		tx.Rollback()
+		return err
+	}
+
+	result, err := tx.ExecContext(ctx, `
+	INSERT INTO 
+	role_assignments (user_id, actor_id, old_role_id, new_role_id, created_at) 
+	values (?, ?, ?, ?, ?)`,
+		assignment.User_ID, assignment.Actor_ID, assignment.Old_Role_ID, assignment.New_Role_ID, assignment.Created_At)
+	if err != nil {
+		log.Println(err)
+		tx.Rollback()
+		return err
+	}
+
+	if assignment.ID, err = result.LastInsertId(); err != nil {
+		log.Println(err)
+		tx.Rollback()
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		log.Println(err)
+	}
+
+	return err
+}
+
+func (repo *Repo) GetAssignments(userID int64) []*Assignment {
+	assignments := []*Assignment{}
+
+	rows, err := repo.DB.Query(`
+	SELECT id, user_id, actor_id, old_role_id, new_role_id, created_at 
+	FROM role_assignments WHERE user_id = ? ORDER BY id DESC`, userID)
+	if err != nil {
+		log.Println(err)
+		return assignments
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		assignment := &Assignment{}
+		err = rows.Scan(&assignment.ID, &assignment.User_ID, &assignment.Actor_ID,
+			&assignment.Old_Role_ID, &assignment.New_Role_ID, &assignment.Created_At)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		assignments = append(assignments, assignment)
+	}
+
+	return assignments
+}
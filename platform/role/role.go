@@ -2,30 +2,171 @@ package role
 
 import (
 	"errors"
+	"fmt"
 	"net/http"
 
 	"github.com/go-chi/render"
 )
 
+var ErrProtected = errors.New("Built-in roles can't be deleted.")
+
 const (
-	Empty                  = 0
-	CanComment             = 1
-	CanPostArticle         = 2
-	CanManageOtherComments = 4
-	CanManageOtherArticle  = 8
-	CanManageRole          = 16
-	CanAssignRole          = 32
-	CanManageOtherUsers    = 64
+	CanComment             = "comment.create"
+	CanPostArticle         = "article.create"
+	CanManageOtherComments = "comment.moderate"
+	CanManageOtherArticle  = "article.moderate"
+	CanManageRole          = "role.manage"
+	CanAssignRole          = "role.assign"
+	CanManageOtherUsers    = "user.manage"
+	CanReadAudit           = "audit.read"
+	CanPublishArticle      = "article.publish"
+	CanManageTags          = "tag.manage"
 )
 
+type Permission struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}
+
+// Permissions lists every permission a role can hold. New capabilities are
+// added here, the first seven are in the order of the old code bits.
+var Permissions = []Permission{
+	{CanComment, "Write comments."},
+	{CanPostArticle, "Write articles."},
+	{CanManageOtherComments, "Edit and delete comments of other users."},
+	{CanManageOtherArticle, "Edit and delete articles of other users."},
+	{CanManageRole, "Create, edit and delete roles."},
+	{CanAssignRole, "Change the role of other users."},
+	{CanManageOtherUsers, "Manage the accounts of other users."},
+	{CanReadAudit, "Read the audit log of privileged actions."},
+	{CanPublishArticle, "Publish articles and review the ones submitted."},
+	{CanManageTags, "Rename, merge and delete tags and manage categories."},
+}
+
+// legacyBits is how many Permissions had a bit in the old int64 codes.
+const legacyBits = 7
+
+func IsPermission(name string) bool {
+	for _, permission := range Permissions {
+		if permission.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// CleanPermissions checks that every name is a known permission and drops duplicates.
+func CleanPermissions(names []string) ([]string, error) {
+	clean := []string{}
+	seen := map[string]bool{}
+	for _, name := range names {
+		if !IsPermission(name) {
+			return nil, fmt.Errorf("Unknown permission %q.", name)
+		}
+		if !seen[name] {
+			seen[name] = true
+			clean = append(clean, name)
+		}
+	}
+	return clean, nil
+}
+
+// FromCode converts an old bitmask code to permission names.
+func FromCode(code int64) []string {
+	names := []string{}
+	for i := 0; i < legacyBits; i++ {
+		if code&(1<<uint(i)) != 0 {
+			names = append(names, Permissions[i].Name)
+		}
+	}
+	return names
+}
+
 type Role struct {
-	ID   int64  `json:"id"`
-	Name string `json:"name"`
-	Code int64  `json:"code"`
+	ID               int64    `json:"id"`
+	Name             string   `json:"name"`
+	Permissions      []string `json:"permissions"`
+	Require_Verified bool     `json:"require_verified"` // unverified users can't comment or post.
+	Require_TOTP     bool     `json:"require_totp"`     // managing roles or other users needs 2FA.
+	Protected        bool     `json:"protected"`        // built-in, can't be deleted.
+	Default          bool     `json:"default"`          // given to new users.
+}
+
+func (role *Role) Check(permission string) bool {
+	for _, name := range role.Permissions {
+		if name == permission {
+			return true
+		}
+	}
+	return false
+}
+
+// Covers reports whether the role holds every permission of the other one.
+func (role *Role) Covers(other *Role) bool {
+	for _, name := range other.Permissions {
+		if !role.Check(name) {
+			return false
+		}
+	}
+	return true
+}
+
+// Restrict narrows the role down to the given permissions.
+func (role *Role) Restrict(permissions []string) {
+	kept := []string{}
+	for _, name := range role.Permissions {
+		for _, allowed := range permissions {
+			if name == allowed {
+				kept = append(kept, name)
+				break
+			}
+		}
+	}
+	role.Permissions = kept
 }
 
-func (role *Role) Check(action int64) bool {
-	return role.Code|action == role.Code
+// Assignment is an entry of the audit trail of role changes.
+type Assignment struct {
+	ID          int64 `json:"id"`
+	User_ID     int64 `json:"user_id"`
+	Actor_ID    int64 `json:"actor_id"`
+	Old_Role_ID int64 `json:"old_role_id"`
+	New_Role_ID int64 `json:"new_role_id"`
+	Created_At  int64 `json:"created_at"`
+}
+
+type AssignmentPayload struct {
+	*Assignment
+}
+
+func NewAssignmentListPayload(assignments []*Assignment) []render.Renderer {
+	list := []render.Renderer{}
+	for _, assignment := range assignments {
+		list = append(list, &AssignmentPayload{Assignment: assignment})
+	}
+	return list
+}
+
+func (ap *AssignmentPayload) Render(w http.ResponseWriter, r *http.Request) error {
+	//do stuff on payload before send
+	return nil
+}
+
+type PermissionPayload struct {
+	*Permission
+}
+
+func NewPermissionListPayload(permissions []Permission) []render.Renderer {
+	list := []render.Renderer{}
+	for i := range permissions {
+		list = append(list, &PermissionPayload{Permission: &permissions[i]})
+	}
+	return list
+}
+
+func (pp *PermissionPayload) Render(w http.ResponseWriter, r *http.Request) error {
+	//do stuff on payload before send
+	return nil
 }
 
 type RolePayload struct {
@@ -49,6 +190,11 @@ func (rp *RolePayload) Bind(r *http.Request) error {
 	if rp.Role == nil {
 		return errors.New("missing required Role fields.")
 	}
+	names, err := CleanPermissions(rp.Permissions)
+	if err != nil {
+		return err
+	}
+	rp.Permissions = names
 	return nil
 }
 
@@ -0,0 +1,303 @@
+package session
+
+import (
+	"context"
+	"database/sql"
+	"go-blog/platform/token"
+	"log"
+	"time"
+)
+
+type Repo struct {
+	DB *sql.DB
+}
+
+func NewRepo(db *sql.DB) *Repo {
+	return &Repo{
+		DB: db,
+	}
+}
+
+// Create opens a new session for the user and returns it with its first refresh token.
+func (repo *Repo) Create(userID int64, expiresAt int64, mfa bool, userAgent string, ip string) (*Session, string, error) {
+	ctx := context.Background()
+
+	plain, hash, err := token.New()
+	if err != nil {
+		log.Println(err)
+		return nil, "", err
+	}
+
+	tx, err := repo.DB.BeginTx(ctx, nil)
+	if err != nil {
+		log.Println(err)
+		return nil, "", err
+	}
+
+	now := time.Now().Unix()
+	sess := &Session{User_ID: userID, Created_At: now, Expires_At: expiresAt, MFA: mfa,
+		User_Agent: userAgent, IP: ip, Last_Seen_At: now}
+
+	result, err := tx.ExecContext(ctx, `
+	INSERT INTO 
+	sessions (user_id, created_at, expires_at, mfa, user_agent, ip, last_seen_at) 
+	VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		sess.User_ID, sess.Created_At, sess.Expires_At, sess.MFA, sess.User_Agent, sess.IP, sess.Last_Seen_At)
+	if err != nil {
+		log.Println(err)
+		tx.Rollback()
+		return nil, "", err
+	}
+
+	if sess.ID, err = result.LastInsertId(); err != nil {
+		log.Println(err)
+		tx.Rollback()
+		return nil, "", err
+	}
+
+	_, err = tx.ExecContext(ctx, "INSERT INTO refresh_tokens (session_id, token_hash, created_at) VALUES (?, ?, ?)",
+		sess.ID, hash, sess.Created_At)
+	if err != nil {
+		log.Println(err)
+		tx.Rollback()
+		return nil, "", err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		log.Println(err)
+		return nil, "", err
+	}
+
+	return sess, plain, nil
+}
+
+// Rotate consumes a refresh token and issues the next one of the same session.
+// Presenting an already used token revokes the whole session.
+func (repo *Repo) Rotate(plain string, userAgent string, ip string) (*Session, string, error) {
+	ctx := context.Background()
+
+	tx, err := repo.DB.BeginTx(ctx, nil)
+	if err != nil {
+		log.Println(err)
+		return nil, "", err
+	}
+
+	sess := &Session{}
+	var tokenID int64
+	var used bool
+
+	err = tx.QueryRowContext(ctx, `
+	SELECT refresh_tokens.id, refresh_tokens.used, 
+	sessions.id, sessions.user_id, sessions.created_at, sessions.expires_at, sessions.revoked, sessions.mfa 
+	FROM refresh_tokens INNER JOIN sessions ON sessions.id = refresh_tokens.session_id 
+	WHERE refresh_tokens.token_hash = ?`, token.Hash(plain)).Scan(
+		&tokenID, &used, &sess.ID, &sess.User_ID, &sess.Created_At, &sess.Expires_At, &sess.Revoked, &sess.MFA)
+
+	switch {
+	case err == sql.ErrNoRows:
+		tx.Rollback()
+		return nil, "", ErrInvalidToken
+	case err != nil:
+		log.Println(err)
+		tx.Rollback()
+		return nil, "", err
+	case sess.Revoked || sess.Expires_At <= time.Now().Unix():
+		tx.Rollback()
+		return nil, "", ErrInvalidToken
+	case used:
+		if _, err = tx.ExecContext(ctx, "UPDATE sessions SET revoked = 1 WHERE id = ?", sess.ID); err != nil {
+			log.Println(err)
+			tx.Rollback()
+			return nil, "", err
+		}
+		if err = tx.Commit(); err != nil {
+			log.Println(err)
+			return nil, "", err
+		}
+		return nil, "", ErrTokenReused
+	}
+
+	newToken, hash, err := token.New()
+	if err != nil {
+		log.Println(err)
+		tx.Rollback()
+		return nil, "", err
+	}
+
+	if _, err = tx.ExecContext(ctx, "UPDATE refresh_tokens SET used = 1 WHERE id = ?", tokenID); err != nil {
+		log.Println(err)
+		tx.Rollback()
+		return nil, "", err
+	}
+
+	_, err = tx.ExecContext(ctx, "UPDATE sessions SET user_agent = ?, ip = ?, last_seen_at = ? WHERE id = ?",
+		userAgent, ip, time.Now().Unix(), sess.ID)
+	if err != nil {
+		log.Println(err)
+		tx.Rollback()
+		return nil, "", err
+	}
+
+	_, err = tx.ExecContext(ctx, "INSERT INTO refresh_tokens (session_id, token_hash, created_at) VALUES (?, ?, ?)",
+		sess.ID, hash, time.Now().Unix())
+	if err != nil {
+		log.Println(err)
+		tx.Rollback()
+		return nil, "", err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		log.Println(err)
+		return nil, "", err
+	}
+
+	return sess, newToken, nil
+}
+
+// Seen reports whether the session is still active and records the
+// request on it when last_seen_at is older than SeenInterval.
+func (repo *Repo) Seen(id int64, userID int64, userAgent string, ip string) bool {
+	now := time.Now().Unix()
+
+	var lastSeen int64
+	err := repo.DB.QueryRow(`
+	SELECT last_seen_at FROM sessions 
+	WHERE id = ? AND user_id = ? AND revoked = 0 AND expires_at > ?`, id, userID, now).Scan(&lastSeen)
+	if err == sql.ErrNoRows {
+		return false
+	} else if err != nil {
+		log.Println(err)
+		return false
+	}
+
+	if now-lastSeen >= SeenInterval {
+		_, err = repo.DB.Exec("UPDATE sessions SET user_agent = ?, ip = ?, last_seen_at = ? WHERE id = ?",
+			userAgent, ip, now, id)
+		if err != nil {
+			log.Println(err)
+		}
+	}
+
+	return true
+}
+
+// GetActiveFor lists the sessions of the user that can still be used,
+// most recently seen first.
+func (repo *Repo) GetActiveFor(userID int64) []*Session {
+	sessions := make([]*Session, 0)
+
+	rows, err := repo.DB.Query(`
+	SELECT id, user_id, created_at, expires_at, revoked, mfa, user_agent, ip, last_seen_at 
+	FROM sessions WHERE user_id = ? AND revoked = 0 AND expires_at > ? 
+	ORDER BY last_seen_at DESC`, userID, time.Now().Unix())
+	if err != nil {
+		log.Println(err)
+		return sessions
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		sess := &Session{}
+		err = rows.Scan(&sess.ID, &sess.User_ID, &sess.Created_At, &sess.Expires_At, &sess.Revoked,
+			&sess.MFA, &sess.User_Agent, &sess.IP, &sess.Last_Seen_At)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		sessions = append(sessions, sess)
+	}
+
+	return sessions
+}
+
+// RevokeFor revokes a session only if it belongs to the user,
+// returning sql.ErrNoRows otherwise.
+func (repo *Repo) RevokeFor(id int64, userID int64) error {
+	stmt, err := repo.DB.Prepare("UPDATE sessions SET revoked = 1 WHERE id = ? AND user_id = ? AND revoked = 0")
+
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+
+	defer stmt.Close()
+
+	result, err := stmt.Exec(id, userID)
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+
+	if affected, err := result.RowsAffected(); err != nil {
+		log.Println(err)
+		return err
+	} else if affected == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
+
+// RevokeOthers revokes every session of the user except the kept one.
+func (repo *Repo) RevokeOthers(userID int64, keepID int64) (int64, error) {
+	stmt, err := repo.DB.Prepare("UPDATE sessions SET revoked = 1 WHERE user_id = ? AND id != ? AND revoked = 0")
+
+	if err != nil {
+		log.Println(err)
+		return 0, err
+	}
+
+	defer stmt.Close()
+
+	result, err := stmt.Exec(userID, keepID)
+	if err != nil {
+		log.Println(err)
+		return 0, err
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		log.Println(err)
+	}
+
+	return affected, err
+}
+
+func (repo *Repo) Revoke(id int64) error {
+	stmt, err := repo.DB.Prepare("UPDATE sessions SET revoked = 1 WHERE id = ?")
+
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+
+	defer stmt.Close()
+
+	if _, err = stmt.Exec(id); err != nil {
+		log.Println(err)
+		return err
+	}
+
+	return nil
+}
+
+func (repo *Repo) RevokeAllFor(userID int64) error {
+	stmt, err := repo.DB.Prepare("UPDATE sessions SET revoked = 1 WHERE user_id = ?")
+
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+
+	defer stmt.Close()
+
+	if _, err = stmt.Exec(userID); err != nil {
+		log.Println(err)
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,71 @@
+package session
+
+import (
+	"errors"
+	"net"
+	"net/http"
+
+	"github.com/go-chi/render"
+)
+
+var ErrInvalidToken = errors.New("Invalid refresh token.")
+var ErrTokenReused = errors.New("Refresh token reused, session revoked.")
+
+// SeenInterval is how stale last_seen_at may get before a request updates it,
+// so authenticated requests don't all write to the db.
+const SeenInterval = 60
+
+const maxUserAgent = 255
+
+// Session groups a chain of rotating refresh tokens issued by a single login.
+// Access tokens carry the session id so they die with the session.
+type Session struct {
+	ID         int64 `json:"id"`
+	User_ID    int64 `json:"-"`
+	Created_At int64 `json:"created_at"`
+	Expires_At int64 `json:"expires_at"`
+	Revoked    bool  `json:"-"`
+	MFA        bool  `json:"mfa"` // logged in with a second factor.
+
+	User_Agent   string `json:"user_agent"`
+	IP           string `json:"ip"`
+	Last_Seen_At int64  `json:"last_seen_at"`
+	Current      bool   `json:"current"` // the session the request was made with.
+}
+
+type SessionPayload struct {
+	*Session
+}
+
+func NewSessionPayload(sess *Session) *SessionPayload {
+	return &SessionPayload{Session: sess}
+}
+
+func NewSessionListPayload(sessions []*Session) []render.Renderer {
+	list := []render.Renderer{}
+	for _, sess := range sessions {
+		list = append(list, NewSessionPayload(sess))
+	}
+	return list
+}
+
+func (s *SessionPayload) Render(w http.ResponseWriter, r *http.Request) error {
+	//do stuff on payload before send
+	return nil
+}
+
+// Client describes where a request came from, the address is the one
+// set by handler.RealIP.
+func Client(r *http.Request) (string, string) {
+	ip := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(ip); err == nil {
+		ip = host
+	}
+
+	userAgent := r.UserAgent()
+	if len(userAgent) > maxUserAgent {
+		userAgent = userAgent[:maxUserAgent]
+	}
+
+	return userAgent, ip
+}
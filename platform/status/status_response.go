@@ -1,7 +1,10 @@
 package status
 
 import (
+	"math"
 	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/go-chi/render"
 )
@@ -10,9 +13,13 @@ type StatusResponse struct {
 	HTTPStatusCode int    `json:"-"`
 	StatusText     string `json:"status"`
 	ErrorText      string `json:"error,omitempty"`
+	RetryAfter     int64  `json:"retry_after,omitempty"` // seconds
 }
 
 func (e *StatusResponse) Render(w http.ResponseWriter, r *http.Request) error {
+	if e.RetryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.FormatInt(e.RetryAfter, 10))
+	}
 	render.Status(r, e.HTTPStatusCode)
 	return nil
 }
@@ -57,6 +64,23 @@ func ErrUnauthorized(err string) render.Renderer {
 	}
 }
 
+func ErrForbidden(err string) render.Renderer {
+	return &StatusResponse{
+		HTTPStatusCode: 403,
+		StatusText:     "Forbidden.",
+		ErrorText:      err,
+	}
+}
+
+func ErrTooManyRequests(err string, retryAfter time.Duration) render.Renderer {
+	return &StatusResponse{
+		HTTPStatusCode: 429,
+		StatusText:     "Too many requests.",
+		ErrorText:      err,
+		RetryAfter:     int64(math.Ceil(retryAfter.Seconds())),
+	}
+}
+
 func DelSuccess() render.Renderer {
 	return &StatusResponse{
 		HTTPStatusCode: 200,
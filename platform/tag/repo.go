@@ -0,0 +1,211 @@
+package tag
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"time"
+)
+
+const TAGS_IN_PAGE = 50
+
+type Search struct {
+	query         string
+	params        []interface{}
+	isConditioned bool
+}
+
+// NewSearch counts the articles of each tag that meet published, which is
+// article.PublishedCondition: this package can't import article since
+// article imports it.
+func NewSearch(published string) *Search {
+	return &Search{
+		query: `SELECT id, name,
+		(SELECT COUNT(*) FROM article_tags JOIN articles ON articles.id = article_tags.article_id
+			WHERE tag_id = tags.id AND ` + published + `) article_count
+		FROM tags `,
+		params:        []interface{}{time.Now().Unix()},
+		isConditioned: false,
+	}
+}
+
+func (s *Search) ApplyCondition() {
+	if s.isConditioned {
+		s.query += `AND `
+	} else {
+		s.query += `WHERE `
+		s.isConditioned = true
+	}
+}
+
+// QueryPrefix keeps the tags starting with the prefix, for completion.
+func (s *Search) QueryPrefix(prefix string) {
+	if prefix = Normalize(prefix); prefix != "" {
+		s.ApplyCondition()
+		s.query += `substr(name, 1, length(?)) = ? `
+		s.params = append(s.params, prefix, prefix)
+	}
+}
+
+// QueryUsed leaves out the tags no published article has.
+func (s *Search) QueryUsed() {
+	s.ApplyCondition()
+	s.query += `article_count > 0 `
+}
+
+func (s *Search) Limit(page int) {
+	from := (page - 1) * TAGS_IN_PAGE
+	s.query += `ORDER BY article_count DESC, name LIMIT ?, ?`
+	s.params = append(s.params, from, TAGS_IN_PAGE)
+}
+
+type Repo struct {
+	DB *sql.DB
+}
+
+func NewRepo(db *sql.DB) *Repo {
+	return &Repo{
+		DB: db,
+	}
+}
+
+func (repo *Repo) GetMultiple(search *Search) []*Tag {
+	tags := []*Tag{}
+
+	rows, err := repo.DB.Query(search.query, search.params...)
+	if err != nil {
+		log.Println(err)
+		return tags
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var tag Tag
+		rows.Scan(&tag.ID, &tag.Name, &tag.Article_Count)
+		tags = append(tags, &tag)
+	}
+
+	return tags
+}
+
+// GetByName returns the tag, counting its articles like NewSearch.
+func (repo *Repo) GetByName(name string, published string) (*Tag, error) {
+	search := NewSearch(published)
+	search.ApplyCondition()
+	search.query += `name = ?`
+	search.params = append(search.params, Normalize(name))
+
+	tag := &Tag{}
+	err := repo.DB.QueryRow(search.query, search.params...).Scan(&tag.ID, &tag.Name, &tag.Article_Count)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Println(err)
+		}
+		return nil, err
+	}
+
+	return tag, nil
+}
+
+// Rename gives the tag a name no other tag has, on every article it is on.
+func (repo *Repo) Rename(id int64, name string) error {
+	var exists bool
+	err := repo.DB.QueryRow("SELECT 1 FROM tags WHERE name = ? AND id != ?", name, id).Scan(&exists)
+	if err == nil {
+		return ErrExists
+	} else if err != sql.ErrNoRows {
+		log.Println(err)
+		return err
+	}
+
+	if _, err = repo.DB.Exec("UPDATE tags SET name = ? WHERE id = ?", name, id); err != nil {
+		log.Println(err)
+		return err
+	}
+
+	return nil
+}
+
+// Merge moves the articles of a tag to another one and deletes it,
+// returning how many articles got the other tag.
+func (repo *Repo) Merge(id int64, intoID int64) (int64, error) {
+	ctx := context.Background()
+
+	tx, err := repo.DB.BeginTx(ctx, nil)
+	if err != nil {
+		log.Println(err)
+		return 0, err
+	}
+
+	result, err := tx.ExecContext(ctx, `
+	INSERT OR IGNORE INTO article_tags (article_id, tag_id)
+	SELECT article_id, ? FROM article_tags WHERE tag_id = ?`, intoID, id)
+	if err != nil {
+		log.Println(err)
+		tx.Rollback()
+		return 0, err
+	}
+
+	moved, err := result.RowsAffected()
+	if err != nil {
+		log.Println(err)
+		tx.Rollback()
+		return 0, err
+	}
+
+	_, err = tx.ExecContext(ctx, "DELETE FROM article_tags WHERE tag_id = ?", id)
+	if err != nil {
+		log.Println(err)
+		tx.Rollback()
+		return 0, err
+	}
+
+	_, err = tx.ExecContext(ctx, "DELETE FROM tags WHERE id = ?", id)
+	if err != nil {
+		log.Println(err)
+		tx.Rollback()
+		return 0, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		log.Println(err)
+		return 0, err
+	}
+
+	return moved, nil
+}
+
+// Delete removes the tag from every article.
+func (repo *Repo) Delete(id int64) error {
+	ctx := context.Background()
+
+	tx, err := repo.DB.BeginTx(ctx, nil)
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, "DELETE FROM article_tags WHERE tag_id = ?", id)
+	if err != nil {
+		log.Println(err)
+		tx.Rollback()
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, "DELETE FROM tags WHERE id = ?", id)
+	if err != nil {
+		log.Println(err)
+		tx.Rollback()
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+
+	return nil
+}
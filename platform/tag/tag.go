@@ -0,0 +1,78 @@
+package tag
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/go-chi/render"
+)
+
+// MaxPerArticle is how many tags an article can have.
+const MaxPerArticle = 10
+
+var (
+	ErrInvalid = errors.New("Tags are up to 32 letters, digits or - _ . + # and start with a letter or digit.")
+	ErrTooMany = fmt.Errorf("An article can have up to %d tags.", MaxPerArticle)
+	ErrExists  = errors.New("A tag with this name already exists, merge them instead.")
+)
+
+var nameRegex = regexp.MustCompile(`^[\p{L}\p{N}][\p{L}\p{N}_.+#-]{0,31}$`)
+
+type Tag struct {
+	ID            int64  `json:"id"`
+	Name          string `json:"name"`
+	Article_Count int64  `json:"article_count"` // published ones.
+}
+
+// Normalize lowercases a tag and joins its words with dashes, so "Go Lang"
+// and "go-lang" are the same tag.
+func Normalize(name string) string {
+	return strings.ToLower(strings.Join(strings.Fields(name), "-"))
+}
+
+func IsValid(name string) bool {
+	return nameRegex.MatchString(name)
+}
+
+// Clean normalizes the tags of an article, dropping empty ones and duplicates.
+func Clean(names []string) ([]string, error) {
+	clean := []string{}
+	seen := map[string]bool{}
+	for _, name := range names {
+		name = Normalize(name)
+		if name == "" || seen[name] {
+			continue
+		}
+		if !IsValid(name) {
+			return nil, ErrInvalid
+		}
+		seen[name] = true
+		clean = append(clean, name)
+	}
+
+	if len(clean) > MaxPerArticle {
+		return nil, ErrTooMany
+	}
+
+	return clean, nil
+}
+
+type TagPayload struct {
+	*Tag
+}
+
+func NewTagListPayload(tags []*Tag) []render.Renderer {
+	list := []render.Renderer{}
+	for _, tag := range tags {
+		list = append(list, &TagPayload{Tag: tag})
+	}
+	return list
+}
+
+func (t *TagPayload) Render(w http.ResponseWriter, r *http.Request) error {
+	//do stuff on payload before send
+	return nil
+}
@@ -0,0 +1,123 @@
+package throttle
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"time"
+)
+
+type Repo struct {
+	DB *sql.DB
+}
+
+func NewRepo(db *sql.DB) *Repo {
+	return &Repo{
+		DB: db,
+	}
+}
+
+// Take counts an attempt against every key unless one of them has to wait,
+// in which case nothing is counted and the longest wait is returned. The
+// check and the count are one transaction so parallel attempts can't all
+// pass the check before any of them is counted. Expired failures are
+// forgotten first, the attempt is given back with Refund when it succeeds.
+func (repo *Repo) Take(policies map[string]Policy, now time.Time) (time.Duration, error) {
+	ctx := context.Background()
+
+	tx, err := repo.DB.BeginTx(ctx, nil)
+	if err != nil {
+		log.Println(err)
+		return 0, err
+	}
+
+	// writing first takes the write lock, so the reads below can't race.
+	for key := range policies {
+		_, err = tx.ExecContext(ctx, "INSERT OR IGNORE INTO login_attempts (key, failures, last_failure_at) VALUES (?, 0, 0)", key)
+		if err != nil {
+			log.Println(err)
+			tx.Rollback()
+			return 0, err
+		}
+	}
+
+	attempts := map[string]*Attempt{}
+	var wait time.Duration
+	for key, policy := range policies {
+		attempt := &Attempt{Key: key}
+		err = tx.QueryRowContext(ctx, "SELECT failures, last_failure_at FROM login_attempts WHERE key = ?", key).Scan(
+			&attempt.Failures, &attempt.Last_Failure_At)
+		if err != nil {
+			log.Println(err)
+			tx.Rollback()
+			return 0, err
+		}
+
+		if policy.Expired(attempt, now) {
+			attempt.Failures = 0
+		} else if keyWait := policy.Wait(attempt, now); keyWait > wait {
+			wait = keyWait
+		}
+		attempts[key] = attempt
+	}
+
+	if wait > 0 {
+		tx.Rollback()
+		return wait, nil
+	}
+
+	for key, attempt := range attempts {
+		_, err = tx.ExecContext(ctx, "UPDATE login_attempts SET failures = ?, last_failure_at = ? WHERE key = ?",
+			attempt.Failures+1, now.Unix(), key)
+		if err != nil {
+			log.Println(err)
+			tx.Rollback()
+			return 0, err
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		log.Println(err)
+		return 0, err
+	}
+
+	return 0, nil
+}
+
+// Refund gives back an attempt counted by Take that turned out to succeed.
+func (repo *Repo) Refund(key string) error {
+	stmt, err := repo.DB.Prepare("UPDATE login_attempts SET failures = failures - 1 WHERE key = ? AND failures > 0")
+
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+
+	defer stmt.Close()
+
+	if _, err = stmt.Exec(key); err != nil {
+		log.Println(err)
+		return err
+	}
+
+	return nil
+}
+
+func (repo *Repo) Reset(key string) error {
+	stmt, err := repo.DB.Prepare("DELETE FROM login_attempts WHERE key = ?")
+
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+
+	defer stmt.Close()
+
+	if _, err = stmt.Exec(key); err != nil {
+		log.Println(err)
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,79 @@
+package throttle
+
+import (
+	"net"
+	"strings"
+	"time"
+)
+
+// Policy decides how long a key has to wait after failed attempts.
+type Policy struct {
+	FreeAttempts     int           // failures allowed before any delay.
+	BaseDelay        time.Duration // first delay, doubled on every further failure.
+	MaxDelay         time.Duration
+	LockoutThreshold int // failures that lock the key for LockoutDuration.
+	LockoutDuration  time.Duration
+	Window           time.Duration // failures below the lockout are forgotten after this long without another.
+}
+
+type Limits struct {
+	Account Policy
+	IP      Policy
+}
+
+type Attempt struct {
+	Key             string
+	Failures        int
+	Last_Failure_At int64
+}
+
+// Wait returns how long the key must wait before it may try again.
+func (p Policy) Wait(a *Attempt, now time.Time) time.Duration {
+	last := time.Unix(a.Last_Failure_At, 0)
+
+	var until time.Time
+	switch {
+	case a.Failures >= p.LockoutThreshold:
+		until = last.Add(p.LockoutDuration)
+	case a.Failures > p.FreeAttempts:
+		delay := p.BaseDelay << uint(a.Failures-p.FreeAttempts-1)
+		if delay > p.MaxDelay || delay <= 0 {
+			delay = p.MaxDelay
+		}
+		until = last.Add(delay)
+	default:
+		return 0
+	}
+
+	if wait := until.Sub(now); wait > 0 {
+		return wait
+	}
+	return 0
+}
+
+// Expired reports whether the failures of a key should be forgotten so it
+// starts over: a served lockout, so it isn't locked again on the next
+// failure, or failures below the lockout that are older than the Window.
+func (p Policy) Expired(a *Attempt, now time.Time) bool {
+	if a.Failures >= p.LockoutThreshold {
+		return p.Wait(a, now) == 0
+	}
+	return p.Window > 0 && now.Sub(time.Unix(a.Last_Failure_At, 0)) >= p.Window
+}
+
+func AccountKey(email string) string {
+	return "account:" + strings.ToLower(email)
+}
+
+// OIDCKey counts the provider logins started from an address, apart from
+// its failed password logins.
+func OIDCKey(remoteAddr string) string {
+	return "oidc-" + IPKey(remoteAddr)
+}
+
+func IPKey(remoteAddr string) string {
+	if host, _, err := net.SplitHostPort(remoteAddr); err == nil {
+		return "ip:" + host
+	}
+	return "ip:" + remoteAddr
+}
@@ -0,0 +1,33 @@
+package token
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+)
+
+// Random returns 32 random bytes, url safe base64 encoded.
+func Random() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// New returns a random token and the hash stored in the db in its place.
+func New() (string, string, error) {
+	token, err := Random()
+	if err != nil {
+		return "", "", err
+	}
+	return token, Hash(token), nil
+}
+
+// Hash is what gets stored for a token, so the db alone can't be used to
+// sign in. Tokens are random enough that a plain SHA-256 will do.
+func Hash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
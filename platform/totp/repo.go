@@ -0,0 +1,213 @@
+package totp
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"time"
+)
+
+type Repo struct {
+	DB *sql.DB
+}
+
+func NewRepo(db *sql.DB) *Repo {
+	return &Repo{
+		DB: db,
+	}
+}
+
+func (repo *Repo) GetByUserID(userID int64) (*TOTP, error) {
+	totp := &TOTP{}
+
+	stmt, err := repo.DB.Prepare("SELECT * FROM user_totp WHERE user_id = ?")
+
+	if err != nil {
+		log.Println(err)
+		return nil, err
+	}
+
+	defer stmt.Close()
+
+	err = stmt.QueryRow(userID).Scan(&totp.User_ID, &totp.Secret, &totp.Enabled, &totp.Last_Step, &totp.Created_At)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return totp, nil
+}
+
+func (repo *Repo) IsEnabled(userID int64) bool {
+	totp, err := repo.GetByUserID(userID)
+	return err == nil && totp.Enabled
+}
+
+// SetPending stores a new secret that only becomes active after Enable.
+func (repo *Repo) SetPending(userID int64, secret string) error {
+	stmt, err := repo.DB.Prepare(`
+	REPLACE INTO 
+	user_totp (user_id, secret, enabled, last_step, created_at) 
+	values (?, ?, 0, 0, ?)`)
+
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+
+	defer stmt.Close()
+
+	if _, err = stmt.Exec(userID, secret, time.Now().Unix()); err != nil {
+		log.Println(err)
+		return err
+	}
+
+	return nil
+}
+
+func (repo *Repo) Enable(userID int64, step int64, recoveryCodes []string) error {
+	ctx := context.Background()
+
+	tx, err := repo.DB.BeginTx(ctx, nil)
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, "UPDATE user_totp SET enabled = 1, last_step = ? WHERE user_id = ?", step, userID)
+	if err != nil {
+		log.Println(err)
+		tx.Rollback()
+		return err
+	}
+
+	if err = replaceRecoveryCodes(ctx, tx, userID, recoveryCodes); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+
+	return nil
+}
+
+func (repo *Repo) ReplaceRecoveryCodes(userID int64, recoveryCodes []string) error {
+	ctx := context.Background()
+
+	tx, err := repo.DB.BeginTx(ctx, nil)
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+
+	if err = replaceRecoveryCodes(ctx, tx, userID, recoveryCodes); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+
+	return nil
+}
+
+func replaceRecoveryCodes(ctx context.Context, tx *sql.Tx, userID int64, recoveryCodes []string) error {
+	_, err := tx.ExecContext(ctx, "DELETE FROM recovery_codes WHERE user_id = ?", userID)
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+
+	for _, code := range recoveryCodes {
+		_, err = tx.ExecContext(ctx, "INSERT INTO recovery_codes (user_id, code_hash) VALUES (?, ?)", userID, HashRecoveryCode(code))
+		if err != nil {
+			log.Println(err)
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (repo *Repo) Disable(userID int64) error {
+	ctx := context.Background()
+
+	tx, err := repo.DB.BeginTx(ctx, nil)
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, "DELETE FROM user_totp WHERE user_id = ?", userID)
+	if err != nil {
+		log.Println(err)
+		tx.Rollback()
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, "DELETE FROM recovery_codes WHERE user_id = ?", userID)
+	if err != nil {
+		log.Println(err)
+		tx.Rollback()
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+
+	return nil
+}
+
+// Verify accepts either a current TOTP code or an unused recovery code.
+// TOTP codes can't be replayed and recovery codes are burnt on use.
+func (repo *Repo) Verify(userID int64, code string) (bool, error) {
+	totp, err := repo.GetByUserID(userID)
+	if err == sql.ErrNoRows {
+		return false, nil
+	} else if err != nil {
+		log.Println(err)
+		return false, err
+	}
+
+	if !totp.Enabled {
+		return false, nil
+	}
+
+	if step := Match(totp.Secret, code, time.Now()); step != 0 {
+		result, err := repo.DB.Exec("UPDATE user_totp SET last_step = ? WHERE user_id = ? AND last_step < ?", step, userID, step)
+		if err != nil {
+			log.Println(err)
+			return false, err
+		}
+		affected, err := result.RowsAffected()
+		if err != nil {
+			log.Println(err)
+			return false, err
+		}
+		return affected == 1, nil
+	}
+
+	result, err := repo.DB.Exec("DELETE FROM recovery_codes WHERE user_id = ? AND code_hash = ?", userID, HashRecoveryCode(code))
+	if err != nil {
+		log.Println(err)
+		return false, err
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		log.Println(err)
+		return false, err
+	}
+
+	return affected == 1, nil
+}
@@ -0,0 +1,118 @@
+package totp
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// rfcSecret is the SHA-1 key of the RFC 6238 test vectors, "12345678901234567890".
+const rfcSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestCodeAt(t *testing.T) {
+	// RFC 6238 appendix B, the last 6 of its 8 digits.
+	tests := []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+
+	for _, test := range tests {
+		code, err := CodeAt(rfcSecret, Step(time.Unix(test.unix, 0)))
+		if err != nil {
+			t.Fatalf("CodeAt(%d): %v", test.unix, err)
+		}
+		if code != test.code {
+			t.Errorf("CodeAt(%d) = %s, want %s", test.unix, code, test.code)
+		}
+	}
+}
+
+func TestCodeAtSecretCase(t *testing.T) {
+	upper, _ := CodeAt(rfcSecret, 1)
+	lower, err := CodeAt(strings.ToLower(rfcSecret), 1)
+	if err != nil || lower != upper {
+		t.Errorf("lower case secret gave %q, %v, want %q", lower, err, upper)
+	}
+}
+
+func TestCodeAtInvalidSecret(t *testing.T) {
+	if _, err := CodeAt("not base32!", 1); err == nil {
+		t.Error("CodeAt accepted a secret that isn't base32")
+	}
+}
+
+func TestMatch(t *testing.T) {
+	now := time.Unix(1234567890, 0)
+	current := Step(now)
+
+	codeAt := func(step int64) string {
+		code, err := CodeAt(rfcSecret, step)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return code
+	}
+
+	tests := []struct {
+		name   string
+		secret string
+		code   string
+		want   int64
+	}{
+		{"current step", rfcSecret, codeAt(current), current},
+		{"previous step", rfcSecret, codeAt(current - 1), current - 1},
+		{"next step", rfcSecret, codeAt(current + 1), current + 1},
+		{"two steps behind", rfcSecret, codeAt(current - 2), 0},
+		{"two steps ahead", rfcSecret, codeAt(current + 2), 0},
+		{"wrong code", rfcSecret, "000000", 0},
+		{"empty code", rfcSecret, "", 0},
+		{"code with spaces", rfcSecret, " " + codeAt(current), 0},
+		{"invalid secret", "not base32!", codeAt(current), 0},
+	}
+
+	for _, test := range tests {
+		if got := Match(test.secret, test.code, now); got != test.want {
+			t.Errorf("%s: Match = %d, want %d", test.name, got, test.want)
+		}
+	}
+}
+
+func TestRecoveryCodes(t *testing.T) {
+	codes, err := GenerateRecoveryCodes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(codes) != RecoveryCodes {
+		t.Fatalf("got %d codes, want %d", len(codes), RecoveryCodes)
+	}
+
+	seen := map[string]bool{}
+	for _, code := range codes {
+		if len(code) != RecoveryCodeLen+1 || code[5] != '-' {
+			t.Errorf("code %q isn't two groups of 5", code)
+		}
+		if seen[code] {
+			t.Errorf("code %q given twice", code)
+		}
+		seen[code] = true
+	}
+}
+
+func TestHashRecoveryCode(t *testing.T) {
+	want := HashRecoveryCode("abcde-fghij")
+	for _, typed := range []string{"abcdefghij", "ABCDE-FGHIJ", " abcde-fghij\n", "ab-cde-fghij"} {
+		if got := HashRecoveryCode(typed); got != want {
+			t.Errorf("HashRecoveryCode(%q) differs from the code as given", typed)
+		}
+	}
+	if HashRecoveryCode("abcde-fghik") == want {
+		t.Error("different codes hash the same")
+	}
+}
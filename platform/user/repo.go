@@ -4,6 +4,7 @@ import (
 	"context"
 	"database/sql"
 	"log"
+	"time"
 )
 
 const USERS_IN_PAGE = 10
@@ -101,6 +102,38 @@ func (repo *Repo) CheckFavoriteFor(id int64, articleID int64) bool {
 	return err == nil
 }
 
+// GetCoAuthorsOf returns the users credited as co-authors of the article.
+func (repo *Repo) GetCoAuthorsOf(articleID int64) []*User {
+	users := []*User{}
+
+	rows, err := repo.DB.Query(`
+	SELECT users.*,(SELECT COUNT(id) FROM favorites WHERE article_id IN (SELECT id FROM articles WHERE user_id = users.id)) karma 
+	FROM users 
+	INNER JOIN article_collaborators ON article_collaborators.user_id = users.id 
+	WHERE article_collaborators.article_id = ? AND article_collaborators.role = 'co-author' 
+	ORDER BY article_collaborators.created_at`, articleID)
+
+	if err != nil {
+		log.Println(err)
+		return users
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		user := &User{}
+		err = rows.Scan(&user.ID, &user.Role_ID, &user.Name, &user.Password,
+			&user.Email, &user.Image, &user.Created_At, &user.Verified, &user.Karma)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		users = append(users, user)
+	}
+
+	return users
+}
+
 func (repo *Repo) Delete(id int64) error {
 	ctx := context.Background()
 
@@ -117,6 +150,27 @@ func (repo *Repo) Delete(id int64) error {
 		return err
 	}
 
+	_, err = tx.ExecContext(ctx, "DELETE FROM article_revisions WHERE article_id IN (SELECT id FROM articles WHERE user_id = ?)", id)
+	if err != nil {
+		log.Println(err)
+		tx.Rollback()
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, "DELETE FROM article_slugs WHERE article_id IN (SELECT id FROM articles WHERE user_id = ?)", id)
+	if err != nil {
+		log.Println(err)
+		tx.Rollback()
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, "DELETE FROM article_tags WHERE article_id IN (SELECT id FROM articles WHERE user_id = ?)", id)
+	if err != nil {
+		log.Println(err)
+		tx.Rollback()
+		return err
+	}
+
 	_, err = tx.ExecContext(ctx, "DELETE FROM articles WHERE user_id = ?", id)
 	if err != nil {
 		log.Println(err)
@@ -131,7 +185,89 @@ func (repo *Repo) Delete(id int64) error {
 		return err
 	}
 
-	_, err = tx.ExecContext(ctx, "DELETE FROM comments WHERE user_id = ?", id)
+	// Their comments with replies stay as tombstones, like comment.Repo.Delete does.
+	_, err = tx.ExecContext(ctx, "UPDATE comments SET body = '', user_id = 0, deleted = 1 WHERE user_id = ?", id)
+	if err != nil {
+		log.Println(err)
+		tx.Rollback()
+		return err
+	}
+
+	for {
+		result, err := tx.ExecContext(ctx, `DELETE FROM comments WHERE deleted = 1 
+		AND NOT EXISTS (SELECT 1 FROM comments replies WHERE replies.parent_id = comments.id)`)
+		if err != nil {
+			log.Println(err)
+			tx.Rollback()
+			return err
+		}
+
+		if removed, err := result.RowsAffected(); err != nil {
+			log.Println(err)
+			tx.Rollback()
+			return err
+		} else if removed == 0 {
+			break
+		}
+	}
+
+	_, err = tx.ExecContext(ctx, "DELETE FROM refresh_tokens WHERE session_id IN (SELECT id FROM sessions WHERE user_id = ?)", id)
+	if err != nil {
+		log.Println(err)
+		tx.Rollback()
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, "DELETE FROM sessions WHERE user_id = ?", id)
+	if err != nil {
+		log.Println(err)
+		tx.Rollback()
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, "DELETE FROM user_tokens WHERE user_id = ?", id)
+	if err != nil {
+		log.Println(err)
+		tx.Rollback()
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, "DELETE FROM user_totp WHERE user_id = ?", id)
+	if err != nil {
+		log.Println(err)
+		tx.Rollback()
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, "DELETE FROM recovery_codes WHERE user_id = ?", id)
+	if err != nil {
+		log.Println(err)
+		tx.Rollback()
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, "DELETE FROM api_keys WHERE user_id = ?", id)
+	if err != nil {
+		log.Println(err)
+		tx.Rollback()
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, "DELETE FROM user_suspensions WHERE user_id = ?", id)
+	if err != nil {
+		log.Println(err)
+		tx.Rollback()
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, "DELETE FROM article_collaborators WHERE user_id = ?", id)
+	if err != nil {
+		log.Println(err)
+		tx.Rollback()
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, "DELETE FROM user_identities WHERE user_id = ?", id)
 	if err != nil {
 		log.Println(err)
 		tx.Rollback()
@@ -185,8 +321,8 @@ func (repo *Repo) DoesEmailExist(email string) (bool, error) {
 func (repo *Repo) Add(user *User) (int64, error) {
 	stmt, err := repo.DB.Prepare(`
 	INSERT INTO 
-	users (name,  password, email, created_at) 
-	values (?, ?, ?, ?)`)
+	users (role_id, name,  password, email, created_at) 
+	values (?, ?, ?, ?, ?)`)
 
 	if err != nil {
 		log.Println(err)
@@ -195,7 +331,7 @@ func (repo *Repo) Add(user *User) (int64, error) {
 
 	defer stmt.Close()
 
-	result, err := stmt.Exec(user.Name, user.Password, user.Email, user.Created_At)
+	result, err := stmt.Exec(user.Role_ID, user.Name, user.Password, user.Email, user.Created_At)
 	if err != nil {
 		log.Println(err)
 		return 0, err
@@ -223,7 +359,7 @@ func (repo *Repo) GetByEmail(email string) (*User, error) {
 
 	err = stmt.QueryRow(email).Scan(
 		&user.ID, &user.Role_ID, &user.Name, &user.Password,
-		&user.Email, &user.Image, &user.Created_At)
+		&user.Email, &user.Image, &user.Created_At, &user.Verified)
 
 	if err != nil {
 		log.Println(err)
@@ -246,7 +382,7 @@ func (repo *Repo) GetByID(id int64) (*User, error) {
 
 	err = stmt.QueryRow(id).Scan(
 		&user.ID, &user.Role_ID, &user.Name, &user.Password,
-		&user.Email, &user.Image, &user.Created_At, &user.Karma)
+		&user.Email, &user.Image, &user.Created_At, &user.Verified, &user.Karma)
 
 	if err != nil {
 		log.Println(err)
@@ -266,9 +402,90 @@ func (repo *Repo) GetMultiple(search *Search) []*User {
 	for rows.Next() {
 		var user User
 		rows.Scan(&user.ID, &user.Role_ID, &user.Name, &user.Password,
-			&user.Email, &user.Image, &user.Created_At, &user.Karma)
+			&user.Email, &user.Image, &user.Created_At, &user.Verified, &user.Karma)
 		users = append(users, &user)
 	}
 
 	return users
 }
+
+// Suspend applies the suspension, replacing the one the user had. Suspended
+// users are signed out everywhere, shadowed ones don't notice anything.
+func (repo *Repo) Suspend(suspension *Suspension) error {
+	ctx := context.Background()
+
+	tx, err := repo.DB.BeginTx(ctx, nil)
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `
+	REPLACE INTO 
+	user_suspensions (user_id, actor_id, mode, reason, expires_at, created_at) 
+	values (?, ?, ?, ?, ?, ?)`,
+		suspension.User_ID, suspension.Actor_ID, suspension.Mode, suspension.Reason, suspension.Expires_At, suspension.Created_At)
+	if err != nil {
+		log.Println(err)
+		tx.Rollback()
+		return err
+	}
+
+	if suspension.Mode == Suspended {
+		_, err = tx.ExecContext(ctx, "UPDATE sessions SET revoked = 1 WHERE user_id = ?", suspension.User_ID)
+		if err != nil {
+			log.Println(err)
+			tx.Rollback()
+			return err
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		log.Println(err)
+	}
+
+	return err
+}
+
+// Unsuspend lifts the suspension of the user, sql.ErrNoRows if there was none.
+func (repo *Repo) Unsuspend(userID int64) error {
+	result, err := repo.DB.Exec("DELETE FROM user_suspensions WHERE user_id = ? AND (expires_at = 0 OR expires_at > ?)",
+		userID, time.Now().Unix())
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+
+	if affected, err := result.RowsAffected(); err != nil {
+		log.Println(err)
+		return err
+	} else if affected == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
+
+// GetSuspension returns the suspension in effect for the user, sql.ErrNoRows if there is none.
+func (repo *Repo) GetSuspension(userID int64) (*Suspension, error) {
+	suspension := &Suspension{}
+
+	err := repo.DB.QueryRow(`
+	SELECT user_id, actor_id, mode, reason, expires_at, created_at 
+	FROM user_suspensions WHERE user_id = ?`, userID).Scan(&suspension.User_ID, &suspension.Actor_ID,
+		&suspension.Mode, &suspension.Reason, &suspension.Expires_At, &suspension.Created_At)
+
+	if err == sql.ErrNoRows {
+		return nil, err
+	} else if err != nil {
+		log.Println(err)
+		return nil, err
+	}
+
+	if !suspension.Active(time.Now().Unix()) {
+		return nil, sql.ErrNoRows
+	}
+
+	return suspension, nil
+}
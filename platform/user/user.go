@@ -2,6 +2,7 @@ package user
 
 import (
 	"errors"
+	"go-blog/platform/password"
 	"go-blog/platform/role"
 	"net/http"
 	"regexp"
@@ -12,12 +13,15 @@ import (
 
 var NameRegex = regexp.MustCompile(`^[a-zA-Z]+((([',. -][a-zA-Z ])?[a-zA-Z]){2,20})$`)
 var EmailRegex = regexp.MustCompile(`(.+)@(.+){2,}\.(.+){2,}`)
-var PasswordRegex = regexp.MustCompile(`^(\S{6,20})$`)
 
 type Claims struct {
 	Authenticated bool
 	RoleID        int64
 	UserID        int64
+	SessionID     int64
+	MFA           bool
+	APIKeyID      int64
+	Permissions   []string // set when an API key narrows the role.
 }
 
 var NotAuthenticated = Claims{Authenticated: false}
@@ -25,15 +29,26 @@ var NotAuthenticated = Claims{Authenticated: false}
 func NewClaimsFromMap(jClaims map[string]interface{}) Claims {
 	return Claims{
 		Authenticated: true,
-		RoleID:        int64(jClaims["role_id"].(float64)),
-		UserID:        int64(jClaims["user_id"].(float64)),
+		RoleID:        claimInt(jClaims, "role_id"),
+		UserID:        claimInt(jClaims, "user_id"),
+		SessionID:     claimInt(jClaims, "session_id"),
+		MFA:           jClaims["mfa"] == true,
 	}
 }
 
-func (c *Claims) toMap() map[string]interface{} {
+func claimInt(jClaims map[string]interface{}, name string) int64 {
+	if value, ok := jClaims[name].(float64); ok {
+		return int64(value)
+	}
+	return 0
+}
+
+func (c *Claims) ToMap() map[string]interface{} {
 	return map[string]interface{}{
-		"role_id": c.RoleID,
-		"user_id": c.UserID,
+		"role_id":    c.RoleID,
+		"user_id":    c.UserID,
+		"session_id": c.SessionID,
+		"mfa":        c.MFA,
 	}
 }
 
@@ -67,8 +82,8 @@ func (p *UpdatePassword) Bind(r *http.Request) error {
 	if p.OldPassword == "" {
 		return errors.New("Missing old password field")
 	}
-	if !PasswordRegex.MatchString(p.Password) {
-		return errors.New("Password requirements does not match.")
+	if err := password.DefaultPolicy.Check(p.Password); err != nil {
+		return err
 	}
 
 	if p.Password == p.OldPassword {
@@ -78,6 +93,110 @@ func (p *UpdatePassword) Bind(r *http.Request) error {
 	return nil
 }
 
+type ForgotPassword struct {
+	Email string `json:"email"`
+}
+
+func (f *ForgotPassword) Bind(r *http.Request) error {
+	if f.Email == "" {
+		return errors.New("Missing email field")
+	}
+	if !EmailRegex.MatchString(f.Email) {
+		return errors.New("Invalid e-mail.")
+	}
+	return nil
+}
+
+type ResetPassword struct {
+	Token    string `json:"token"`
+	Password string `json:"password"`
+}
+
+func (p *ResetPassword) Bind(r *http.Request) error {
+	if p.Token == "" {
+		return errors.New("Missing token field")
+	}
+	if p.Password == "" {
+		return errors.New("Missing password field")
+	}
+	if err := password.DefaultPolicy.Check(p.Password); err != nil {
+		return err
+	}
+	return nil
+}
+
+type TOTPLogin struct {
+	Challenge string `json:"challenge"`
+	Code      string `json:"code"`
+}
+
+func (t *TOTPLogin) Bind(r *http.Request) error {
+	if t.Challenge == "" {
+		return errors.New("Missing challenge field")
+	}
+	if t.Code == "" {
+		return errors.New("Missing code field")
+	}
+	return nil
+}
+
+const (
+	Suspended = "suspend" // can't log in or change anything.
+	Shadowed  = "shadow"  // new comments are only visible to the user.
+)
+
+// Suspension is a moderation measure on a user, lifted at Expires_At unless it is 0.
+type Suspension struct {
+	User_ID    int64  `json:"user_id"`
+	Actor_ID   int64  `json:"actor_id"`
+	Mode       string `json:"mode"`
+	Reason     string `json:"reason"`
+	Expires_At int64  `json:"expires_at"`
+	Created_At int64  `json:"created_at"`
+}
+
+// Active reports whether the suspension is still in effect at now.
+func (s *Suspension) Active(now int64) bool {
+	return s.Expires_At == 0 || s.Expires_At > now
+}
+
+type SuspensionPayload struct {
+	*Suspension
+}
+
+func NewSuspensionPayload(suspension *Suspension) *SuspensionPayload {
+	return &SuspensionPayload{Suspension: suspension}
+}
+
+func (s *SuspensionPayload) Bind(r *http.Request) error {
+	//do stuff on payload after 'receive and decode' but before binding data
+	if s.Suspension == nil {
+		return errors.New("missing required Suspension fields.")
+	}
+	if s.Mode == "" {
+		s.Mode = Suspended
+	}
+	if s.Mode != Suspended && s.Mode != Shadowed {
+		return errors.New("Mode must be 'suspend' or 'shadow'.")
+	}
+	if s.Reason == "" {
+		return errors.New("Missing reason field")
+	}
+
+	now := time.Now().Unix()
+	if s.Expires_At != 0 && s.Expires_At <= now {
+		return errors.New("Expiry must be in the future.")
+	}
+
+	s.Created_At = now
+	return nil
+}
+
+func (s *SuspensionPayload) Render(w http.ResponseWriter, r *http.Request) error {
+	//do stuff on payload before send
+	return nil
+}
+
 type User struct {
 	ID         int64  `json:"id"`
 	Role_ID    int64  `json:"-"`
@@ -85,14 +204,16 @@ type User struct {
 	Name       string `json:"name"`
 	Password   string `json:"password,omitempty"`
 	Image      string `json:"image"`
+	Verified   bool   `json:"verified"`
 	Karma      int64  `json:"karma"`
 	Created_At int64  `json:"created_at"`
 }
 
 type UserPayload struct {
 	*User
-	Role  *role.RolePayload `json:"role"`
-	Token string            `json:"token,omitempty"`
+	Role         *role.RolePayload `json:"role"`
+	Token        string            `json:"token,omitempty"`
+	RefreshToken string            `json:"refresh_token,omitempty"`
 }
 
 func NewUserPayload(user *User, roleRepo *role.Repo) *UserPayload {
@@ -119,6 +240,8 @@ func (u *UserPayload) Bind(r *http.Request) error {
 		return errors.New("missing required User fields.")
 	}
 	u.Token = ""
+	u.RefreshToken = ""
+	u.User.Verified = false
 	u.User.Created_At = time.Now().Unix()
 	return nil
 }
@@ -0,0 +1,106 @@
+package usertoken
+
+import (
+	"context"
+	"database/sql"
+	"go-blog/platform/token"
+	"log"
+	"time"
+)
+
+type Repo struct {
+	DB *sql.DB
+}
+
+func NewRepo(db *sql.DB) *Repo {
+	return &Repo{
+		DB: db,
+	}
+}
+
+// Issue creates a new token of the given kind for the user, replacing any
+// previous token of the same kind, and returns its plain value.
+func (repo *Repo) Issue(userID int64, kind string, data string, lifetime time.Duration) (string, error) {
+	ctx := context.Background()
+
+	plain, hash, err := token.New()
+	if err != nil {
+		log.Println(err)
+		return "", err
+	}
+
+	tx, err := repo.DB.BeginTx(ctx, nil)
+	if err != nil {
+		log.Println(err)
+		return "", err
+	}
+
+	_, err = tx.ExecContext(ctx, "DELETE FROM user_tokens WHERE user_id = ? AND kind = ?", userID, kind)
+	if err != nil {
+		log.Println(err)
+		tx.Rollback()
+		return "", err
+	}
+
+	_, err = tx.ExecContext(ctx, `
+	INSERT INTO 
+	user_tokens (user_id, kind, token_hash, data, expires_at) 
+	values (?, ?, ?, ?, ?)`, userID, kind, hash, data, time.Now().Add(lifetime).Unix())
+	if err != nil {
+		log.Println(err)
+		tx.Rollback()
+		return "", err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		log.Println(err)
+		return "", err
+	}
+
+	return plain, nil
+}
+
+// Consume returns the token if it is valid and removes it so it can't be used again.
+func (repo *Repo) Consume(plain string, kind string) (*Token, error) {
+	ctx := context.Background()
+
+	tx, err := repo.DB.BeginTx(ctx, nil)
+	if err != nil {
+		log.Println(err)
+		return nil, err
+	}
+
+	result := &Token{}
+	err = tx.QueryRowContext(ctx, `
+	SELECT id, user_id, kind, data, expires_at 
+	FROM user_tokens WHERE token_hash = ? AND kind = ?`, token.Hash(plain), kind).Scan(
+		&result.ID, &result.User_ID, &result.Kind, &result.Data, &result.Expires_At)
+
+	if err == sql.ErrNoRows {
+		tx.Rollback()
+		return nil, ErrInvalidToken
+	} else if err != nil {
+		log.Println(err)
+		tx.Rollback()
+		return nil, err
+	}
+
+	if _, err = tx.ExecContext(ctx, "DELETE FROM user_tokens WHERE id = ?", result.ID); err != nil {
+		log.Println(err)
+		tx.Rollback()
+		return nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		log.Println(err)
+		return nil, err
+	}
+
+	if result.Expires_At <= time.Now().Unix() {
+		return nil, ErrInvalidToken
+	}
+
+	return result, nil
+}
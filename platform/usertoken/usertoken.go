@@ -0,0 +1,22 @@
+package usertoken
+
+import (
+	"errors"
+)
+
+// Kinds of single-use tokens mailed to users.
+const (
+	PasswordReset = "password_reset"
+	EmailVerify   = "email_verify"   // Data holds the address being confirmed.
+	TOTPChallenge = "totp_challenge" // Data holds the remember flag of the login.
+)
+
+var ErrInvalidToken = errors.New("Invalid or expired token.")
+
+type Token struct {
+	ID         int64
+	User_ID    int64
+	Kind       string
+	Data       string
+	Expires_At int64
+}